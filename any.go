@@ -0,0 +1,58 @@
+package yarp
+
+import "bytes"
+
+// Any is a well-known message carrying an arbitrary registered message,
+// identified by its YarpID, along with its encoded representation. Any allows
+// messages to hold late-bound payloads, whose types are only resolved when
+// Unpack is called. See NewAny.
+type Any struct {
+	*Structure
+	ID    uint64     `index:"0"`
+	Value RawMessage `index:"1"`
+}
+
+func (Any) YarpID() uint64         { return AnyID }
+func (Any) YarpPackage() string    { return "io.libyarp" }
+func (Any) YarpStructName() string { return "Any" }
+
+// NewAny encodes a given message into a new Any instance.
+func NewAny(v StructValuer) (*Any, error) {
+	data, err := Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Any{ID: v.YarpID(), Value: data}, nil
+}
+
+// Is indicates whether the receiver holds a message of the same type as v.
+func (a Any) Is(v StructValuer) bool {
+	return a.ID == v.YarpID()
+}
+
+// Unpack decodes the message held by the receiver, returning a pointer to a
+// new instance of its type. Returns ErrUnknownStructType in case the message's
+// type is not registered.
+func (a Any) Unpack() (StructValuer, error) {
+	if _, ok := registry[a.ID]; !ok {
+		return nil, ErrUnknownStructType
+	}
+	_, v, err := Decode(bytes.NewReader(a.Value))
+	if err != nil {
+		return nil, err
+	}
+	sv, ok := v.(StructValuer)
+	if !ok || sv.YarpID() != a.ID {
+		return nil, ErrStructTypeMismatch
+	}
+	return sv, nil
+}
+
+// UnpackTo decodes the message held by the receiver into dst, which must be a
+// pointer to a message of the same type. See DecodeReuse.
+func (a Any) UnpackTo(dst StructValuer) error {
+	if !a.Is(dst) {
+		return ErrStructTypeMismatch
+	}
+	return DecodeReuse(bytes.NewReader(a.Value), dst)
+}
@@ -0,0 +1,140 @@
+package yarp
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type Event struct {
+	*Structure
+	Name    string       `index:"0"`
+	Payload *Any         `index:"1"`
+	Plugin  StructValuer `index:"2"`
+}
+
+func (Event) YarpID() uint64         { return 0x5 }
+func (Event) YarpPackage() string    { return "io.vito" }
+func (Event) YarpStructName() string { return "Event" }
+
+func TestAny(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(Event{}, OtherTS{})
+
+	payload, err := NewAny(&OtherTS{Project: "Foo", Role: "Bar"})
+	require.NoError(t, err)
+	assert.True(t, payload.Is(OtherTS{}))
+	assert.False(t, payload.Is(Event{}))
+
+	data, err := Encode(Event{
+		Name:    "created",
+		Payload: payload,
+		Plugin:  &OtherTS{Project: "Plugin"},
+	})
+	require.NoError(t, err)
+
+	_, decoded, err := Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	ev := decoded.(*Event)
+	assert.Equal(t, "created", ev.Name)
+	require.NotNil(t, ev.Payload)
+	assert.Equal(t, OtherTS{}.YarpID(), ev.Payload.ID)
+
+	v, err := ev.Payload.Unpack()
+	require.NoError(t, err)
+	assert.Equal(t, "Foo", v.(*OtherTS).Project)
+	assert.Equal(t, "Bar", v.(*OtherTS).Role)
+
+	other := &OtherTS{}
+	require.NoError(t, ev.Payload.UnpackTo(other))
+	assert.Equal(t, "Foo", other.Project)
+	assert.ErrorIs(t, ev.Payload.UnpackTo(&Event{}), ErrStructTypeMismatch)
+
+	plugin, ok := ev.Plugin.(*OtherTS)
+	require.True(t, ok)
+	assert.Equal(t, "Plugin", plugin.Project)
+
+	data, err = Encode(Event{Name: "empty"})
+	require.NoError(t, err)
+	_, decoded, err = Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Nil(t, decoded.(*Event).Payload)
+	assert.Nil(t, decoded.(*Event).Plugin)
+
+	resetRegistry()
+	_, err = payload.Unpack()
+	assert.ErrorIs(t, err, ErrUnknownStructType)
+}
+
+type Holder struct {
+	*Structure
+	Value interface{} `index:"0"`
+}
+
+func (Holder) YarpID() uint64         { return 0x6 }
+func (Holder) YarpPackage() string    { return "io.vito" }
+func (Holder) YarpStructName() string { return "Holder" }
+
+func TestInterfaceFieldRequiresMessage(t *testing.T) {
+	_, err := Encode(Holder{Value: "string"})
+	assert.Error(t, err)
+
+	_, err = Encode(Holder{Value: OtherTS{Project: "Foo"}})
+	assert.NoError(t, err)
+}
+
+type messageStreamer struct {
+	h  Header
+	ch chan<- StructValuer
+}
+
+func (s messageStreamer) Headers() Header     { return s.h }
+func (s messageStreamer) Push(v StructValuer) { s.ch <- v }
+
+type readerStreamer struct {
+	h  Header
+	ch chan<- io.Reader
+}
+
+func (s readerStreamer) Headers() Header  { return s.h }
+func (s readerStreamer) Push(v io.Reader) { s.ch <- v }
+
+func TestCanEncodeInterfaces(t *testing.T) {
+	for _, v := range []interface{}{
+		(*StructValuer)(nil),
+		(*FastEncoder)(nil),
+		[]StructValuer{},
+		map[string]StructValuer{},
+	} {
+		typ := reflect.TypeOf(v)
+		if typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+		assert.True(t, canEncode(typ), typ.String())
+	}
+
+	for _, v := range []interface{}{
+		(*interface{})(nil),
+		(*io.Reader)(nil),
+		(*error)(nil),
+		[]interface{}{},
+		map[string]interface{}{},
+	} {
+		typ := reflect.TypeOf(v)
+		if typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+		assert.False(t, canEncode(typ), typ.String())
+	}
+
+	assert.True(t, isStreamer(reflect.TypeOf(&messageStreamer{})))
+	assert.False(t, isStreamer(reflect.TypeOf(&readerStreamer{})))
+
+	_, err := Encode(map[string]interface{}{"a": &OtherTS{}})
+	assert.Error(t, err)
+	_, err = Encode(map[string]StructValuer{"a": &OtherTS{}})
+	assert.NoError(t, err)
+}
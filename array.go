@@ -6,43 +6,77 @@ import (
 	"reflect"
 )
 
-func encodeArray(val reflect.Value) ([]byte, error) {
+func (c codec) encodeArray(val reflect.Value) ([]byte, error) {
+	return c.appendArray(nil, val)
+}
+
+func (c codec) appendArray(dst []byte, val reflect.Value) ([]byte, error) {
+	size, err := c.arrayBodySize(val)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		if !val.IsNil() && c.emptyContainers() {
+			return append(dst, 0x70), nil
+		}
+		return append(dst, 0x60), nil
+	}
+
+	dst = appendInteger(dst, uint64(size), 0x60)
+	for i := 0; i < val.Len(); i++ {
+		if dst, err = c.appendEncode(dst, val.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+func (c codec) sizeArray(val reflect.Value) (int, error) {
+	size, err := c.arrayBodySize(val)
+	if err != nil || size == 0 {
+		return 1, err
+	}
+	return sizeInteger(uint64(size)) + size, nil
+}
+
+// arrayBodySize type-checks val, and returns the amount of bytes required to
+// encode its items.
+func (c codec) arrayBodySize(val reflect.Value) (int, error) {
 	if val.Kind() != reflect.Slice {
-		return nil, fmt.Errorf("encodeArray invoked for non-array type %s", val.String())
+		return 0, fmt.Errorf("encodeArray invoked for non-array type %s", val.String())
 	}
 	if val.Len() == 0 {
-		return []byte{0x60}, nil
+		return 0, nil
 	}
 
 	sliceLen := val.Len()
 	sliceType := val.Index(0).Type()
-	// Type-check
+	size := 0
 	for i := 0; i < sliceLen; i++ {
-		if val.Index(i).Type() != sliceType {
-			return nil, ErrNonHomogeneousArray
+		item := val.Index(i)
+		if item.Type() != sliceType {
+			return 0, ErrNonHomogeneousArray
 		}
-	}
-
-	var buf []byte
-	for i := 0; i < sliceLen; i++ {
-		b, err := encode(val.Index(i))
+		n, err := c.size(item)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-		buf = append(buf, b...)
+		size += n
 	}
-	header := encodeInteger(uint64(len(buf)))
-	header[0] = header[0] | 0x60
-	return append(header, buf...), nil
+	return size, nil
 }
 
-func decodeArray(header byte, r io.Reader) ([]interface{}, error) {
+func (c codec) decodeArray(header byte, r io.Reader) ([]interface{}, error) {
 	var data []interface{}
-	_, size, err := decodeScalar(header, r)
+	empty, size, err := decodeScalar(header, r)
 	if err != nil {
 		return nil, err
 	}
 	if size == 0 {
+		if empty {
+			// Explicitly empty array; see WireVersion4.
+			return []interface{}{}, nil
+		}
 		return nil, nil
 	} else if size >= sizeLimit {
 		return nil, ErrSizeTooLarge
@@ -50,7 +84,7 @@ func decodeArray(header byte, r io.Reader) ([]interface{}, error) {
 
 	reader := io.LimitReader(r, int64(size))
 	for {
-		t, v, err := Decode(reader)
+		t, v, err := c.decode(reader)
 		if err != nil {
 			if err == io.EOF {
 				break
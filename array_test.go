@@ -14,7 +14,7 @@ func TestArrayInts(t *testing.T) {
 		0xFF,
 		0xEE,
 	}
-	encoded, err := encodeArray(reflect.ValueOf(items))
+	encoded, err := defaultCodec.encodeArray(reflect.ValueOf(items))
 	require.NoError(t, err)
 	require.Equal(t, []byte{0x61, 0xc, 0x23, 0x80, 0x23, 0xfe, 0x23, 0xdc}, encoded)
 	ty, decoded, err := Decode(bytes.NewReader(encoded))
@@ -31,7 +31,7 @@ func TestArrayStrings(t *testing.T) {
 		"Caffé",
 		"Covfefe",
 	}
-	encoded, err := encodeArray(reflect.ValueOf(items))
+	encoded, err := defaultCodec.encodeArray(reflect.ValueOf(items))
 	require.NoError(t, err)
 	require.Equal(t, []byte{0x61, 0x32, 0xa1, 0xc, 0x43, 0x6f, 0x66, 0x66, 0x65, 0x65, 0xa1, 0xc, 0x43, 0x61, 0x66, 0x66, 0xc3, 0xa9, 0xa1, 0xe, 0x43, 0x6f, 0x76, 0x66, 0x65, 0x66, 0x65}, encoded)
 	ty, decoded, err := Decode(bytes.NewReader(encoded))
@@ -48,7 +48,7 @@ func TestArrayFloat(t *testing.T) {
 		0.2,
 		0.3,
 	}
-	encoded, err := encodeArray(reflect.ValueOf(items))
+	encoded, err := defaultCodec.encodeArray(reflect.ValueOf(items))
 	require.NoError(t, err)
 	require.Equal(t, []byte{0x61, 0x1e, 0x40, 0xcd, 0xcc, 0xcc, 0x3d, 0x40, 0xcd, 0xcc, 0x4c, 0x3e, 0x40, 0x9a, 0x99, 0x99, 0x3e}, encoded)
 	ty, decoded, err := Decode(bytes.NewReader(encoded))
@@ -58,3 +58,34 @@ func TestArrayFloat(t *testing.T) {
 	assert.EqualValues(t, 0.2, decoded.([]interface{})[1])
 	assert.EqualValues(t, 0.3, decoded.([]interface{})[2])
 }
+
+func TestArrayEmpty(t *testing.T) {
+	v4 := newCodec(WireVersion4)
+	for _, c := range []codec{defaultCodec, v4} {
+		encoded, err := c.encodeArray(reflect.ValueOf([]string(nil)))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x60}, encoded)
+	}
+
+	encoded, err := defaultCodec.encodeArray(reflect.ValueOf([]string{}))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x60}, encoded)
+
+	encoded, err = v4.encodeArray(reflect.ValueOf([]string{}))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x70}, encoded)
+	ty, decoded, err := v4.decode(bytes.NewReader(encoded))
+	require.NoError(t, err)
+	assert.Equal(t, Array, ty)
+	assert.NotNil(t, decoded)
+	assert.Empty(t, decoded)
+
+	// The flag is honoured by decoders regardless of their versions, since
+	// it is never set by older encoders.
+	_, decoded, err = defaultCodec.decode(bytes.NewReader(encoded))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{}, decoded)
+	_, decoded, err = v4.decode(bytes.NewReader([]byte{0x60}))
+	require.NoError(t, err)
+	assert.Nil(t, decoded)
+}
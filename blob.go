@@ -0,0 +1,357 @@
+package yarp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// blobChunkSize determines the maximum size of each chunk written when
+// streaming a Blob.
+const blobChunkSize = 32 << 10
+
+// Blob represents a potentially large binary payload, and may be used as a
+// message field through a *Blob. Blobs are backed by an io.Reader when
+// encoded, and exposed as an io.Reader when decoded.
+//
+// When both peers use WireVersion5 or newer, a Blob held by the last field of
+// a request, response or stream item is streamed in chunks directly from its
+// reader into the connection, and the receiving side reads them lazily from
+// the connection as the Blob is read. For that to be possible, the following
+// rules apply:
+//   - A message may have at most one *Blob field, which must be the one with
+//     the highest index, and must not be a oneof member;
+//   - Blobs are only streamed when held by the top-level message. Blobs held by
+//     nested messages, slices or maps are buffered, and are subject to the
+//     same size limit as other values;
+//   - A streamed Blob must be read until io.EOF, or closed, before values
+//     following its message can be read. Clients keep the connection of a
+//     unary response open until its Blob is either fully read or closed, and
+//     only deliver the next item of a stream after the current item's Blob was
+//     consumed. The trailer of a unary response containing a streamed Blob is
+//     provided by Blob.Trailer.
+//
+// In all other cases, including Encode and Decode, the Blob's contents are
+// fully buffered and encoded as a regular String value, which is also how a
+// Blob is presented to peers unaware of Blobs.
+type Blob struct {
+	r      io.Reader
+	data   []byte
+	chunks *blobChunks
+}
+
+var reflectedBlob = reflect.TypeOf(Blob{})
+var reflectedBlobPtr = reflect.TypeOf(&Blob{})
+
+// NewBlob returns a new Blob backed by a given reader.
+func NewBlob(r io.Reader) *Blob {
+	return &Blob{r: r}
+}
+
+// NewBlobBytes returns a new Blob holding a given byte slice.
+func NewBlobBytes(data []byte) *Blob {
+	return &Blob{r: bytes.NewReader(data), data: data}
+}
+
+// Read reads up to len(p) bytes from the Blob.
+func (b *Blob) Read(p []byte) (int, error) {
+	if b.chunks != nil {
+		return b.chunks.Read(p)
+	}
+	if b.r == nil {
+		return 0, io.EOF
+	}
+	return b.r.Read(p)
+}
+
+// Close discards all unread contents of a Blob obtained from a stream,
+// allowing values following it to be read. For other Blobs, Close closes the
+// underlying reader, in case it implements io.Closer.
+func (b *Blob) Close() error {
+	if b.chunks != nil {
+		return b.chunks.discard()
+	}
+	if c, ok := b.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// materialize reads all the Blob's contents into memory, allowing it to be
+// encoded as a regular value.
+func (b *Blob) materialize() ([]byte, error) {
+	if b.data != nil || b.r == nil && b.chunks == nil {
+		return b.data, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(b, int64(sizeLimit)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) >= sizeLimit {
+		return nil, ErrSizeTooLarge
+	}
+	b.r, b.data, b.chunks = bytes.NewReader(data), data, nil
+	return data, nil
+}
+
+// Trailer returns the trailer headers provided by the server after a Blob
+// streamed as part of a unary response, once the Blob was read until io.EOF
+// or closed. Returns nil for other Blobs, or while the Blob is being read.
+func (b *Blob) Trailer() map[string]string {
+	if b.chunks == nil {
+		return nil
+	}
+	select {
+	case <-b.chunks.done:
+		return b.chunks.trailer
+	default:
+		return nil
+	}
+}
+
+// streaming indicates whether b is being read from a stream, and must be
+// consumed before values following it are read.
+func (b *Blob) streaming() bool {
+	return b != nil && b.chunks != nil
+}
+
+// done returns a channel closed once a streamed Blob was fully read or
+// discarded.
+func (b *Blob) done() <-chan struct{} {
+	return b.chunks.done
+}
+
+// blobChunks reads the chunks of a streamed Blob. Each chunk is comprised of
+// an unsigned scalar indicating its size followed by its bytes, and the last
+// chunk has size zero.
+type blobChunks struct {
+	r         io.Reader
+	remaining uint64
+	err       error
+	done      chan struct{}
+	once      sync.Once
+	trailer   map[string]string
+
+	// release, when set, is called once the Blob is finished, before done
+	// is closed. An error returned by it replaces io.EOF.
+	release func(err error) error
+}
+
+func newBlobChunks(r io.Reader) *blobChunks {
+	return &blobChunks{r: r, done: make(chan struct{})}
+}
+
+func (c *blobChunks) finish(err error) {
+	c.once.Do(func() {
+		if c.release != nil {
+			if rerr := c.release(err); rerr != nil && err == io.EOF {
+				err = rerr
+			}
+		}
+		close(c.done)
+	})
+	c.err = err
+}
+
+func (c *blobChunks) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.remaining == 0 {
+		head := []byte{0x00}
+		if _, err := io.ReadFull(c.r, head); err != nil {
+			c.finish(unexpectedEOF(err))
+			return 0, c.err
+		}
+		_, size, err := decodeScalar(head[0], c.r)
+		if err != nil {
+			c.finish(unexpectedEOF(err))
+			return 0, c.err
+		}
+		if size >= sizeLimit {
+			c.finish(ErrSizeTooLarge)
+			return 0, c.err
+		}
+		if size == 0 {
+			c.finish(io.EOF)
+			return 0, c.err
+		}
+		c.remaining = size
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= uint64(n)
+	if err != nil {
+		c.finish(unexpectedEOF(err))
+		return n, c.err
+	}
+	return n, nil
+}
+
+func (c *blobChunks) discard() error {
+	_, err := io.Copy(io.Discard, c)
+	if err == nil {
+		c.finish(ErrBlobClosed)
+	}
+	return err
+}
+
+// writeBlobChunks writes the contents of b to w as chunks.
+func writeBlobChunks(w io.Writer, b *Blob) error {
+	buf := make([]byte, blobChunkSize+16)
+	for {
+		n, err := io.ReadFull(b, buf[16:])
+		if n > 0 {
+			var headBuf [16]byte
+			head := appendUint(headBuf[:0], uint64(n))
+			start := 16 - len(head)
+			copy(buf[start:], head)
+			if _, werr := w.Write(buf[start : 16+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(encodeUint(0))
+	return err
+}
+
+func (c codec) appendBlob(dst []byte, b *Blob) ([]byte, error) {
+	if c.streamBlobs {
+		return append(dst, 0xB0), nil
+	}
+	data, err := b.materialize()
+	if err != nil {
+		return nil, err
+	}
+	dst = appendInteger(dst, uint64(len(data)), 0xA0)
+	return append(dst, data...), nil
+}
+
+func (c codec) sizeBlob(b *Blob) (int, error) {
+	if c.streamBlobs {
+		return 1, nil
+	}
+	data, err := b.materialize()
+	if err != nil {
+		return 0, err
+	}
+	return sizeInteger(uint64(len(data))) + len(data), nil
+}
+
+// blobFromString converts a regular String value into a Blob.
+func blobFromString(s string) *Blob {
+	return &Blob{r: strings.NewReader(s)}
+}
+
+// bindBlob prepares a streamed Blob decoded as the value of a struct field,
+// making it read chunks from the reader enclosing body, which is the reader
+// limited to the struct's contents. Streamed Blobs are only valid as the last
+// value in a struct.
+func bindBlob(b *Blob, body io.Reader) error {
+	lr, ok := body.(*io.LimitedReader)
+	if !ok || lr.N != 0 {
+		return ErrCorruptStream
+	}
+	b.chunks.r = lr.R
+	return nil
+}
+
+// skipBlob discards the chunks of a streamed Blob whose marker was read from r.
+func skipBlob(r io.Reader) error {
+	if lr, ok := r.(*io.LimitedReader); ok && lr.N == 0 {
+		r = lr.R
+	}
+	return newBlobChunks(r).discard()
+}
+
+// holdConn keeps the connection a streamed Blob b is read from open while b
+// is being read. finish is called once, with the error that finished b, if
+// any, and must close the connection. That happens once b is finished, once
+// ctx is done, or once b is garbage collected without being finished. When b
+// reaches io.EOF, trailer is called to read the headers following it, which
+// are then provided by Blob.Trailer.
+func holdConn(ctx context.Context, b *Blob, finish func(err error), trailer func() (map[string]string, error)) {
+	var once sync.Once
+	release := func(err error) {
+		once.Do(func() { finish(contextError(ctx, err)) })
+	}
+	chunks := b.chunks
+	chunks.release = func(err error) error {
+		if err != io.EOF {
+			release(err)
+			return nil
+		}
+		t, err := trailer()
+		chunks.trailer = t
+		release(err)
+		return err
+	}
+	abandoned := make(chan struct{})
+	runtime.SetFinalizer(b, func(*Blob) { close(abandoned) })
+	go func() {
+		select {
+		case <-chunks.done:
+		case <-ctx.Done():
+			release(ctx.Err())
+		case <-abandoned:
+			release(errBlobAbandoned)
+		}
+	}()
+}
+
+// topLevelBlob returns the Blob held by the last field of the message in v,
+// if any.
+func topLevelBlob(v reflect.Value) *Blob {
+	for v.IsValid() && (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Kind() != reflect.Struct || !canEncodeStruct(v.Type()) {
+		return nil
+	}
+	fields, err := validateAndExtractStruct(v.Type())
+	if err != nil || len(fields) == 0 {
+		return nil
+	}
+	f := fields[len(fields)-1]
+	if f.OneOf || f.Field.Type != reflectedBlobPtr {
+		return nil
+	}
+	b, _ := v.FieldByIndex(f.Field.Index).Interface().(*Blob)
+	return b
+}
+
+// streaming returns a copy of c that writes a marker in place of a Blob held
+// by the top-level message being encoded, in case c's version allows Blobs to
+// be streamed. In that case, the Blob's contents must be written after the
+// message through writeBlob.
+func (c codec) streaming() codec {
+	c.streamBlobs = c.blobStreaming()
+	return c
+}
+
+// writeBlob streams the contents of the Blob held by the message in v to w,
+// in case c was obtained through streaming, and v holds a Blob.
+func (c codec) writeBlob(w io.Writer, v reflect.Value) error {
+	if !c.streamBlobs {
+		return nil
+	}
+	if b := topLevelBlob(v); b != nil {
+		return writeBlobChunks(w, b)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package yarp
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type Upload struct {
+	*Structure
+	Name string `index:"0"`
+	Data *Blob  `index:"1"`
+}
+
+func (Upload) YarpID() uint64         { return 0xd }
+func (Upload) YarpPackage() string    { return "io.vito" }
+func (Upload) YarpStructName() string { return "Upload" }
+
+type UploadStreamer struct {
+	h  Header
+	ch chan<- *Upload
+}
+
+func (i UploadStreamer) Headers() Header { return i.h }
+func (i UploadStreamer) Push(v *Upload)  { i.ch <- v }
+
+type MisplacedBlob struct {
+	*Structure
+	Data *Blob  `index:"0"`
+	Name string `index:"1"`
+}
+
+func (MisplacedBlob) YarpID() uint64         { return 0xe }
+func (MisplacedBlob) YarpPackage() string    { return "io.vito" }
+func (MisplacedBlob) YarpStructName() string { return "MisplacedBlob" }
+
+type OneOfBlob struct {
+	*Structure
+	Name    *string `index:"0,0"`
+	HasName bool
+	Data    *Blob `index:"0,1"`
+	HasData bool
+}
+
+func (OneOfBlob) YarpID() uint64         { return 0xf }
+func (OneOfBlob) YarpPackage() string    { return "io.vito" }
+func (OneOfBlob) YarpStructName() string { return "OneOfBlob" }
+
+func blobFixture(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestBlobBuffered(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(Upload{})
+
+	data := blobFixture(1024)
+	encoded, err := Encode(Upload{Name: "a", Data: NewBlob(bytes.NewReader(data))})
+	require.NoError(t, err)
+
+	// Buffered Blobs are encoded as regular strings
+	assert.Equal(t, byte(0xA0), encoded[len(encoded)-len(data)-3]&0xF0)
+
+	_, v, err := Decode(bytes.NewReader(encoded))
+	require.NoError(t, err)
+	require.IsType(t, &Upload{}, v)
+	u := v.(*Upload)
+	assert.Equal(t, "a", u.Name)
+	assert.False(t, u.Data.streaming())
+	read, err := io.ReadAll(u.Data)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+
+	t.Run("nil", func(t *testing.T) {
+		encoded, err := Encode(Upload{Name: "a"})
+		require.NoError(t, err)
+		_, v, err := Decode(bytes.NewReader(encoded))
+		require.NoError(t, err)
+		assert.Nil(t, v.(*Upload).Data)
+	})
+
+	t.Run("size", func(t *testing.T) {
+		v := Upload{Name: "a", Data: NewBlobBytes(data)}
+		size, err := Size(v)
+		require.NoError(t, err)
+		assert.Equal(t, len(encoded), size)
+	})
+}
+
+func TestBlobStreamed(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(Upload{})
+
+	// Larger than a single chunk
+	data := blobFixture(blobChunkSize*2 + 17)
+	buf := &bytes.Buffer{}
+	c := newCodec(LatestWireVersion).streaming()
+	for i := 0; i < 3; i++ {
+		v := reflect.ValueOf(Upload{Name: strconv.Itoa(i), Data: NewBlob(bytes.NewReader(data))})
+		encoded, err := c.appendEncode(nil, v)
+		require.NoError(t, err)
+		buf.Write(encoded)
+		require.NoError(t, c.writeBlob(buf, v))
+	}
+
+	dec := newCodec(LatestWireVersion)
+	_, v, err := dec.decode(buf)
+	require.NoError(t, err)
+	u := v.(*Upload)
+	assert.Equal(t, "0", u.Name)
+	require.True(t, u.Data.streaming())
+	read, err := io.ReadAll(u.Data)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+	<-u.Data.done()
+
+	// Closing a Blob discards its contents
+	_, v, err = dec.decode(buf)
+	require.NoError(t, err)
+	u = v.(*Upload)
+	assert.Equal(t, "1", u.Name)
+	require.NoError(t, u.Data.Close())
+	_, err = u.Data.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrBlobClosed)
+
+	// Projections skip streamed Blobs entirely
+	projected := Upload{}
+	require.NoError(t, DecodeFields(buf, &projected, 0))
+	assert.Equal(t, "2", projected.Name)
+	assert.Nil(t, projected.Data)
+	assert.Zero(t, buf.Len())
+}
+
+func TestBlobInvalidFields(t *testing.T) {
+	_, err := validateAndExtractStruct(reflect.ValueOf(MisplacedBlob{}).Type())
+	assert.ErrorIs(t, err, ErrInvalidBlobField)
+	_, err = validateAndExtractStruct(reflect.ValueOf(OneOfBlob{}).Type())
+	assert.ErrorIs(t, err, ErrInvalidBlobField)
+}
+
+func TestBlobServer(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(Upload{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	data := blobFixture(blobChunkSize*3 + 1)
+	s := NewServer(l.Addr().String())
+	s.RegisterHandler(0x1, "io.vito.Blobs.echo", func(ctx context.Context, headers Header, req *Upload) (Header, *Upload, error) {
+		read, err := io.ReadAll(req.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		SetTrailer(ctx, "Length", strconv.Itoa(len(read)))
+		return nil, &Upload{Name: strconv.Itoa(len(read)), Data: NewBlobBytes(read)}, nil
+	})
+	s.RegisterHandler(0x2, "io.vito.Blobs.split", func(ctx context.Context, headers Header, req *Upload, out *UploadStreamer) error {
+		for i := 0; i < 3; i++ {
+			out.Push(&Upload{Name: strconv.Itoa(i), Data: NewBlobBytes(data)})
+		}
+		return nil
+	})
+	stalled, stall := io.Pipe()
+	t.Cleanup(func() {
+		_ = stall.Close()
+	})
+	s.RegisterHandler(0x3, "io.vito.Blobs.stall", func(ctx context.Context, headers Header, req *Upload) (Header, *Upload, error) {
+		return nil, &Upload{Data: NewBlob(stalled)}, nil
+	})
+	go func() {
+		_ = s.StartListener(l)
+	}()
+
+	c := NewClient(l.Addr().String())
+
+	t.Run("unary", func(t *testing.T) {
+		res, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &Upload{Data: NewBlobBytes(data)})
+		require.NoError(t, err)
+		u := res.(*Upload)
+		assert.Equal(t, strconv.Itoa(len(data)), u.Name)
+		read, err := io.ReadAll(u.Data)
+		require.NoError(t, err)
+		assert.Equal(t, data, read)
+	})
+
+	latest := NewClient(l.Addr().String(), WithWireVersion(LatestWireVersion))
+
+	t.Run("unary trailer", func(t *testing.T) {
+		res, _, err := latest.DoRequest(context.Background(), Request{Method: 0x1}, &Upload{Data: NewBlobBytes(data)})
+		require.NoError(t, err)
+		u := res.(*Upload)
+		require.True(t, u.Data.streaming())
+		assert.Nil(t, u.Data.Trailer())
+		read, err := io.ReadAll(u.Data)
+		require.NoError(t, err)
+		assert.Equal(t, data, read)
+		assert.Equal(t, strconv.Itoa(len(data)), Header(u.Data.Trailer()).Get("Length"))
+	})
+
+	t.Run("unary closed", func(t *testing.T) {
+		res, _, err := latest.DoRequest(context.Background(), Request{Method: 0x1}, &Upload{Data: NewBlobBytes(data)})
+		require.NoError(t, err)
+		u := res.(*Upload)
+		require.NoError(t, u.Data.Close())
+		assert.Equal(t, strconv.Itoa(len(data)), Header(u.Data.Trailer()).Get("Length"))
+	})
+
+	t.Run("unary canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		res, _, err := latest.DoRequest(ctx, Request{Method: 0x3}, &Upload{})
+		require.NoError(t, err)
+		u := res.(*Upload)
+		time.AfterFunc(10*time.Millisecond, cancel)
+		_, err = io.ReadAll(u.Data)
+		assert.Error(t, err)
+		assert.Nil(t, u.Data.Trailer())
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		ch, _, err := c.DoRequestStreamed(context.Background(), Request{Method: 0x2}, &Upload{})
+		require.NoError(t, err)
+		count := 0
+		for v := range ch {
+			u := v.(*Upload)
+			assert.Equal(t, strconv.Itoa(count), u.Name)
+			if count == 1 {
+				require.NoError(t, u.Data.Close())
+			} else {
+				read, err := io.ReadAll(u.Data)
+				require.NoError(t, err)
+				assert.Equal(t, data, read)
+			}
+			count++
+		}
+		assert.Equal(t, 3, count)
+	})
+
+	t.Run("older wire version", func(t *testing.T) {
+		c := NewClient(l.Addr().String(), WithWireVersion(WireVersion4))
+		res, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &Upload{Data: NewBlobBytes(data)})
+		require.NoError(t, err)
+		u := res.(*Upload)
+		assert.False(t, u.Data.streaming())
+		read, err := io.ReadAll(u.Data)
+		require.NoError(t, err)
+		assert.Equal(t, data, read)
+	})
+}
+
+func TestBlobAbandoned(t *testing.T) {
+	closed := make(chan error, 1)
+	func() {
+		b := &Blob{chunks: newBlobChunks(bytes.NewReader(nil))}
+		holdConn(context.Background(), b, func(err error) { closed <- err }, func() (map[string]string, error) {
+			return nil, nil
+		})
+	}()
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		select {
+		case err := <-closed:
+			assert.Equal(t, errBlobAbandoned, err)
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("connection held by an abandoned Blob was not closed")
+}
@@ -0,0 +1,115 @@
+package yarp
+
+import (
+	"io"
+	"strconv"
+)
+
+// WireVersion identifies a revision of the YARP wire format. Newer revisions
+// are only used when both peers agree on them, either explicitly through
+// EncodeVersion and DecodeVersion, or through the negotiation performed by
+// Client and Server. See WithWireVersion.
+type WireVersion uint8
+
+const (
+	// WireVersion1 is the original wire format, in which signed integers are
+	// written as their two's complement representation.
+	WireVersion1 WireVersion = 1
+
+	// WireVersion2 writes signed integers using ZigZag encoding, so values
+	// with small magnitudes, such as -1, take as little as a single byte. All
+	// other types are encoded exactly as in WireVersion1.
+	WireVersion2 WireVersion = 2
+
+	// WireVersion3 allows structs implementing SparseStructValuer to be
+	// encoded using a sparse layout. See SparseStructValuer.
+	WireVersion3 WireVersion = 3
+
+	// WireVersion4 distinguishes nil slices and maps from empty ones. Empty,
+	// non-nil values are written with the sign bit of their headers set, and
+	// decoded as empty values instead of nil. Decoders unaware of this flag
+	// simply decode such values as nil, as they did before.
+	WireVersion4 WireVersion = 4
+
+	// WireVersion5 allows Blobs held by requests, responses and stream items
+	// to be streamed in chunks. See Blob.
+	WireVersion5 WireVersion = 5
+
+	// LatestWireVersion represents the most recent wire version supported by
+	// this implementation.
+	LatestWireVersion = WireVersion5
+)
+
+// wireVersionHeader is the reserved header used by clients to announce the
+// wire version used to encode a request, and by servers to indicate the
+// version used to encode a response.
+const wireVersionHeader = "Yarp-Wire-Version"
+
+// codec carries settings affecting how values are written to and read from a
+// stream. The zero value is not valid; use defaultCodec or newCodec.
+type codec struct {
+	version WireVersion
+
+	// streamBlobs indicates that a Blob held by the value being encoded must
+	// be written as a marker, as its contents are streamed afterwards. See
+	// writeValue.
+	streamBlobs bool
+}
+
+var defaultCodec = codec{version: WireVersion1}
+
+func newCodec(version WireVersion) codec {
+	return codec{version: version}
+}
+
+func (c codec) zigZag() bool {
+	return c.version >= WireVersion2
+}
+
+func (c codec) sparseStructs() bool {
+	return c.version >= WireVersion3
+}
+
+func (c codec) emptyContainers() bool {
+	return c.version >= WireVersion4
+}
+
+func (c codec) blobStreaming() bool {
+	return c.version >= WireVersion5
+}
+
+// parseWireVersion parses a value obtained from the wire version header. An
+// empty value indicates a peer unaware of versioning, and is therefore
+// interpreted as WireVersion1.
+func parseWireVersion(v string) (WireVersion, error) {
+	if v == "" {
+		return WireVersion1, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 8)
+	if err != nil || n < uint64(WireVersion1) || n > uint64(LatestWireVersion) {
+		return 0, ErrUnsupportedWireVersion
+	}
+	return WireVersion(n), nil
+}
+
+func (w WireVersion) String() string {
+	return strconv.Itoa(int(w))
+}
+
+// EncodeVersion works like Encode, but writes v using the provided wire
+// version.
+func EncodeVersion(v interface{}, version WireVersion) ([]byte, error) {
+	if version < WireVersion1 || version > LatestWireVersion {
+		return nil, ErrUnsupportedWireVersion
+	}
+	return newCodec(version).encodeInterface(v)
+}
+
+// DecodeVersion works like Decode, but reads r expecting values written using
+// the provided wire version.
+func DecodeVersion(r io.Reader, version WireVersion) (Type, interface{}, error) {
+	if version < WireVersion1 || version > LatestWireVersion {
+		return Invalid, nil, ErrUnsupportedWireVersion
+	}
+	return newCodec(version).decode(r)
+}
@@ -0,0 +1,106 @@
+package yarp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// deadlineHeader is the reserved header used by clients to indicate how many
+// milliseconds remain until the caller gives up on a request. Servers use it
+// to set the deadline of the context provided to handlers.
+const deadlineHeader = "Yarp-Deadline"
+
+// errInvalidDeadline indicates that a request provided an invalid value
+// through the deadline header.
+var errInvalidDeadline = fmt.Errorf("invalid deadline")
+
+// formatDeadline returns the value of the deadline header for a given ctx, or
+// an empty string in case ctx has no deadline. Returns ctx's error in case it
+// is already done.
+func formatDeadline(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return "", nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return "", context.DeadlineExceeded
+	}
+	// Round up, so that requests with less than a millisecond remaining are
+	// not sent without a deadline.
+	ms := (remaining + time.Millisecond - 1) / time.Millisecond
+	return strconv.FormatInt(int64(ms), 10), nil
+}
+
+// parseDeadline parses a value obtained from the deadline header. Returns
+// zero in case v is empty, or exceeds the maximum time.Duration.
+func parseDeadline(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	ms, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || ms == 0 {
+		return 0, errInvalidDeadline
+	}
+	if ms > math.MaxInt64/uint64(time.Millisecond) {
+		return 0, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// capTimeout returns the timeout applied to a handler, given the deadline
+// provided by the client, and the maximum configured on the server. Zero
+// values indicate absent timeouts.
+func capTimeout(deadline, max time.Duration) time.Duration {
+	if max > 0 && (deadline == 0 || deadline > max) {
+		return max
+	}
+	return deadline
+}
+
+// watchedConn closes its connection in case a context is done before the
+// connection is closed, interrupting requests whose caller gave up.
+type watchedConn struct {
+	io.ReadWriteCloser
+	stop func()
+}
+
+func watchConn(ctx context.Context, c io.ReadWriteCloser) io.ReadWriteCloser {
+	if ctx.Done() == nil {
+		return c
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.Close()
+		case <-done:
+		}
+	}()
+	once := sync.Once{}
+	return watchedConn{c, func() {
+		once.Do(func() { close(done) })
+	}}
+}
+
+func (w watchedConn) Close() error {
+	w.stop()
+	return w.ReadWriteCloser.Close()
+}
+
+// contextError returns ctx's error in case it is done, since err was likely
+// caused by its connection being closed. Otherwise, err is returned.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package yarp
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseDeadline(t *testing.T) {
+	d, err := parseDeadline("")
+	require.NoError(t, err)
+	assert.Zero(t, d)
+
+	d, err = parseDeadline("1500")
+	require.NoError(t, err)
+	assert.Equal(t, 1500*time.Millisecond, d)
+
+	d, err = parseDeadline("18446744073709551615")
+	require.NoError(t, err)
+	assert.Zero(t, d)
+
+	for _, v := range []string{"0", "-1", "1s", "a"} {
+		_, err = parseDeadline(v)
+		assert.ErrorIs(t, err, errInvalidDeadline, v)
+	}
+}
+
+func TestFormatDeadline(t *testing.T) {
+	v, err := formatDeadline(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, v)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	v, err = formatDeadline(ctx)
+	require.NoError(t, err)
+	d, err := parseDeadline(v)
+	require.NoError(t, err)
+	assert.True(t, d > 59*time.Minute && d <= time.Hour, d)
+
+	cancel()
+	_, err = formatDeadline(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	deadlines := make(chan time.Duration, 1)
+	s := NewServer(l.Addr().String(), WithHandlerTimeout(time.Minute))
+	s.RegisterHandler(0x1, "io.vito.Deadlines.remaining", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		d, ok := ctx.Deadline()
+		if !ok {
+			deadlines <- 0
+		} else {
+			deadlines <- time.Until(d)
+		}
+		return nil, &SimpleResponse{}, nil
+	})
+	wait := func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	}
+	s.RegisterHandler(0x2, "io.vito.Deadlines.wait", wait)
+	finished := make(chan struct{})
+	s.RegisterHandler(0x4, "io.vito.Deadlines.waitLonger", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		defer close(finished)
+		return wait(ctx, headers, req)
+	})
+	s.RegisterHandler(0x3, "io.vito.Deadlines.runaway", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		time.Sleep(100 * time.Millisecond)
+		return nil, &SimpleResponse{}, nil
+	})
+	s.SetMethodTimeout("io.vito.Deadlines.wait", 50*time.Millisecond)
+	s.SetMethodTimeout("io.vito.Deadlines.runaway", 10*time.Millisecond)
+	s.SetMethodTimeout("io.vito.Deadlines.waitLonger", 200*time.Millisecond)
+	go func() {
+		_ = s.StartListener(l)
+	}()
+	c := NewClient(l.Addr().String())
+
+	t.Run("client deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, _, err := c.DoRequest(ctx, Request{Method: 0x1}, &SimpleRequest{})
+		require.NoError(t, err)
+		d := <-deadlines
+		assert.True(t, d > 9*time.Second && d <= 10*time.Second, d)
+	})
+
+	t.Run("capped by the server", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		defer cancel()
+		_, _, err := c.DoRequest(ctx, Request{Method: 0x1}, &SimpleRequest{})
+		require.NoError(t, err)
+		d := <-deadlines
+		assert.True(t, d > 59*time.Second && d <= time.Minute, d)
+
+		_, _, err = c.DoRequest(context.Background(), Request{Method: 0x1}, &SimpleRequest{})
+		require.NoError(t, err)
+		d = <-deadlines
+		assert.True(t, d > 59*time.Second && d <= time.Minute, d)
+	})
+
+	t.Run("handler deadline exceeded", func(t *testing.T) {
+		for _, method := range []uint64{0x2, 0x3} {
+			_, _, err := c.DoRequest(context.Background(), Request{Method: method}, &SimpleRequest{})
+			ok, managed := IsManagedError(err)
+			require.True(t, ok, err)
+			assert.Equal(t, ErrorKind(ErrorKindDeadlineExceeded), managed.Kind)
+		}
+	})
+
+	t.Run("client gives up", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		_, _, err := c.DoRequest(ctx, Request{Method: 0x4}, &SimpleRequest{})
+		assert.Equal(t, context.Canceled, err)
+
+		_, _, err = c.DoRequest(ctx, Request{Method: 0x4}, &SimpleRequest{})
+		assert.Equal(t, context.Canceled, err)
+		<-finished
+	})
+
+	t.Run("invalid deadline", func(t *testing.T) {
+		_, _, err := c.DoRequest(context.Background(), Request{Method: 0x1, Headers: map[string]string{deadlineHeader: "soon"}}, &SimpleRequest{})
+		ok, managed := IsManagedError(err)
+		require.True(t, ok, err)
+		assert.Equal(t, ErrorKind(ErrorKindBadRequest), managed.Kind)
+	})
+}
@@ -8,8 +8,14 @@ import (
 // Decode takes an io.Reader and attempts to decode it as either a primitive
 // type, or a registered message. Decode returns an error in case the provided
 // stream contains an unregistered message.
+// Decode expects values written using WireVersion1, as produced by Encode. Use
+// DecodeVersion to read values written using other versions.
 // Decode does not close r.
 func Decode(r io.Reader) (t Type, ret interface{}, err error) {
+	return defaultCodec.decode(r)
+}
+
+func (c codec) decode(r io.Reader) (t Type, ret interface{}, err error) {
 	defer func() {
 		if rawErr := recover(); rawErr != nil {
 			if innerErr, ok := rawErr.(error); ok {
@@ -25,6 +31,11 @@ func Decode(r io.Reader) (t Type, ret interface{}, err error) {
 	if _, err := r.Read(header); err != nil {
 		return Invalid, nil, err
 	}
+	return c.decodeWithHeader(header, r)
+}
+
+// decodeWithHeader decodes a value whose header was already consumed from r.
+func (c codec) decodeWithHeader(header []byte, r io.Reader) (Type, interface{}, error) {
 	switch detectType(header[0]) {
 	case Void:
 		return Void, nil, nil
@@ -33,6 +44,9 @@ func Decode(r io.Reader) (t Type, ret interface{}, err error) {
 		if err != nil {
 			return Scalar, nil, err
 		}
+		if s && c.zigZag() {
+			return Scalar, decodeZigZag(v), nil
+		}
 		if s {
 			return Scalar, int64(v), nil
 		}
@@ -47,19 +61,24 @@ func Decode(r io.Reader) (t Type, ret interface{}, err error) {
 		}
 		return Float, v, nil
 	case Array:
-		arr, err := decodeArray(header[0], r)
+		arr, err := c.decodeArray(header[0], r)
 		return Array, arr, err
 	case String:
+		if header[0]&0x10 == 0x10 {
+			// Streamed Blob, whose chunks follow the enclosing struct. See
+			// bindBlob.
+			return String, &Blob{chunks: newBlobChunks(r)}, nil
+		}
 		str, err := decodeString(header[0], r)
 		return String, str, err
 	case Struct:
-		str, err := decodeStructToConcrete(header[0], r)
+		str, err := c.decodeStructToConcrete(header[0], r)
 		return Struct, str, err
 	case Map:
-		m, err := decodeMap(header[0], r)
+		m, err := c.decodeMap(header[0], r)
 		return Map, m, err
 	case OneOf:
-		oo, err := decodeOneOf(header[0], r)
+		oo, err := c.decodeOneOf(header[0], r)
 		return OneOf, oo, err
 	default:
 		return Invalid, nil, ErrInvalidType
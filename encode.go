@@ -5,47 +5,149 @@ import (
 	"reflect"
 )
 
-func encode(v reflect.Value) ([]byte, error) {
+func (c codec) encode(v reflect.Value) ([]byte, error) {
+	return c.appendEncode(nil, v)
+}
+
+// appendEncode encodes v, appending it to dst, and returns the extended
+// buffer.
+func (c codec) appendEncode(dst []byte, v reflect.Value) ([]byte, error) {
+	if v.Type() == reflectedRawMessage {
+		if v.Len() == 0 {
+			return appendVoid(dst), nil
+		}
+		return append(dst, v.Bytes()...), nil
+	}
 	switch v.Kind() {
 	case reflect.Slice:
-		return encodeArray(v)
+		return c.appendArray(dst, v)
 	case reflect.String:
-		return encodeString(v.String()), nil
+		return appendString(dst, v.String()), nil
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return encodeUint(v.Uint()), nil
+		return appendUint(dst, v.Uint()), nil
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return encodeInt(v.Int()), nil
+		if c.zigZag() {
+			return appendZigZag(dst, v.Int()), nil
+		}
+		return appendInt(dst, v.Int()), nil
 	case reflect.Bool:
-		return encodeBool(v.Bool()), nil
+		return appendBool(dst, v.Bool()), nil
 	case reflect.Float32:
-		return encodeFloat32(float32(v.Float())), nil
+		return appendFloat32(dst, float32(v.Float())), nil
 	case reflect.Float64:
-		return encodeFloat64(v.Float()), nil
+		return appendFloat64(dst, v.Float()), nil
 	case reflect.Pointer:
 		if v.IsNil() {
-			return encodeVoid(), nil
+			return appendVoid(dst), nil
+		}
+		if v.Type() == reflectedBlobPtr {
+			return c.appendBlob(dst, v.Interface().(*Blob))
 		}
-		return encode(v.Elem())
+		return c.appendEncode(dst, v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			return appendVoid(dst), nil
+		}
+		if _, ok := v.Interface().(StructValuer); !ok {
+			return nil, fmt.Errorf("cannot encode interface value of type %s; only messages are supported", v.Elem().Type())
+		}
+		return c.appendEncode(dst, v.Elem())
 	case reflect.Struct:
-		return encodeStruct(v)
+		return c.appendStruct(dst, v)
 	case reflect.Map:
-		return encodeMap(v)
+		return c.appendMap(dst, v)
 	default:
 		return nil, fmt.Errorf("cannot encode type %s", v.Kind())
 	}
 }
 
-// Encode takes an arbitrary value and encodes it into a byte slice.
+// size returns the amount of bytes required to encode v, following the same
+// rules as appendEncode.
+func (c codec) size(v reflect.Value) (int, error) {
+	if v.Type() == reflectedRawMessage {
+		if v.Len() == 0 {
+			return 1, nil
+		}
+		return v.Len(), nil
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		return c.sizeArray(v)
+	case reflect.String:
+		return sizeString(v.String()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return sizeInteger(v.Uint()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if c.zigZag() {
+			return sizeInteger(zigZag(v.Int())), nil
+		}
+		return sizeInteger(uint64(v.Int())), nil
+	case reflect.Bool:
+		return 1, nil
+	case reflect.Float32:
+		return sizeFloat(v.Float(), 32), nil
+	case reflect.Float64:
+		return sizeFloat(v.Float(), 64), nil
+	case reflect.Pointer:
+		if v.IsNil() {
+			return 1, nil
+		}
+		if v.Type() == reflectedBlobPtr {
+			return c.sizeBlob(v.Interface().(*Blob))
+		}
+		return c.size(v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			return 1, nil
+		}
+		if _, ok := v.Interface().(StructValuer); !ok {
+			return 0, fmt.Errorf("cannot encode interface value of type %s; only messages are supported", v.Elem().Type())
+		}
+		return c.size(v.Elem())
+	case reflect.Struct:
+		return c.sizeStruct(v)
+	case reflect.Map:
+		return c.sizeMap(v)
+	default:
+		return 0, fmt.Errorf("cannot encode type %s", v.Kind())
+	}
+}
+
+// Encode takes an arbitrary value and encodes it into a byte slice, using
+// WireVersion1. Use EncodeVersion to write values using other versions.
 func Encode(v interface{}) (ret []byte, err error) {
-	defer func() {
-		if rawErr := recover(); rawErr != nil {
-			if innerErr, ok := rawErr.(error); ok {
-				err = innerErr
-				return
-			}
+	return defaultCodec.encodeInterface(v)
+}
+
+// AppendEncode works like Encode, but appends the encoded value to dst, and
+// returns the extended buffer. Callers may reuse buffers across calls to avoid
+// allocations.
+func AppendEncode(dst []byte, v interface{}) ([]byte, error) {
+	return defaultCodec.appendEncodeInterface(dst, v)
+}
 
-			err = fmt.Errorf("unexpected error during decode operation: %s", rawErr)
+// Size returns the amount of bytes required to encode v, without encoding it.
+func Size(v interface{}) (n int, err error) {
+	defer recoverEncodeError(&err)
+	return defaultCodec.size(reflect.ValueOf(v))
+}
+
+func (c codec) encodeInterface(v interface{}) (ret []byte, err error) {
+	return c.appendEncodeInterface(nil, v)
+}
+
+func (c codec) appendEncodeInterface(dst []byte, v interface{}) (ret []byte, err error) {
+	defer recoverEncodeError(&err)
+	return c.appendEncode(dst, reflect.ValueOf(v))
+}
+
+func recoverEncodeError(err *error) {
+	if rawErr := recover(); rawErr != nil {
+		if innerErr, ok := rawErr.(error); ok {
+			*err = innerErr
+			return
 		}
-	}()
-	return encode(reflect.ValueOf(v))
+
+		*err = fmt.Errorf("unexpected error during decode operation: %s", rawErr)
+	}
 }
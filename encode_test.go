@@ -0,0 +1,77 @@
+package yarp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"reflect"
+	"testing"
+)
+
+func TestAppendEncode(t *testing.T) {
+	prefix := []byte{0x01, 0x02}
+	v := TS{ID: 1, Name: "Vito", Keys: []string{"a"}, AMap: map[string]int{"b": 2}}
+	data, err := AppendEncode(prefix, v)
+	require.NoError(t, err)
+	encoded, err := Encode(v)
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte{0x01, 0x02}, encoded...), data)
+
+	// Buffers with enough capacity are reused.
+	buf := make([]byte, 0, 512)
+	data, err = AppendEncode(buf, v)
+	require.NoError(t, err)
+	assert.Same(t, &buf[:1][0], &data[0])
+
+	_, err = AppendEncode(nil, []int{1})
+	require.NoError(t, err)
+	_, err = AppendEncode(nil, make(chan int))
+	assert.Error(t, err)
+}
+
+func TestSize(t *testing.T) {
+	str, num := "str", 3
+	values := []interface{}{
+		0, -1, uint64(1 << 63), true, float32(0), 1.5, "", "Caffé",
+		[]string{}, []string{"a", "b"}, [][]int{{1}, {}},
+		map[string]int{}, map[string]int{"a": 1, "b": -300},
+		&num, (*int)(nil), RawMessage(nil), RawMessage{0x20},
+		TS{ID: 1, Name: "Vito", OneOfA: &str, Other: []OtherTS{{Project: "p"}}, OptionalTS: &OtherTS{}},
+		&TS{AMap: map[string]int{"a": 1}},
+		SparseTS{A: 1, Extra: "x"},
+		Matrix{Message: &OtherTS{}, MapOfMaps: map[string]map[int8]int{"a": {1: 2}}},
+		fastFixture(),
+	}
+	for _, version := range []WireVersion{WireVersion1, LatestWireVersion} {
+		c := newCodec(version)
+		for _, v := range values {
+			encoded, err := c.encodeInterface(v)
+			require.NoError(t, err)
+			size, err := c.size(reflect.ValueOf(v))
+			require.NoError(t, err)
+			assert.Equal(t, len(encoded), size, "%T (%#v) on version %d", v, v, version)
+		}
+	}
+
+	size, err := Size(TS{ID: 1})
+	require.NoError(t, err)
+	encoded, err := Encode(TS{ID: 1})
+	require.NoError(t, err)
+	assert.Equal(t, len(encoded), size)
+
+	_, err = Size(make(chan int))
+	assert.Error(t, err)
+	_, err = Size([]interface{}{1})
+	assert.Error(t, err)
+}
+
+func BenchmarkAppendEncode(b *testing.B) {
+	v := reflectFixture()
+	buf := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = AppendEncode(buf[:0], v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
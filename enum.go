@@ -0,0 +1,215 @@
+package yarp
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// EnumValuer represents a named integer type generated from an enum
+// definition. Enums are encoded as regular scalars; values unknown to the
+// receiving side are preserved as-is during decoding, and can be detected
+// through EnumDescriptor.Valid.
+type EnumValuer interface {
+	YarpEnumDescriptor() *EnumDescriptor
+}
+
+// EnumValue represents a single named value of an enum.
+type EnumValue struct {
+	Name   string
+	Number int64
+}
+
+// EnumDescriptor describes an enum type, along with its named values.
+// Autogenerated code uses an EnumDescriptor to implement String, MarshalText
+// and UnmarshalText for enum types through EnumString, MarshalEnumText and
+// UnmarshalEnumText, allowing them to be represented by their symbolic names,
+// for instance, by encoding/json.
+type EnumDescriptor struct {
+	Package string
+	Name    string
+	Values  []EnumValue
+}
+
+// FullName returns the fully-qualified name of the enum, comprised of its
+// package and name.
+func (d *EnumDescriptor) FullName() string {
+	if d.Package == "" {
+		return d.Name
+	}
+	return d.Package + "." + d.Name
+}
+
+// NameOf returns the name of a given value, and whether it is known by the
+// receiver.
+func (d *EnumDescriptor) NameOf(n int64) (string, bool) {
+	for _, v := range d.Values {
+		if v.Number == n {
+			return v.Name, true
+		}
+	}
+	return "", false
+}
+
+// NumberOf returns the value identified by a given name, and whether it is
+// known by the receiver.
+func (d *EnumDescriptor) NumberOf(name string) (int64, bool) {
+	for _, v := range d.Values {
+		if v.Name == name {
+			return v.Number, true
+		}
+	}
+	return 0, false
+}
+
+// Valid indicates whether a given value is known by the receiver.
+func (d *EnumDescriptor) Valid(n int64) bool {
+	_, ok := d.NameOf(n)
+	return ok
+}
+
+// String returns the name of a given value, or the enum name followed by the
+// numeric value between parentheses, in case it is unknown.
+func (d *EnumDescriptor) String(n int64) string {
+	if name, ok := d.NameOf(n); ok {
+		return name
+	}
+	return fmt.Sprintf("%s(%d)", d.Name, n)
+}
+
+// MarshalText returns the name of a given value, or its numeric
+// representation, in case it is unknown.
+func (d *EnumDescriptor) MarshalText(n int64) ([]byte, error) {
+	if name, ok := d.NameOf(n); ok {
+		return []byte(name), nil
+	}
+	return []byte(strconv.FormatInt(n, 10)), nil
+}
+
+// UnmarshalText parses either a value name or its numeric representation.
+func (d *EnumDescriptor) UnmarshalText(text []byte) (int64, error) {
+	if n, ok := d.NumberOf(string(text)); ok {
+		return n, nil
+	}
+	n, err := strconv.ParseInt(string(text), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for enum %s", text, d.FullName())
+	}
+	return n, nil
+}
+
+// enumNumber returns the numeric value of v, or ErrIncompatibleEnum in case v
+// is not an integer type.
+func enumNumber(v EnumValuer) (int64, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
+	}
+	return 0, ErrIncompatibleEnum
+}
+
+// EnumName returns the name of a given enum value, and whether it is known by
+// its descriptor. See EnumDescriptor.NameOf. Values of types other than
+// integers are never known.
+func EnumName(v EnumValuer) (string, bool) {
+	n, err := enumNumber(v)
+	if err != nil {
+		return "", false
+	}
+	return v.YarpEnumDescriptor().NameOf(n)
+}
+
+// EnumString returns the name of a given enum value, or the enum name
+// followed by the value between parentheses, in case it is unknown.
+// Autogenerated enum types use it to implement fmt.Stringer.
+func EnumString(v EnumValuer) string {
+	d := v.YarpEnumDescriptor()
+	n, err := enumNumber(v)
+	if err != nil {
+		return fmt.Sprintf("%s(%v)", d.Name, reflect.ValueOf(v))
+	}
+	return d.String(n)
+}
+
+// MarshalEnumText returns the name of a given enum value, or its numeric
+// representation, in case it is unknown. Autogenerated enum types use it to
+// implement encoding.TextMarshaler. Returns ErrIncompatibleEnum in case v is
+// not an integer type.
+func MarshalEnumText(v EnumValuer) ([]byte, error) {
+	n, err := enumNumber(v)
+	if err != nil {
+		return nil, err
+	}
+	return v.YarpEnumDescriptor().MarshalText(n)
+}
+
+// UnmarshalEnumText parses either a value name or its numeric representation
+// into dst, which must be a pointer to an enum type. Autogenerated enum types
+// use it to implement encoding.TextUnmarshaler. dst is left untouched in case
+// text cannot be parsed.
+func UnmarshalEnumText(dst EnumValuer, text []byte) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return ErrIncompatibleEnum
+	}
+	n, err := dst.YarpEnumDescriptor().UnmarshalText(text)
+	if err != nil {
+		return err
+	}
+	switch rv = rv.Elem(); rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		rv.SetUint(uint64(n))
+	default:
+		return ErrIncompatibleEnum
+	}
+	return nil
+}
+
+var enumRegistry = map[string]*EnumDescriptor{}
+
+// TryRegisterEnumType takes an arbitrary number of EnumValuer instances,
+// validates them, and registers their descriptors. Returns an error in case
+// an enum is invalid.
+func TryRegisterEnumType(v ...EnumValuer) error {
+	for _, v := range v {
+		switch reflect.TypeOf(v).Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			return ErrIncompatibleEnum
+		}
+		d := v.YarpEnumDescriptor()
+		if d == nil || d.Name == "" {
+			return ErrIncompatibleEnum
+		}
+		names := map[string]bool{}
+		for _, val := range d.Values {
+			if names[val.Name] {
+				return ErrDuplicatedEnumValue
+			}
+			names[val.Name] = true
+		}
+		enumRegistry[d.FullName()] = d
+	}
+	return nil
+}
+
+// RegisterEnumType works like TryRegisterEnumType, but panics instead of
+// returning an error.
+func RegisterEnumType(v ...EnumValuer) {
+	if err := TryRegisterEnumType(v...); err != nil {
+		panic(err)
+	}
+}
+
+// LookupEnumDescriptor returns the EnumDescriptor registered under a given
+// fully-qualified name.
+func LookupEnumDescriptor(fullName string) (*EnumDescriptor, bool) {
+	d, ok := enumRegistry[fullName]
+	return d, ok
+}
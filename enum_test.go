@@ -0,0 +1,166 @@
+package yarp
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type Color int32
+
+var _ColorDescriptor = &EnumDescriptor{
+	Package: "io.vito",
+	Name:    "Color",
+	Values: []EnumValue{
+		{Name: "RED", Number: 0},
+		{Name: "GREEN", Number: 1},
+		{Name: "BLUE", Number: 2},
+	},
+}
+
+func (Color) YarpEnumDescriptor() *EnumDescriptor { return _ColorDescriptor }
+func (c Color) String() string                    { return EnumString(c) }
+func (c Color) MarshalText() ([]byte, error)      { return MarshalEnumText(c) }
+func (c *Color) UnmarshalText(b []byte) error     { return UnmarshalEnumText(c, b) }
+
+type Paint struct {
+	*Structure
+	Color   Color         `index:"0"`
+	Palette []Color       `index:"1"`
+	Usage   map[Color]int `index:"2"`
+}
+
+func (Paint) YarpID() uint64         { return 0x7 }
+func (Paint) YarpPackage() string    { return "io.vito" }
+func (Paint) YarpStructName() string { return "Paint" }
+
+func TestEnum(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(Paint{})
+	RegisterEnumType(Color(0))
+
+	d, ok := LookupEnumDescriptor("io.vito.Color")
+	require.True(t, ok)
+	assert.Same(t, _ColorDescriptor, d)
+	assert.Equal(t, "GREEN", Color(1).String())
+	assert.Equal(t, "Color(42)", Color(42).String())
+	assert.True(t, d.Valid(2))
+	assert.False(t, d.Valid(42))
+
+	data, err := Encode(Paint{
+		Color:   Color(42),
+		Palette: []Color{1, 2},
+		Usage:   map[Color]int{0: 3},
+	})
+	require.NoError(t, err)
+	_, decoded, err := Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	p := decoded.(*Paint)
+	assert.Equal(t, Color(42), p.Color)
+	assert.Equal(t, []Color{1, 2}, p.Palette)
+	assert.Equal(t, map[Color]int{0: 3}, p.Usage)
+	assert.Empty(t, p.UnknownFields)
+
+	js, err := json.Marshal(p)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"UnknownFields": null, "Color": "42", "Palette": ["GREEN", "BLUE"], "Usage": {"RED": 3}}`, string(js))
+
+	var c Color
+	require.NoError(t, json.Unmarshal([]byte(`"BLUE"`), &c))
+	assert.Equal(t, Color(2), c)
+	assert.Error(t, json.Unmarshal([]byte(`"PURPLE"`), &c))
+}
+
+type InvalidEnum string
+
+func (InvalidEnum) YarpEnumDescriptor() *EnumDescriptor { return _ColorDescriptor }
+
+func TestRegisterEnumType(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	assert.ErrorIs(t, TryRegisterEnumType(InvalidEnum("")), ErrIncompatibleEnum)
+}
+
+type Weight uint8
+
+var _WeightDescriptor = &EnumDescriptor{
+	Name: "Weight",
+	Values: []EnumValue{
+		{Name: "LIGHT", Number: 1},
+		{Name: "HEAVY", Number: 200},
+	},
+}
+
+func (Weight) YarpEnumDescriptor() *EnumDescriptor { return _WeightDescriptor }
+
+func TestEnumDescriptor(t *testing.T) {
+	d := _ColorDescriptor
+	assert.Equal(t, "io.vito.Color", d.FullName())
+	assert.Equal(t, "Weight", _WeightDescriptor.FullName())
+
+	name, ok := d.NameOf(1)
+	assert.True(t, ok)
+	assert.Equal(t, "GREEN", name)
+	_, ok = d.NameOf(42)
+	assert.False(t, ok)
+
+	n, ok := d.NumberOf("BLUE")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), n)
+	_, ok = d.NumberOf("PURPLE")
+	assert.False(t, ok)
+
+	assert.Equal(t, "RED", d.String(0))
+	assert.Equal(t, "Color(-1)", d.String(-1))
+
+	text, err := d.MarshalText(2)
+	require.NoError(t, err)
+	assert.Equal(t, "BLUE", string(text))
+	text, err = d.MarshalText(-1)
+	require.NoError(t, err)
+	assert.Equal(t, "-1", string(text))
+
+	n, err = d.UnmarshalText([]byte("GREEN"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	n, err = d.UnmarshalText([]byte("42"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), n)
+	_, err = d.UnmarshalText([]byte("PURPLE"))
+	assert.EqualError(t, err, `invalid value "PURPLE" for enum io.vito.Color`)
+}
+
+func TestEnumHelpers(t *testing.T) {
+	name, ok := EnumName(Color(2))
+	assert.True(t, ok)
+	assert.Equal(t, "BLUE", name)
+	_, ok = EnumName(Color(42))
+	assert.False(t, ok)
+
+	assert.Equal(t, "HEAVY", EnumString(Weight(200)))
+	assert.Equal(t, "Weight(3)", EnumString(Weight(3)))
+
+	text, err := MarshalEnumText(Weight(1))
+	require.NoError(t, err)
+	assert.Equal(t, "LIGHT", string(text))
+	text, err = MarshalEnumText(Color(42))
+	require.NoError(t, err)
+	assert.Equal(t, "42", string(text))
+
+	w := Weight(1)
+	require.NoError(t, UnmarshalEnumText(&w, []byte("HEAVY")))
+	assert.Equal(t, Weight(200), w)
+	require.NoError(t, UnmarshalEnumText(&w, []byte("7")))
+	assert.Equal(t, Weight(7), w)
+	assert.Error(t, UnmarshalEnumText(&w, []byte("MASSIVE")))
+	assert.Equal(t, Weight(7), w)
+	assert.ErrorIs(t, UnmarshalEnumText(Weight(1), []byte("LIGHT")), ErrIncompatibleEnum)
+
+	// Types other than integers are reported instead of panicking.
+	_, ok = EnumName(InvalidEnum("pink"))
+	assert.False(t, ok)
+	assert.Equal(t, "Color(pink)", EnumString(InvalidEnum("pink")))
+	_, err = MarshalEnumText(InvalidEnum("pink"))
+	assert.ErrorIs(t, err, ErrIncompatibleEnum)
+}
@@ -27,6 +27,14 @@ var ErrIncompatibleStruct = fmt.Errorf("incompatible structure to encode; struct
 // provided.
 var ErrIncompleteStruct = fmt.Errorf("incomplete structure definition; missing *Structure field")
 
+// ErrIncompatibleEnum indicates that an enum type that is not an integer, or
+// that lacks a valid EnumDescriptor was provided.
+var ErrIncompatibleEnum = fmt.Errorf("incompatible enum type; enums must be integers providing an EnumDescriptor")
+
+// ErrDuplicatedEnumValue indicates that a given enum descriptor contains two
+// or more values sharing the same name.
+var ErrDuplicatedEnumValue = fmt.Errorf("duplicated enum value name")
+
 // ErrInvalidTag indicates that a structure tag contains an invalid value that
 // could not be parsed as a number.
 var ErrInvalidTag = fmt.Errorf("invalid index tag")
@@ -47,6 +55,45 @@ var ErrFieldGap = fmt.Errorf("structs must have no gaps between field indexes")
 // unknown struct type.
 var ErrUnknownStructType = fmt.Errorf("unknown struct type")
 
+// ErrStructTypeMismatch indicates that a stream contains a struct type
+// different from the one expected by the caller.
+var ErrStructTypeMismatch = fmt.Errorf("stream contains an unexpected struct type")
+
+// ErrUnexpectedFieldType indicates that a field read through a Decoder holds a
+// value of a type different from the one expected by the caller.
+var ErrUnexpectedFieldType = fmt.Errorf("unexpected field type")
+
+// ErrUnbalancedStruct indicates that a FastEncoder implementation did not
+// match each call to Encoder.BeginStruct with a call to Encoder.EndStruct.
+var ErrUnbalancedStruct = fmt.Errorf("unbalanced struct encoding")
+
+// errMuxUnsupported indicates that a server does not accept multiplexed
+// connections.
+var errMuxUnsupported = fmt.Errorf("multiplexed connections are not supported by the server")
+
+// errStreamRefused indicates that a server refused a stream of a multiplexed
+// connection without processing it, so it can be retried.
+var errStreamRefused = fmt.Errorf("stream refused by the server")
+
+// errBlobAbandoned indicates that a streamed Blob was garbage collected before
+// being finished.
+var errBlobAbandoned = fmt.Errorf("blob was abandoned before being read")
+
+// ErrInvalidBlobField indicates that a struct contains a *Blob field that is
+// either a oneof member, or is not the field with the highest index.
+var ErrInvalidBlobField = fmt.Errorf("blob fields must be the last field of a struct, and cannot be oneof members")
+
+// ErrBlobClosed indicates that a Blob was read after being closed.
+var ErrBlobClosed = fmt.Errorf("read on closed blob")
+
+// ErrSendClosed indicates that a value was sent through a ClientStream after
+// CloseSend was called.
+var ErrSendClosed = fmt.Errorf("send on closed stream")
+
+// ErrStreamTruncated indicates that the connection of a response was closed
+// before its Trailer was received.
+var ErrStreamTruncated = fmt.Errorf("stream ended before its trailer")
+
 // ErrCorruptStream indicates that the stream being processed is corrupt.
 var ErrCorruptStream = fmt.Errorf("corrupt stream")
 
@@ -59,6 +106,10 @@ var ErrWantsStreamed = fmt.Errorf("method requires a streamed response")
 // by Server's Start and StartListener methods when Shutdown is called.
 var ErrServerClosed = fmt.Errorf("server closed")
 
+// ErrUnsupportedWireVersion indicates that a peer requested, or a caller
+// provided, a wire version not supported by this implementation.
+var ErrUnsupportedWireVersion = fmt.Errorf("unsupported wire version")
+
 // IsManagedError indicates whether a given error value can be converted to an
 // Error instance, and returns it, in case conversion is possible.
 func IsManagedError(err error) (bool, Error) {
@@ -0,0 +1,443 @@
+package yarp
+
+import (
+	"encoding/binary"
+	"io"
+	"reflect"
+)
+
+// FastEncoder may be implemented by messages able to encode themselves without
+// relying on reflection. When available, YarpEncode is used by the encoder
+// instead of inspecting the message's fields. Implementations must call
+// Encoder.BeginStruct and Encoder.EndStruct around their fields, and are
+// expected to be emitted by code generators rather than written by hand.
+type FastEncoder interface {
+	StructValuer
+	YarpEncode(e *Encoder) error
+}
+
+// FastDecoder may be implemented by pointers to messages able to decode
+// themselves without relying on reflection. When the type registered for a
+// given struct ID implements FastDecoder, YarpDecode is invoked on a new
+// instance of it, and is expected to iterate fields through Decoder.Next.
+// Projections and DecodeReuse always use reflection.
+type FastDecoder interface {
+	StructValuer
+	YarpDecode(d *Decoder) error
+}
+
+var reflectedFastDecoder = reflect.TypeOf((*FastDecoder)(nil)).Elem()
+
+// Encoder writes values to a buffer on behalf of FastEncoder implementations,
+// using the wire version negotiated for the value being encoded.
+type Encoder struct {
+	c       codec
+	buf     []byte
+	structs []encoderStruct
+}
+
+type encoderStruct struct {
+	start  int
+	sparse bool
+}
+
+// BeginStruct starts writing v's fields. Every call must be matched by a call
+// to EndStruct once all fields were written.
+func (e *Encoder) BeginStruct(v StructValuer) {
+	sparse := false
+	if sv, ok := v.(SparseStructValuer); ok && e.c.sparseStructs() {
+		sparse = sv.YarpSparse()
+	}
+	e.structs = append(e.structs, encoderStruct{start: len(e.buf), sparse: sparse})
+	id := make([]byte, 8)
+	binary.LittleEndian.PutUint64(id, v.YarpID())
+	e.buf = append(e.buf, id...)
+}
+
+// EndStruct finishes the struct started by the last call to BeginStruct,
+// writing its header.
+func (e *Encoder) EndStruct() error {
+	if len(e.structs) == 0 {
+		return ErrUnbalancedStruct
+	}
+	s := e.structs[len(e.structs)-1]
+	e.structs = e.structs[:len(e.structs)-1]
+
+	flags := byte(0x80)
+	if s.sparse {
+		flags |= 0x10
+	}
+	var headerBuf [16]byte
+	header := appendInteger(headerBuf[:0], uint64(len(e.buf)-s.start), flags)
+	// Move the ID and body forward, making room for the header.
+	end := len(e.buf)
+	e.buf = append(e.buf, header...)
+	copy(e.buf[s.start+len(header):], e.buf[s.start:end])
+	copy(e.buf[s.start:], header)
+	return nil
+}
+
+// Field starts the field with the provided index, and must precede each value
+// written to a struct. zero indicates whether the field holds its zero value,
+// allowing it to be omitted from sparse structs, in which case Field returns
+// false, and the value must not be written.
+func (e *Encoder) Field(index int, zero bool) bool {
+	if len(e.structs) == 0 || !e.structs[len(e.structs)-1].sparse {
+		return true
+	}
+	if zero {
+		return false
+	}
+	e.buf = appendUint(e.buf, uint64(index))
+	return true
+}
+
+// Int writes a signed integer.
+func (e *Encoder) Int(v int64) {
+	if e.c.zigZag() {
+		e.buf = appendZigZag(e.buf, v)
+		return
+	}
+	e.buf = appendInt(e.buf, v)
+}
+
+// Uint writes an unsigned integer.
+func (e *Encoder) Uint(v uint64) {
+	e.buf = appendUint(e.buf, v)
+}
+
+// Bool writes a boolean value.
+func (e *Encoder) Bool(v bool) {
+	e.buf = appendBool(e.buf, v)
+}
+
+// Float32 writes a 32-bit float.
+func (e *Encoder) Float32(v float32) {
+	e.buf = appendFloat32(e.buf, v)
+}
+
+// Float64 writes a 64-bit float.
+func (e *Encoder) Float64(v float64) {
+	e.buf = appendFloat64(e.buf, v)
+}
+
+// String writes a string.
+func (e *Encoder) String(v string) {
+	e.buf = appendString(e.buf, v)
+}
+
+// OneOf writes a oneof field holding v as its index-th member. An index of
+// -1 indicates that no member is set.
+func (e *Encoder) OneOf(index int, v interface{}) error {
+	buf, err := e.c.appendOneOf(e.buf, &OneOfValue{Index: index, Data: v})
+	if err != nil {
+		return err
+	}
+	e.buf = buf
+	return nil
+}
+
+// Encode writes an arbitrary value, such as a slice, map or nested message,
+// falling back to reflection for types other than FastEncoder messages.
+func (e *Encoder) Encode(v interface{}) error {
+	if v == nil {
+		e.buf = appendVoid(e.buf)
+		return nil
+	}
+	buf, err := e.c.appendEncode(e.buf, reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	e.buf = buf
+	return nil
+}
+
+func (c codec) appendFast(dst []byte, v FastEncoder) ([]byte, error) {
+	e := &Encoder{c: c, buf: dst}
+	if err := v.YarpEncode(e); err != nil {
+		return nil, err
+	}
+	if len(e.structs) != 0 {
+		return nil, ErrUnbalancedStruct
+	}
+	return e.buf, nil
+}
+
+// Decoder reads the fields of a single struct on behalf of FastDecoder
+// implementations. Fields are iterated through Next, and each one must be
+// consumed through one of the Decoder's methods, based on the field's index.
+// Fields left unconsumed are skipped.
+type Decoder struct {
+	c        codec
+	r        io.Reader
+	sparse   bool
+	position int
+	index    int
+	header   byte
+	consumed bool
+	err      error
+	unknown  []UnknownField
+	buf      [1]byte
+}
+
+// Next advances the Decoder to the next field, returning false once all
+// fields were read, or an error occurred. See Err.
+func (d *Decoder) Next() bool {
+	if d.err != nil {
+		return false
+	}
+	if !d.consumed && d.position >= 0 {
+		if err := d.Skip(); err != nil {
+			return false
+		}
+	}
+
+	b := d.buf[:]
+	if d.sparse {
+		if _, err := io.ReadFull(d.r, b); err != nil {
+			if err != io.EOF {
+				d.err = err
+			}
+			return false
+		}
+		_, idx, err := decodeScalar(b[0], d.r)
+		if err != nil {
+			d.err = err
+			return false
+		}
+		if idx >= maxSparseIndex {
+			d.err = ErrCorruptStream
+			return false
+		}
+		d.index = int(idx)
+	} else {
+		d.index = d.position + 1
+	}
+	d.position++
+
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		if err != io.EOF || d.sparse {
+			d.err = unexpectedEOF(err)
+		}
+		return false
+	}
+	d.header = b[0]
+	d.consumed = false
+	return true
+}
+
+// Err returns the first error found while iterating fields, if any.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Index returns the index of the current field.
+func (d *Decoder) Index() int {
+	return d.index
+}
+
+// Type returns the type of the current field's value.
+func (d *Decoder) Type() Type {
+	return detectType(d.header)
+}
+
+// consume marks the current value as read, returning ErrUnexpectedFieldType in
+// case it is not of the provided type.
+func (d *Decoder) consume(t Type) error {
+	if d.consumed {
+		return ErrCorruptStream
+	}
+	d.consumed = true
+	if detectType(d.header) != t {
+		d.err = ErrUnexpectedFieldType
+		return d.err
+	}
+	return nil
+}
+
+func (d *Decoder) fail(err error) error {
+	if err != nil {
+		d.err = unexpectedEOF(err)
+	}
+	return d.err
+}
+
+// Int reads a signed integer.
+func (d *Decoder) Int() (int64, error) {
+	if err := d.consume(Scalar); err != nil {
+		return 0, err
+	}
+	signed, v, err := decodeScalar(d.header, d.r)
+	if err != nil {
+		return 0, d.fail(err)
+	}
+	if signed && d.c.zigZag() {
+		return decodeZigZag(v), nil
+	}
+	return int64(v), nil
+}
+
+// Uint reads an unsigned integer.
+func (d *Decoder) Uint() (uint64, error) {
+	if err := d.consume(Scalar); err != nil {
+		return 0, err
+	}
+	_, v, err := decodeScalar(d.header, d.r)
+	if err != nil {
+		return 0, d.fail(err)
+	}
+	return v, nil
+}
+
+// Bool reads a boolean value.
+func (d *Decoder) Bool() (bool, error) {
+	if err := d.consume(Scalar); err != nil {
+		return false, err
+	}
+	signed, _, err := decodeScalar(d.header, d.r)
+	if err != nil {
+		return false, d.fail(err)
+	}
+	return signed, nil
+}
+
+// Float reads either a 32 or 64-bit float.
+func (d *Decoder) Float() (float64, error) {
+	if err := d.consume(Float); err != nil {
+		return 0, err
+	}
+	_, v, err := decodeFloat(d.header, d.r)
+	if err != nil {
+		return 0, d.fail(err)
+	}
+	return v, nil
+}
+
+// String reads a string.
+func (d *Decoder) String() (string, error) {
+	if err := d.consume(String); err != nil {
+		return "", err
+	}
+	v, err := decodeString(d.header, d.r)
+	if err != nil {
+		return "", d.fail(err)
+	}
+	return v, nil
+}
+
+// Raw reads the current value without decoding it.
+func (d *Decoder) Raw() (RawMessage, error) {
+	if err := d.consume(d.Type()); err != nil {
+		return nil, err
+	}
+	raw, err := readRawWithHeader(d.header, d.r)
+	if err != nil {
+		return nil, d.fail(err)
+	}
+	return rawMessage(raw), nil
+}
+
+// Decode reads an arbitrary value, such as a slice, map, oneof or nested
+// message, into dst, which must be a pointer to a type able to hold it.
+// Falls back to reflection, except for nested FastDecoder messages.
+func (d *Decoder) Decode(dst interface{}) error {
+	if err := d.consume(d.Type()); err != nil {
+		return err
+	}
+	_, v, err := d.c.decodeWithHeader([]byte{d.header}, d.r)
+	if err != nil {
+		return d.fail(err)
+	}
+	if b, ok := v.(*Blob); ok && b.streaming() {
+		if err = bindBlob(b, d.r); err != nil {
+			return d.fail(err)
+		}
+	}
+	into := reflect.ValueOf(dst)
+	if into.Kind() != reflect.Pointer || into.IsNil() {
+		d.err = ErrUnexpectedFieldType
+		return d.err
+	}
+	into = into.Elem()
+	cv, ok := convertValue(reflect.ValueOf(v), into.Type(), into)
+	if !ok {
+		d.err = ErrUnexpectedFieldType
+		return d.err
+	}
+	into.Set(cv)
+	return nil
+}
+
+// OneOf reads a oneof field, returning the index of the member that is set,
+// along with its value, as returned by Decode. Returns -1 in case no member is
+// set.
+func (d *Decoder) OneOf() (int, interface{}, error) {
+	if err := d.consume(OneOf); err != nil {
+		return -1, nil, err
+	}
+	oo, err := d.c.decodeOneOf(d.header, d.r)
+	if err != nil {
+		return -1, nil, d.fail(err)
+	}
+	if oo == nil {
+		return -1, nil, nil
+	}
+	return oo.Index, oo.Data, nil
+}
+
+// Skip discards the current value.
+func (d *Decoder) Skip() error {
+	d.consumed = true
+	if d.header == 0xB0 {
+		return d.fail(skipBlob(d.r))
+	}
+	if _, err := readRawWithHeader(d.header, d.r); err != nil {
+		return d.fail(err)
+	}
+	return nil
+}
+
+// Unknown reads the current value as an UnknownField, to be later returned by
+// Structure. Implementations are expected to call Unknown for fields they do
+// not recognise.
+func (d *Decoder) Unknown() error {
+	t := d.Type()
+	if err := d.consume(t); err != nil {
+		return err
+	}
+	_, v, err := d.c.decodeWithHeader([]byte{d.header}, d.r)
+	if err != nil {
+		return d.fail(err)
+	}
+	if b, ok := v.(*Blob); ok && b.streaming() {
+		if err = bindBlob(b, d.r); err != nil {
+			return d.fail(err)
+		}
+	}
+	d.unknown = append(d.unknown, UnknownField{Index: d.index, Type: t, Data: v})
+	return nil
+}
+
+// Structure returns a new Structure containing all fields read through
+// Unknown.
+func (d *Decoder) Structure() *Structure {
+	return &Structure{UnknownFields: d.unknown}
+}
+
+// decodeFast decodes a struct body from r into a new instance of t, which
+// must implement FastDecoder through its pointer.
+func (c codec) decodeFast(t reflect.Type, sparse bool, r io.Reader) (interface{}, error) {
+	v := reflect.New(t).Interface().(FastDecoder)
+	d := &Decoder{c: c, r: r, sparse: sparse, position: -1, consumed: true}
+	if err := v.YarpDecode(d); err != nil {
+		return nil, err
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	// Discard anything left behind by the implementation.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,446 @@
+package yarp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"reflect"
+	"testing"
+)
+
+// FastTS and ReflectTS share the same layout and ID, but only FastTS
+// implements FastEncoder and FastDecoder, mirroring what a generator would
+// emit.
+type FastTS struct {
+	*Structure
+	ID        int64             `index:"0"`
+	Name      string            `index:"1"`
+	Score     float64           `index:"2"`
+	Active    bool              `index:"3"`
+	Tags      []string          `index:"4"`
+	Counts    map[string]uint32 `index:"5"`
+	Other     *OtherTS          `index:"6"`
+	Label     *string           `index:"7,0"`
+	HasLabel  bool
+	Number    *int64 `index:"7,1"`
+	HasNumber bool
+}
+
+func (FastTS) YarpID() uint64         { return 0xa }
+func (FastTS) YarpPackage() string    { return "io.vito" }
+func (FastTS) YarpStructName() string { return "FastTS" }
+
+func (v FastTS) YarpEncode(e *Encoder) error {
+	e.BeginStruct(v)
+	if e.Field(0, v.ID == 0) {
+		e.Int(v.ID)
+	}
+	if e.Field(1, v.Name == "") {
+		e.String(v.Name)
+	}
+	if e.Field(2, v.Score == 0) {
+		e.Float64(v.Score)
+	}
+	if e.Field(3, !v.Active) {
+		e.Bool(v.Active)
+	}
+	if e.Field(4, v.Tags == nil) {
+		if err := e.Encode(v.Tags); err != nil {
+			return err
+		}
+	}
+	if e.Field(5, v.Counts == nil) {
+		if err := e.Encode(v.Counts); err != nil {
+			return err
+		}
+	}
+	if e.Field(6, v.Other == nil) {
+		if err := e.Encode(v.Other); err != nil {
+			return err
+		}
+	}
+	if e.Field(7, v.Label == nil && v.Number == nil) {
+		var err error
+		switch {
+		case v.Label != nil:
+			err = e.OneOf(0, *v.Label)
+		case v.Number != nil:
+			err = e.OneOf(1, *v.Number)
+		default:
+			err = e.OneOf(-1, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return e.EndStruct()
+}
+
+func (v *FastTS) YarpDecode(d *Decoder) error {
+	for d.Next() {
+		var err error
+		switch d.Index() {
+		case 0:
+			v.ID, err = d.Int()
+		case 1:
+			v.Name, err = d.String()
+		case 2:
+			v.Score, err = d.Float()
+		case 3:
+			v.Active, err = d.Bool()
+		case 4:
+			err = d.Decode(&v.Tags)
+		case 5:
+			err = d.Decode(&v.Counts)
+		case 6:
+			err = d.Decode(&v.Other)
+		case 7:
+			var idx int
+			var val interface{}
+			idx, val, err = d.OneOf()
+			switch idx {
+			case 0:
+				s := val.(string)
+				v.Label, v.HasLabel = &s, true
+			case 1:
+				n := val.(int64)
+				v.Number, v.HasNumber = &n, true
+			}
+		default:
+			err = d.Unknown()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	v.Structure = d.Structure()
+	return d.Err()
+}
+
+type ReflectTS struct {
+	*Structure
+	ID        int64             `index:"0"`
+	Name      string            `index:"1"`
+	Score     float64           `index:"2"`
+	Active    bool              `index:"3"`
+	Tags      []string          `index:"4"`
+	Counts    map[string]uint32 `index:"5"`
+	Other     *OtherTS          `index:"6"`
+	Label     *string           `index:"7,0"`
+	HasLabel  bool
+	Number    *int64 `index:"7,1"`
+	HasNumber bool
+}
+
+func (ReflectTS) YarpID() uint64         { return 0xa }
+func (ReflectTS) YarpPackage() string    { return "io.vito" }
+func (ReflectTS) YarpStructName() string { return "ReflectTS" }
+
+// SparseFastTS is a sparse message implementing FastEncoder and FastDecoder.
+type SparseFastTS struct {
+	*Structure
+	A int64  `index:"0"`
+	B string `index:"1"`
+	C int64  `index:"2"`
+}
+
+func (SparseFastTS) YarpID() uint64         { return 0xc }
+func (SparseFastTS) YarpPackage() string    { return "io.vito" }
+func (SparseFastTS) YarpStructName() string { return "SparseFastTS" }
+func (SparseFastTS) YarpSparse() bool       { return true }
+
+func (v SparseFastTS) YarpEncode(e *Encoder) error {
+	e.BeginStruct(v)
+	if e.Field(0, v.A == 0) {
+		e.Int(v.A)
+	}
+	if e.Field(1, v.B == "") {
+		e.String(v.B)
+	}
+	if e.Field(2, v.C == 0) {
+		e.Int(v.C)
+	}
+	return e.EndStruct()
+}
+
+func (v *SparseFastTS) YarpDecode(d *Decoder) error {
+	for d.Next() {
+		var err error
+		switch d.Index() {
+		case 0:
+			v.A, err = d.Int()
+		case 1:
+			v.B, err = d.String()
+		case 2:
+			v.C, err = d.Int()
+		default:
+			err = d.Unknown()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	v.Structure = d.Structure()
+	return d.Err()
+}
+
+func fastFixture() FastTS {
+	label := "label"
+	return FastTS{
+		ID:       -42,
+		Name:     "Vito",
+		Score:    99.5,
+		Active:   true,
+		Tags:     []string{"a", "b", "c"},
+		Counts:   map[string]uint32{"x": 1},
+		Other:    &OtherTS{Project: "yarp", Role: "owner"},
+		Label:    &label,
+		HasLabel: true,
+	}
+}
+
+func reflectFixture() ReflectTS {
+	f := fastFixture()
+	return ReflectTS{
+		ID:       f.ID,
+		Name:     f.Name,
+		Score:    f.Score,
+		Active:   f.Active,
+		Tags:     f.Tags,
+		Counts:   f.Counts,
+		Other:    f.Other,
+		Label:    f.Label,
+		HasLabel: f.HasLabel,
+	}
+}
+
+// replaceID replaces the first occurrence of a struct ID in data.
+func replaceID(data []byte, from, to uint64) []byte {
+	f, t := make([]byte, 8), make([]byte, 8)
+	binary.LittleEndian.PutUint64(f, from)
+	binary.LittleEndian.PutUint64(t, to)
+	return bytes.Replace(data, f, t, 1)
+}
+
+func TestFastPath(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(FastTS{}, OtherTS{}, SparseFastTS{})
+
+	for _, version := range []WireVersion{WireVersion1, WireVersion2, LatestWireVersion} {
+		t.Run("version "+version.String(), func(t *testing.T) {
+			v := fastFixture()
+			fast, err := EncodeVersion(v, version)
+			require.NoError(t, err)
+
+			slow, err := EncodeVersion(reflectFixture(), version)
+			require.NoError(t, err)
+			assert.Equal(t, slow, fast)
+
+			_, decoded, err := DecodeVersion(bytes.NewReader(fast), version)
+			require.NoError(t, err)
+			require.IsType(t, &FastTS{}, decoded)
+			assert.True(t, Equal(&v, decoded.(*FastTS)), "got %#v", decoded)
+			assert.True(t, decoded.(*FastTS).HasLabel)
+
+			// Messages encoded through reflection are also decoded by the
+			// fast path.
+			data, err := EncodeVersion(ReflectTS{ID: 1, Name: "a"}, version)
+			require.NoError(t, err)
+			_, decoded, err = DecodeVersion(bytes.NewReader(data), version)
+			require.NoError(t, err)
+			require.IsType(t, &FastTS{}, decoded)
+			assert.Equal(t, int64(1), decoded.(*FastTS).ID)
+			assert.Equal(t, "a", decoded.(*FastTS).Name)
+		})
+	}
+
+	t.Run("sparse", func(t *testing.T) {
+		v := SparseFastTS{C: -7}
+		data, err := EncodeVersion(v, WireVersion3)
+		require.NoError(t, err)
+		assert.Equal(t, byte(0x90), data[0]&0xF0)
+		_, decoded, err := DecodeVersion(bytes.NewReader(data), WireVersion3)
+		require.NoError(t, err)
+		require.IsType(t, &SparseFastTS{}, decoded)
+		assert.Equal(t, int64(-7), decoded.(*SparseFastTS).C)
+		assert.Empty(t, decoded.(*SparseFastTS).B)
+	})
+
+	t.Run("unknown fields", func(t *testing.T) {
+		data, err := EncodeVersion(SparseTS{A: 3, B: "a", F: 9, Extra: "x"}, WireVersion3)
+		require.NoError(t, err)
+		data = replaceID(data, SparseTS{}.YarpID(), SparseFastTS{}.YarpID())
+		_, decoded, err := DecodeVersion(bytes.NewReader(data), WireVersion3)
+		require.NoError(t, err)
+		require.IsType(t, &SparseFastTS{}, decoded)
+		v := decoded.(*SparseFastTS)
+		assert.Equal(t, int64(3), v.A)
+		assert.Equal(t, "a", v.B)
+		assert.Equal(t, []UnknownField{
+			{Index: 5, Type: Scalar, Data: uint64(9)},
+			{Index: 7, Type: String, Data: "x"},
+		}, v.UnknownFields)
+	})
+
+	t.Run("type mismatch", func(t *testing.T) {
+		data, err := Encode(OtherTS{Project: "a"})
+		require.NoError(t, err)
+		data = replaceID(data, OtherTS{}.YarpID(), SparseFastTS{}.YarpID())
+		_, _, err = Decode(bytes.NewReader(data))
+		assert.ErrorIs(t, err, ErrUnexpectedFieldType)
+	})
+}
+
+// FastSimpleRequest and FastSimpleResponse share the layout and IDs of the
+// fixture messages generated from fixture/simple.yarp, implementing
+// FastEncoder and FastDecoder as a generator would.
+type FastSimpleRequest struct {
+	*Structure
+	Name  string `index:"0"`
+	Email string `index:"1"`
+}
+
+func (FastSimpleRequest) YarpID() uint64         { return SimpleRequest{}.YarpID() }
+func (FastSimpleRequest) YarpPackage() string    { return "io.libsimple" }
+func (FastSimpleRequest) YarpStructName() string { return "SimpleRequest" }
+
+func (v FastSimpleRequest) YarpEncode(e *Encoder) error {
+	e.BeginStruct(v)
+	if e.Field(0, v.Name == "") {
+		e.String(v.Name)
+	}
+	if e.Field(1, v.Email == "") {
+		e.String(v.Email)
+	}
+	return e.EndStruct()
+}
+
+func (v *FastSimpleRequest) YarpDecode(d *Decoder) error {
+	for d.Next() {
+		var err error
+		switch d.Index() {
+		case 0:
+			v.Name, err = d.String()
+		case 1:
+			v.Email, err = d.String()
+		default:
+			err = d.Unknown()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	v.Structure = d.Structure()
+	return d.Err()
+}
+
+type FastSimpleResponse struct {
+	*Structure
+	ID int32 `index:"0"`
+}
+
+func (FastSimpleResponse) YarpID() uint64         { return SimpleResponse{}.YarpID() }
+func (FastSimpleResponse) YarpPackage() string    { return "io.libsimple" }
+func (FastSimpleResponse) YarpStructName() string { return "SimpleResponse" }
+
+func (v FastSimpleResponse) YarpEncode(e *Encoder) error {
+	e.BeginStruct(v)
+	if e.Field(0, v.ID == 0) {
+		e.Int(int64(v.ID))
+	}
+	return e.EndStruct()
+}
+
+func (v *FastSimpleResponse) YarpDecode(d *Decoder) error {
+	for d.Next() {
+		var err error
+		switch d.Index() {
+		case 0:
+			var n int64
+			n, err = d.Int()
+			v.ID = int32(n)
+		default:
+			err = d.Unknown()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	v.Structure = d.Structure()
+	return d.Err()
+}
+
+// fixtureBenchmarks pairs fixture messages with their FastEncoder and
+// FastDecoder counterparts.
+var fixtureBenchmarks = []struct {
+	name          string
+	reflect, fast StructValuer
+}{
+	{"SimpleRequest", SimpleRequest{Name: "Vito", Email: "hey@vito.io"}, FastSimpleRequest{Name: "Vito", Email: "hey@vito.io"}},
+	{"SimpleResponse", SimpleResponse{ID: -42}, FastSimpleResponse{ID: -42}},
+	{"FastTS", reflectFixture(), fastFixture()},
+}
+
+func TestFastFixtures(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	for _, tc := range fixtureBenchmarks {
+		t.Run(tc.name, func(t *testing.T) {
+			resetRegistry()
+			RegisterStructType(OtherTS{}, tc.fast)
+			slow, err := EncodeVersion(tc.reflect, LatestWireVersion)
+			require.NoError(t, err)
+			fast, err := EncodeVersion(tc.fast, LatestWireVersion)
+			require.NoError(t, err)
+			assert.Equal(t, slow, fast)
+
+			_, decoded, err := DecodeVersion(bytes.NewReader(fast), LatestWireVersion)
+			require.NoError(t, err)
+			require.IsType(t, reflect.PointerTo(reflect.TypeOf(tc.fast)), reflect.TypeOf(decoded))
+			assert.True(t, Equal(tc.fast, reflect.ValueOf(decoded).Elem().Interface().(StructValuer)))
+		})
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, tc := range fixtureBenchmarks {
+		for _, path := range []struct {
+			name string
+			v    StructValuer
+		}{{"reflection", tc.reflect}, {"fast", tc.fast}} {
+			v := path.v
+			b.Run(tc.name+"/"+path.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := EncodeVersion(v, LatestWireVersion); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	b.Cleanup(resetRegistry)
+	for _, tc := range fixtureBenchmarks {
+		data, err := EncodeVersion(tc.reflect, LatestWireVersion)
+		require.NoError(b, err)
+		for _, path := range []struct {
+			name string
+			v    StructValuer
+		}{{"reflection", tc.reflect}, {"fast", tc.fast}} {
+			v := path.v
+			b.Run(tc.name+"/"+path.name, func(b *testing.B) {
+				resetRegistry()
+				RegisterStructType(OtherTS{}, v)
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, _, err := DecodeVersion(bytes.NewReader(data), LatestWireVersion); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
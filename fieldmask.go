@@ -0,0 +1,362 @@
+package yarp
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldMaskHeader is the reserved request header used by clients to provide a
+// FieldMask to the server. When present, the server removes all fields absent
+// from the mask from the response before encoding it. The header value must
+// be obtained through FieldMask.String.
+const FieldMaskHeader = "Yarp-Field-Mask"
+
+// FieldMask represents a set of field paths of a message. Each path is a list
+// of field indexes, in which each item after the first one refers to a field
+// of the struct held by the previous one. A path comprised of a single index
+// refers to the whole field, along with all its contents.
+type FieldMask struct {
+	Paths [][]int
+}
+
+// NewFieldMask returns a new FieldMask containing the provided paths.
+func NewFieldMask(paths ...[]int) FieldMask {
+	return FieldMask{Paths: paths}
+}
+
+// FieldMaskByName returns a new FieldMask containing the provided paths,
+// resolved against v's type. Each path is comprised of field names or indexes
+// separated by dots, such as "single_other.project" or "8.0". Names are
+// matched against Go field names ignoring case and underscores, so both
+// IDL-style and Go-style names are accepted.
+func FieldMaskByName(v StructValuer, paths ...string) (FieldMask, error) {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	mask := FieldMask{}
+	for _, p := range paths {
+		path, err := resolveFieldPath(t, p)
+		if err != nil {
+			return FieldMask{}, err
+		}
+		mask.Paths = append(mask.Paths, path)
+	}
+	return mask, nil
+}
+
+func resolveFieldPath(t reflect.Type, p string) ([]int, error) {
+	var path []int
+	for _, name := range strings.Split(p, ".") {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || !canEncodeStruct(t) {
+			return nil, fmt.Errorf("cannot resolve field path %q: %s is not a message", p, t)
+		}
+		fields, err := validateAndExtractStruct(t)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := strconv.Atoi(name)
+		if err == nil {
+			if idx < 0 || idx >= len(fields) {
+				return nil, fmt.Errorf("cannot resolve field path %q: %s has no field with index %d", p, t, idx)
+			}
+		} else {
+			idx = -1
+			for _, f := range fields {
+				if !f.OneOf && normalizeFieldName(f.Field.Name) == normalizeFieldName(name) {
+					idx = f.Index
+					break
+				}
+				for _, m := range f.OneOfIndexes {
+					if normalizeFieldName(m.Name) == normalizeFieldName(name) {
+						idx = f.Index
+					}
+				}
+			}
+			if idx == -1 {
+				return nil, fmt.Errorf("cannot resolve field path %q: %s has no field named %s", p, t, name)
+			}
+		}
+		path = append(path, idx)
+		if f := fields[idx]; !f.OneOf {
+			t = f.Field.Type
+		}
+	}
+	return path, nil
+}
+
+func normalizeFieldName(n string) string {
+	return strings.ToLower(strings.ReplaceAll(n, "_", ""))
+}
+
+// ParseFieldMask parses a FieldMask from its string representation, as
+// returned by FieldMask.String.
+func ParseFieldMask(s string) (FieldMask, error) {
+	mask := FieldMask{}
+	if s == "" {
+		return mask, nil
+	}
+	for _, p := range strings.Split(s, ",") {
+		var path []int
+		for _, i := range strings.Split(p, ".") {
+			idx, err := strconv.Atoi(i)
+			if err != nil || idx < 0 {
+				return FieldMask{}, fmt.Errorf("invalid field mask path %q", p)
+			}
+			path = append(path, idx)
+		}
+		mask.Paths = append(mask.Paths, path)
+	}
+	return mask, nil
+}
+
+// String returns the representation of the FieldMask used by FieldMaskHeader,
+// in which paths are separated by commas, and indexes in a path are separated
+// by dots.
+func (m FieldMask) String() string {
+	paths := make([]string, len(m.Paths))
+	for i, p := range m.Paths {
+		items := make([]string, len(p))
+		for j, idx := range p {
+			items[j] = strconv.Itoa(idx)
+		}
+		paths[i] = strings.Join(items, ".")
+	}
+	return strings.Join(paths, ",")
+}
+
+// Apply resets all fields of v absent from the mask to their zero values,
+// including UnknownFields. v must be a pointer to a message.
+func (m FieldMask) Apply(v StructValuer) error {
+	into := reflect.ValueOf(v)
+	if into.Kind() != reflect.Pointer || into.IsNil() || into.Elem().Kind() != reflect.Struct {
+		return ErrIncompatibleStruct
+	}
+	return applyFieldMask(into.Elem(), NewProjection(m.Paths...))
+}
+
+func applyFieldMask(v reflect.Value, p *Projection) error {
+	fields, err := validateAndExtractStruct(v.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		nested, ok := p.field(f.Index)
+		if !ok {
+			if f.OneOf {
+				clearOneOf(v, f)
+			} else {
+				clearField(v, f.Field)
+			}
+			continue
+		}
+		if nested == nil {
+			continue
+		}
+		if !f.OneOf {
+			if err = applyNestedFieldMask(v.FieldByIndex(f.Field.Index), nested); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, m := range f.OneOfIndexes {
+			if err = applyNestedFieldMask(v.FieldByIndex(m.Index), nested); err != nil {
+				return err
+			}
+		}
+	}
+
+	s := v.FieldByName("Structure")
+	if s.IsNil() {
+		return nil
+	}
+	structure := s.Interface().(*Structure)
+	var unknownFields []UnknownField
+	for _, u := range structure.UnknownFields {
+		if _, ok := p.field(u.Index); ok {
+			unknownFields = append(unknownFields, u)
+		}
+	}
+	structure.UnknownFields = unknownFields
+	return nil
+}
+
+func applyNestedFieldMask(v reflect.Value, p *Projection) error {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct || !canEncodeStruct(v.Type()) {
+		return nil
+	}
+	return applyFieldMask(v, p)
+}
+
+// maskedCopy returns a shallow copy of message v in which all fields absent
+// from p are reset to their zero values, including UnknownFields. Nested
+// messages partially included in p are copied the same way, so v is never
+// modified.
+func maskedCopy(v reflect.Value, p *Projection) (reflect.Value, error) {
+	fields, err := validateAndExtractStruct(v.Type())
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	n := reflect.New(v.Type()).Elem()
+	n.Set(v)
+	for _, f := range fields {
+		nested, ok := p.field(f.Index)
+		switch {
+		case !ok && f.OneOf:
+			clearOneOf(n, f)
+		case !ok:
+			clearField(n, f.Field)
+		case nested == nil:
+		case f.OneOf:
+			for _, m := range f.OneOfIndexes {
+				if err = maskNestedField(n.FieldByIndex(m.Index), nested); err != nil {
+					return reflect.Value{}, err
+				}
+			}
+		default:
+			if err = maskNestedField(n.FieldByIndex(f.Field.Index), nested); err != nil {
+				return reflect.Value{}, err
+			}
+		}
+	}
+
+	s := n.FieldByName("Structure")
+	if s.IsNil() {
+		return n, nil
+	}
+	structure := &Structure{}
+	for _, u := range s.Interface().(*Structure).UnknownFields {
+		if _, ok := p.field(u.Index); ok {
+			structure.UnknownFields = append(structure.UnknownFields, u)
+		}
+	}
+	s.Set(reflect.ValueOf(structure))
+	return n, nil
+}
+
+// maskNestedField replaces the message held by field v, either by value or
+// pointer, with a copy of it masked by p. See maskedCopy.
+func maskNestedField(v reflect.Value, p *Projection) error {
+	base := v
+	if base.Kind() == reflect.Pointer {
+		if base.IsNil() {
+			return nil
+		}
+		base = base.Elem()
+	}
+	if base.Kind() != reflect.Struct || !canEncodeStruct(base.Type()) {
+		return nil
+	}
+	masked, err := maskedCopy(base, p)
+	if err != nil {
+		return err
+	}
+	if v.Kind() == reflect.Pointer {
+		ptr := reflect.New(base.Type())
+		ptr.Elem().Set(masked)
+		masked = ptr
+	}
+	v.Set(masked)
+	return nil
+}
+
+// DiffFieldMask returns a FieldMask containing the paths of all fields that
+// differ between a and b, which must be messages of the same type. Nested
+// messages present on both a and b are compared field by field, producing
+// paths to their differing fields. Fields are compared using the same rules
+// as Equal.
+func DiffFieldMask(a, b StructValuer) (FieldMask, error) {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !va.IsValid() || !vb.IsValid() {
+		return FieldMask{}, ErrIncompatibleStruct
+	}
+	if va.Type() != vb.Type() {
+		return FieldMask{}, ErrStructTypeMismatch
+	}
+	for va.Kind() == reflect.Pointer {
+		if va.IsNil() || vb.IsNil() {
+			return FieldMask{}, ErrIncompatibleStruct
+		}
+		va, vb = va.Elem(), vb.Elem()
+	}
+	mask := FieldMask{}
+	if err := diffStruct(va, vb, nil, &mask); err != nil {
+		return FieldMask{}, err
+	}
+	return mask, nil
+}
+
+func diffStruct(a, b reflect.Value, prefix []int, mask *FieldMask) error {
+	fields, err := validateAndExtractStruct(a.Type())
+	if err != nil {
+		return err
+	}
+	path := func(idx int) []int {
+		p := make([]int, len(prefix), len(prefix)+1)
+		copy(p, prefix)
+		return append(p, idx)
+	}
+
+	for _, f := range fields {
+		if f.OneOf {
+			for _, m := range f.OneOfIndexes {
+				if !equalValues(a.FieldByIndex(m.Index), b.FieldByIndex(m.Index)) {
+					mask.Paths = append(mask.Paths, path(f.Index))
+					break
+				}
+			}
+			continue
+		}
+
+		fa, fb := a.FieldByIndex(f.Field.Index), b.FieldByIndex(f.Field.Index)
+		if equalValues(fa, fb) {
+			continue
+		}
+		if fa.Kind() == reflect.Pointer && !fa.IsNil() && !fb.IsNil() {
+			fa, fb = fa.Elem(), fb.Elem()
+		}
+		if fa.Kind() == reflect.Struct && canEncodeStruct(fa.Type()) {
+			if err = diffStruct(fa, fb, path(f.Index), mask); err != nil {
+				return err
+			}
+			continue
+		}
+		mask.Paths = append(mask.Paths, path(f.Index))
+	}
+
+	unknownA, unknownB := map[int]UnknownField{}, map[int]UnknownField{}
+	for _, u := range unknownFieldsOf(a) {
+		unknownA[u.Index] = u
+	}
+	for _, u := range unknownFieldsOf(b) {
+		unknownB[u.Index] = u
+	}
+	var unknownIndexes []int
+	for idx, u := range unknownA {
+		if o, ok := unknownB[idx]; !ok || !equalUnknownFields(u, o) {
+			unknownIndexes = append(unknownIndexes, idx)
+		}
+	}
+	for idx := range unknownB {
+		if _, ok := unknownA[idx]; !ok {
+			unknownIndexes = append(unknownIndexes, idx)
+		}
+	}
+	sort.Ints(unknownIndexes)
+	for _, idx := range unknownIndexes {
+		mask.Paths = append(mask.Paths, path(idx))
+	}
+	return nil
+}
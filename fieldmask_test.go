@@ -0,0 +1,141 @@
+package yarp
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestFieldMaskByName(t *testing.T) {
+	mask, err := FieldMaskByName(&TS{}, "name", "single_other.role", "8.0", "OneOfB", "optional_ts.project")
+	require.NoError(t, err)
+	assert.Equal(t, [][]int{{1}, {8, 1}, {8, 0}, {6}, {9, 0}}, mask.Paths)
+
+	_, err = FieldMaskByName(&TS{}, "missing")
+	assert.Error(t, err)
+	_, err = FieldMaskByName(&TS{}, "name.foo")
+	assert.Error(t, err)
+	_, err = FieldMaskByName(&TS{}, "42")
+	assert.Error(t, err)
+}
+
+func TestFieldMaskString(t *testing.T) {
+	mask := NewFieldMask([]int{1}, []int{8, 1})
+	assert.Equal(t, "1,8.1", mask.String())
+	parsed, err := ParseFieldMask(mask.String())
+	require.NoError(t, err)
+	assert.Equal(t, mask, parsed)
+
+	_, err = ParseFieldMask("1,a")
+	assert.Error(t, err)
+}
+
+func TestFieldMaskApply(t *testing.T) {
+	v := messageFixture()
+	mask, err := FieldMaskByName(v, "name", "single_other.role", "optional_ts", "one_of_a")
+	require.NoError(t, err)
+	require.NoError(t, mask.Apply(v))
+	assert.Zero(t, v.ID)
+	assert.Equal(t, "Vito", v.Name)
+	assert.Nil(t, v.Keys)
+	assert.Nil(t, v.Other)
+	assert.Nil(t, v.AMap)
+	require.NotNil(t, v.OneOfA)
+	assert.True(t, v.HasOneOfA)
+	assert.Empty(t, v.SingleOther.Project)
+	assert.Equal(t, "Baz", v.OptionalTS.Role)
+	assert.Empty(t, v.UnknownFields)
+
+	v = messageFixture()
+	require.NoError(t, NewFieldMask([]int{10}).Apply(v))
+	assert.Len(t, v.UnknownFields, 1)
+	assert.Nil(t, v.OneOfA)
+	assert.False(t, v.HasOneOfA)
+}
+
+func TestMaskedCopy(t *testing.T) {
+	mask, err := FieldMaskByName(&TS{}, "name", "single_other.role", "optional_ts.role", "one_of_a")
+	require.NoError(t, err)
+	v := messageFixture()
+	masked, err := maskedCopy(reflect.ValueOf(v).Elem(), NewProjection(mask.Paths...))
+	require.NoError(t, err)
+	assert.True(t, Equal(messageFixture(), v), "source must not be modified")
+
+	expected := messageFixture()
+	require.NoError(t, mask.Apply(expected))
+	trimmed := masked.Addr().Interface().(*TS)
+	assert.True(t, Equal(expected, trimmed), "expected %#v, got %#v", expected, trimmed)
+	assert.NotSame(t, v.OptionalTS, trimmed.OptionalTS)
+	assert.NotSame(t, v.Structure, trimmed.Structure)
+}
+
+func TestDiffFieldMask(t *testing.T) {
+	a, b := messageFixture(), messageFixture()
+	mask, err := DiffFieldMask(a, b)
+	require.NoError(t, err)
+	assert.Empty(t, mask.Paths)
+
+	b.Name = "Other"
+	b.SingleOther.Role = "Role"
+	b.OptionalTS = nil
+	str := "other"
+	b.OneOfA = &str
+	b.UnknownFields = append(b.UnknownFields, UnknownField{Index: 12, Type: Void})
+	mask, err = DiffFieldMask(a, b)
+	require.NoError(t, err)
+	assert.Equal(t, [][]int{{1}, {6}, {8, 1}, {9}, {12}}, mask.Paths)
+
+	_, err = DiffFieldMask(a, &OtherTS{})
+	assert.ErrorIs(t, err, ErrStructTypeMismatch)
+	_, err = DiffFieldMask(nil, b)
+	assert.ErrorIs(t, err, ErrIncompatibleStruct)
+	_, err = DiffFieldMask(a, nil)
+	assert.ErrorIs(t, err, ErrIncompatibleStruct)
+
+	// Entries of decoded maps may be present in any order.
+	mask, err = DiffFieldMask(unknownMap("a", "b", "c"), unknownMap("b", "c", "a"))
+	require.NoError(t, err)
+	assert.Empty(t, mask.Paths)
+	mask, err = DiffFieldMask(unknownMap("a", "b"), unknownMap("a", "c"))
+	require.NoError(t, err)
+	assert.Equal(t, [][]int{{2}, {3}, {4}}, mask.Paths)
+}
+
+func TestServerFieldMask(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	srv := SimpleServerImpl{registeredClients: 5}
+	s := NewServer(l.Addr().String())
+	RegisterSimpleService(s, &srv)
+	go func() {
+		_ = s.StartListener(l)
+	}()
+	RegisterMessages()
+	c := NewSimpleServiceClient(l.Addr().String())
+
+	res, _, err := c.DeregisterUser(context.Background(), &SimpleRequest{}, map[string]string{
+		FieldMaskHeader: NewFieldMask([]int{1}).String(),
+	})
+	require.NoError(t, err)
+	assert.Zero(t, res.ID)
+
+	res, _, err = c.DeregisterUser(context.Background(), &SimpleRequest{}, map[string]string{
+		FieldMaskHeader: NewFieldMask([]int{0}).String(),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), res.ID)
+
+	_, _, err = c.DeregisterUser(context.Background(), &SimpleRequest{}, map[string]string{
+		FieldMaskHeader: "invalid",
+	})
+	ok, managed := IsManagedError(err)
+	require.True(t, ok)
+	assert.Equal(t, ErrorKind(ErrorKindBadRequest), managed.Kind)
+}
@@ -7,29 +7,46 @@ import (
 )
 
 func encodeFloat32(value float32) []byte {
+	return appendFloat32(nil, value)
+}
+
+func appendFloat32(dst []byte, value float32) []byte {
 	header := uint8(0x40)
 	if value == 0 {
 		header |= 0x8
-		return []byte{header}
+		return append(dst, header)
 	}
-	data := make([]byte, 5)
+	var data [5]byte
 	data[0] = header
 	v := math.Float32bits(value)
 	binary.LittleEndian.PutUint32(data[1:], v)
-	return data
+	return append(dst, data[:]...)
 }
 
 func encodeFloat64(value float64) []byte {
+	return appendFloat64(nil, value)
+}
+
+func appendFloat64(dst []byte, value float64) []byte {
 	header := uint8(0x50)
 	if value == 0 {
 		header |= 0x8
-		return []byte{header}
+		return append(dst, header)
 	}
-	data := make([]byte, 9)
+	var data [9]byte
 	data[0] = header
 	v := math.Float64bits(value)
 	binary.LittleEndian.PutUint64(data[1:], v)
-	return data
+	return append(dst, data[:]...)
+}
+
+// sizeFloat returns the amount of bytes required to encode a float with the
+// provided amount of bits.
+func sizeFloat(value float64, bits int) int {
+	if value == 0 {
+		return 1
+	}
+	return 1 + bits/8
 }
 
 func decodeFloat(header byte, reader io.Reader) (bits int, value float64, err error) {
@@ -0,0 +1,152 @@
+package yarp
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+// Handler invokes the handler of a method returning a single value, given its
+// request message, and returns its response headers and value. For
+// client-streaming methods, msg is the receiver provided to the handler.
+type Handler func(ctx context.Context, req *RPCRequest, msg interface{}) (Header, interface{}, error)
+
+// Interceptor wraps the invocation of handlers of methods returning a single
+// value. Interceptors are invoked after the request message is decoded, and
+// either call next to continue processing the request, or return a response
+// or error by themselves. The message, the response and the error returned by
+// next may be inspected or replaced.
+type Interceptor func(ctx context.Context, req *RPCRequest, msg interface{}, next Handler) (Header, interface{}, error)
+
+// ServerStream delivers values of a streamed response to the client.
+type ServerStream interface {
+	// Push sends a value to the client. Once Push returns an error, the
+	// handler's context is cancelled, and further values are discarded.
+	Push(v interface{}) error
+}
+
+// StreamHandler invokes the handler of a server-streaming or
+// bidirectional-streaming method, given its request message, delivering the
+// values it pushes through stream. For bidirectional-streaming methods, msg is
+// the receiver provided to the handler.
+type StreamHandler func(ctx context.Context, req *RPCRequest, msg interface{}, stream ServerStream) error
+
+// StreamInterceptor wraps the invocation of handlers of server-streaming and
+// bidirectional-streaming methods. Like Interceptor, it may inspect the
+// request message and the error returned by next. Pushed values may be
+// inspected or replaced by providing next with a ServerStream wrapping the
+// one received by the StreamInterceptor.
+type StreamInterceptor func(ctx context.Context, req *RPCRequest, msg interface{}, stream ServerStream, next StreamHandler) error
+
+// UseInterceptor registers a given Interceptor to wrap handlers of methods
+// returning a single value. Interceptors are invoked in the order they are
+// registered, after all Middlewares.
+func (s *Server) UseInterceptor(i Interceptor) {
+	s.interceptors = append(s.interceptors, i)
+}
+
+// UseStreamInterceptor registers a given StreamInterceptor to wrap handlers of
+// methods returning streams. StreamInterceptors are invoked in the order they
+// are registered, after all Middlewares.
+func (s *Server) UseStreamInterceptor(i StreamInterceptor) {
+	s.streamInterceptors = append(s.streamInterceptors, i)
+}
+
+// chainInterceptors returns a Handler invoking all interceptors in order,
+// followed by h.
+func chainInterceptors(interceptors []Interceptor, h Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		in, next := interceptors[i], h
+		h = func(ctx context.Context, req *RPCRequest, msg interface{}) (Header, interface{}, error) {
+			return in(ctx, req, msg, next)
+		}
+	}
+	return h
+}
+
+// chainStreamInterceptors returns a StreamHandler invoking all interceptors in
+// order, followed by h.
+func chainStreamInterceptors(interceptors []StreamInterceptor, h StreamHandler) StreamHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		in, next := interceptors[i], h
+		h = func(ctx context.Context, req *RPCRequest, msg interface{}, stream ServerStream) error {
+			return in(ctx, req, msg, stream, next)
+		}
+	}
+	return h
+}
+
+// serverStream is the ServerStream writing values of a streamed response to
+// its connection. The response header is written along with the first value.
+type serverStream struct {
+	c   *srvConn
+	h   Header
+	mu  sync.Mutex
+	err error
+}
+
+func (s *serverStream) Push(v interface{}) error {
+	if isNilValue(v) {
+		return ErrInvalidType
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.err = s.c.writeStreamValue(s.h, reflect.ValueOf(v)); s.err != nil {
+		s.c.handleError(s.err)
+		// Further values cannot be delivered, so the handler is
+		// interrupted.
+		if s.c.cancel != nil {
+			s.c.cancel()
+		}
+	}
+	return s.err
+}
+
+// Invoker performs a request of a unary method, given its request value, and
+// returns the response value and headers provided by the server.
+type Invoker func(ctx context.Context, req Request, v interface{}) (interface{}, map[string]string, error)
+
+// ClientInterceptor wraps requests of unary methods performed by a Client.
+// ClientInterceptors either call next to perform the request, or return a
+// response or error by themselves. The Request, its value, and the result of
+// next may be inspected or replaced, and next may be called more than once to
+// retry a request.
+type ClientInterceptor func(ctx context.Context, req Request, v interface{}, next Invoker) (interface{}, map[string]string, error)
+
+// StreamInvoker performs a request of a server-streaming method, given its
+// request value, and returns the channel of values and the headers provided by
+// the server.
+type StreamInvoker func(ctx context.Context, req Request, v interface{}) (<-chan interface{}, map[string]string, error)
+
+// ClientStreamInterceptor wraps requests of server-streaming methods performed
+// by a Client. Like ClientInterceptor, it may inspect or replace the Request,
+// its value, and the result of next. Received values may be inspected or
+// replaced by returning a channel fed by the one returned by next.
+type ClientStreamInterceptor func(ctx context.Context, req Request, v interface{}, next StreamInvoker) (<-chan interface{}, map[string]string, error)
+
+// chainClientInterceptors returns an Invoker invoking all interceptors in
+// order, followed by i.
+func chainClientInterceptors(interceptors []ClientInterceptor, i Invoker) Invoker {
+	for n := len(interceptors) - 1; n >= 0; n-- {
+		in, next := interceptors[n], i
+		i = func(ctx context.Context, req Request, v interface{}) (interface{}, map[string]string, error) {
+			return in(ctx, req, v, next)
+		}
+	}
+	return i
+}
+
+// chainClientStreamInterceptors returns a StreamInvoker invoking all
+// interceptors in order, followed by i.
+func chainClientStreamInterceptors(interceptors []ClientStreamInterceptor, i StreamInvoker) StreamInvoker {
+	for n := len(interceptors) - 1; n >= 0; n-- {
+		in, next := interceptors[n], i
+		i = func(ctx context.Context, req Request, v interface{}) (<-chan interface{}, map[string]string, error) {
+			return in(ctx, req, v, next)
+		}
+	}
+	return i
+}
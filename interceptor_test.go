@@ -0,0 +1,283 @@
+package yarp
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// idStream increments the ID of pushed responses, rejecting those whose ID
+// exceeds a limit.
+type idStream struct {
+	ServerStream
+	limit int32
+}
+
+func (s idStream) Push(v interface{}) error {
+	res := *v.(*SimpleResponse)
+	res.ID++
+	if res.ID > s.limit {
+		return Error{Kind: ErrorKindManagedError, Identifier: "limit"}
+	}
+	return s.ServerStream.Push(&res)
+}
+
+func TestInterceptors(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	var calls []string
+	s := NewServer(l.Addr().String())
+	s.Use(func(req *RPCRequest) (*RPCRequest, error) {
+		calls = append(calls, "middleware")
+		return req, nil
+	})
+	s.UseInterceptor(func(ctx context.Context, req *RPCRequest, msg interface{}, next Handler) (Header, interface{}, error) {
+		calls = append(calls, "first "+req.MethodFQN)
+		if r, ok := msg.(*SimpleRequest); ok && r.Name == "denied" {
+			return nil, nil, Error{Kind: ErrorKindUnauthorized}
+		}
+		h, res, err := next(ctx, req, msg)
+		if err == nil {
+			if r, ok := res.(*SimpleResponse); ok {
+				r.ID *= 10
+			}
+		}
+		return h, res, err
+	})
+	s.UseInterceptor(func(ctx context.Context, req *RPCRequest, msg interface{}, next Handler) (Header, interface{}, error) {
+		calls = append(calls, "second")
+		return next(ctx, req, msg)
+	})
+	s.UseStreamInterceptor(func(ctx context.Context, req *RPCRequest, msg interface{}, stream ServerStream, next StreamHandler) error {
+		calls = append(calls, "stream "+req.MethodFQN)
+		return next(ctx, req, msg, idStream{stream, 3})
+	})
+	s.RegisterHandler(0x1, "io.vito.Interceptors.unary", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		id, err := strconv.Atoi(req.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &SimpleResponse{ID: int32(id)}, nil
+	})
+	s.RegisterHandler(0x2, "io.vito.Interceptors.stream", func(ctx context.Context, headers Header, req *SimpleRequest, out *SimpleResponseContextStreamer) error {
+		n, err := strconv.Atoi(req.Name)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err = out.Push(&SimpleResponse{ID: int32(i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	s.RegisterHandler(0x3, "io.vito.Interceptors.upload", func(ctx context.Context, headers Header, in *SimpleRequestReceiver) (Header, *SimpleResponse, error) {
+		return nil, &SimpleResponse{}, nil
+	})
+	var uploadMsg interface{}
+	s.UseInterceptor(func(ctx context.Context, req *RPCRequest, msg interface{}, next Handler) (Header, interface{}, error) {
+		if req.Identifier == 0x3 {
+			uploadMsg = msg
+		}
+		return next(ctx, req, msg)
+	})
+	go func() {
+		_ = s.StartListener(l)
+	}()
+	c := NewClient(l.Addr().String())
+
+	t.Run("unary", func(t *testing.T) {
+		calls = nil
+		res, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &SimpleRequest{Name: "4"})
+		require.NoError(t, err)
+		assert.Equal(t, int32(40), res.(*SimpleResponse).ID)
+		assert.Equal(t, []string{"middleware", "first io.vito.Interceptors.unary", "second"}, calls)
+	})
+
+	t.Run("short-circuit", func(t *testing.T) {
+		calls = nil
+		_, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &SimpleRequest{Name: "denied"})
+		ok, managed := IsManagedError(err)
+		require.True(t, ok, err)
+		assert.Equal(t, ErrorKind(ErrorKindUnauthorized), managed.Kind)
+		assert.Equal(t, []string{"middleware", "first io.vito.Interceptors.unary"}, calls)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		calls = nil
+		ch, _, status, err := c.DoRequestStreamedWithStatus(context.Background(), Request{Method: 0x2}, &SimpleRequest{Name: "3"})
+		require.NoError(t, err)
+		var ids []int32
+		for v := range ch {
+			ids = append(ids, v.(*SimpleResponse).ID)
+		}
+		_, err = status.Wait()
+		require.NoError(t, err)
+		assert.Equal(t, []int32{1, 2, 3}, ids)
+		assert.Equal(t, []string{"middleware", "stream io.vito.Interceptors.stream"}, calls)
+	})
+
+	t.Run("rejected push", func(t *testing.T) {
+		ch, _, status, err := c.DoRequestStreamedWithStatus(context.Background(), Request{Method: 0x2}, &SimpleRequest{Name: "5"})
+		require.NoError(t, err)
+		count := 0
+		for range ch {
+			count++
+		}
+		_, err = status.Wait()
+		assert.Equal(t, 3, count)
+		ok, managed := IsManagedError(err)
+		require.True(t, ok, err)
+		assert.Equal(t, "limit", managed.Identifier)
+	})
+
+	t.Run("receiver", func(t *testing.T) {
+		stream, err := c.NewStream(context.Background(), Request{Method: 0x3})
+		require.NoError(t, err)
+		_, _, err = stream.CloseAndRecv()
+		require.NoError(t, err)
+		assert.IsType(t, &SimpleRequestReceiver{}, uploadMsg)
+	})
+}
+
+func TestChainInterceptors(t *testing.T) {
+	var order []int
+	interceptor := func(i int) Interceptor {
+		return func(ctx context.Context, req *RPCRequest, msg interface{}, next Handler) (Header, interface{}, error) {
+			order = append(order, i)
+			return next(ctx, req, msg)
+		}
+	}
+	h := chainInterceptors([]Interceptor{interceptor(1), interceptor(2), interceptor(3)}, func(ctx context.Context, req *RPCRequest, msg interface{}) (Header, interface{}, error) {
+		order = append(order, 0)
+		return nil, msg, nil
+	})
+	_, res, err := h(context.Background(), &RPCRequest{}, "msg")
+	require.NoError(t, err)
+	assert.Equal(t, "msg", res)
+	assert.Equal(t, []int{1, 2, 3, 0}, order)
+}
+
+func TestClientInterceptors(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	s := NewServer(l.Addr().String())
+	failures := 1
+	s.RegisterHandler(0x1, "io.vito.ClientInterceptors.unary", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		if req.Name == "flaky" && failures > 0 {
+			failures--
+			return nil, nil, Error{Kind: ErrorKindManagedError, Identifier: "flaky"}
+		}
+		SetTrailer(ctx, "Trace", headers.Get("Trace"))
+		return Header{"Trace": headers.Get("Trace")}, &SimpleResponse{ID: 1}, nil
+	})
+	s.RegisterHandler(0x2, "io.vito.ClientInterceptors.stream", func(ctx context.Context, headers Header, req *SimpleRequest, out *SimpleResponseStreamer) error {
+		for i := 0; i < 3; i++ {
+			out.Push(&SimpleResponse{ID: int32(i)})
+		}
+		return nil
+	})
+	go func() {
+		_ = s.StartListener(l)
+	}()
+
+	var calls []string
+	c := NewClient(l.Addr().String(),
+		WithClientInterceptor(func(ctx context.Context, req Request, v interface{}, next Invoker) (interface{}, map[string]string, error) {
+			calls = append(calls, "trace")
+			req.Headers = Header(req.Headers).Clone()
+			Header(req.Headers).Set("Trace", strconv.FormatUint(req.Method, 10))
+			return next(ctx, req, v)
+		}),
+		WithClientInterceptor(func(ctx context.Context, req Request, v interface{}, next Invoker) (interface{}, map[string]string, error) {
+			calls = append(calls, "retry")
+			res, headers, err := next(ctx, req, v)
+			if ok, _ := IsManagedError(err); ok {
+				calls = append(calls, "retry")
+				return next(ctx, req, v)
+			}
+			return res, headers, err
+		}),
+		WithClientStreamInterceptor(func(ctx context.Context, req Request, v interface{}, next StreamInvoker) (<-chan interface{}, map[string]string, error) {
+			if v.(*SimpleRequest).Name == "cached" {
+				ch := make(chan interface{}, 1)
+				ch <- &SimpleResponse{ID: 42}
+				close(ch)
+				return ch, nil, nil
+			}
+			in, headers, err := next(ctx, req, v)
+			if err != nil {
+				return nil, nil, err
+			}
+			out := make(chan interface{})
+			go func() {
+				defer close(out)
+				for v := range in {
+					v.(*SimpleResponse).ID *= 2
+					out <- v
+				}
+			}()
+			return out, headers, nil
+		}),
+	)
+
+	t.Run("unary", func(t *testing.T) {
+		calls = nil
+		res, headers, trailer, err := c.DoRequestWithTrailer(context.Background(), Request{Method: 0x1}, &SimpleRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), res.(*SimpleResponse).ID)
+		assert.Equal(t, "1", Header(headers).Get("Trace"))
+		assert.Equal(t, "1", Header(trailer).Get("Trace"))
+		assert.Equal(t, []string{"trace", "retry"}, calls)
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		calls = nil
+		_, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &SimpleRequest{Name: "flaky"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"trace", "retry", "retry"}, calls)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		ch, _, status, err := c.DoRequestStreamedWithStatus(context.Background(), Request{Method: 0x2}, &SimpleRequest{})
+		require.NoError(t, err)
+		var ids []int32
+		for v := range ch {
+			ids = append(ids, v.(*SimpleResponse).ID)
+		}
+		_, err = status.Wait()
+		require.NoError(t, err)
+		assert.Equal(t, []int32{0, 2, 4}, ids)
+	})
+
+	t.Run("stream provided by interceptor", func(t *testing.T) {
+		ch, _, status, err := c.DoRequestStreamedWithStatus(context.Background(), Request{Method: 0x2}, &SimpleRequest{Name: "cached"})
+		require.NoError(t, err)
+		assert.Equal(t, int32(42), (<-ch).(*SimpleResponse).ID)
+		trailer, err := status.Wait()
+		assert.NoError(t, err)
+		assert.Nil(t, trailer)
+	})
+}
+
+func TestServerStreamPushNil(t *testing.T) {
+	s := &serverStream{c: makeConnection()}
+	assert.Equal(t, ErrInvalidType, s.Push(nil))
+	assert.Equal(t, ErrInvalidType, s.Push((*SimpleResponse)(nil)))
+	assert.NoError(t, s.err)
+}
@@ -0,0 +1,109 @@
+package yarp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logger receives structured log entries from Clients and Servers. Each entry
+// is comprised of a message followed by alternating keys and values, following
+// the conventions of log/slog, so that a *slog.Logger may be used as a Logger.
+// Entries include the following keys, when applicable:
+//   - method: the fully-qualified name of the requested method, logged by
+//     Servers, which resolve it from their registered handlers, and by
+//     Clients in case it is provided through Request.MethodFQN;
+//   - method_id: the identifier of the requested method, logged by Clients,
+//     and by Servers for unknown methods;
+//   - peer: the address of the remote party;
+//   - duration: the time.Duration of the request or connection;
+//   - bytes_read and bytes_written: the amount of bytes transferred;
+//   - error: the error that occurred.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// nopLogger is the Logger used in case none is provided, discarding all
+// entries.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// isSlow returns whether a request that took d to complete exceeds a given
+// threshold. Zero thresholds disable slow request reporting.
+func isSlow(d, threshold time.Duration) bool {
+	return threshold > 0 && d >= threshold
+}
+
+// countingConn counts bytes read from and written to a connection.
+type countingConn struct {
+	io.ReadWriteCloser
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// counts returns the amount of bytes read and written so far.
+func (c *countingConn) counts() (read, written int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&c.read), atomic.LoadInt64(&c.written)
+}
+
+// loggedConn logs the closing of a connection established by a Client, along
+// with its duration and the amount of bytes transferred through it.
+type loggedConn struct {
+	net.Conn
+	counted countingConn
+	log     Logger
+	peer    string
+	started time.Time
+	once    sync.Once
+}
+
+func newLoggedConn(conn net.Conn, log Logger, peer string) *loggedConn {
+	return &loggedConn{
+		Conn:    conn,
+		counted: countingConn{ReadWriteCloser: conn},
+		log:     log,
+		peer:    peer,
+		started: time.Now(),
+	}
+}
+
+func (c *loggedConn) Read(p []byte) (int, error) {
+	return c.counted.Read(p)
+}
+
+func (c *loggedConn) Write(p []byte) (int, error) {
+	return c.counted.Write(p)
+}
+
+func (c *loggedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		read, written := c.counted.counts()
+		c.log.Debug("connection closed", "peer", c.peer, "duration", time.Since(c.started), "bytes_read", read, "bytes_written", written)
+	})
+	return err
+}
@@ -0,0 +1,224 @@
+package yarp
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type logEntry struct {
+	level string
+	msg   string
+	args  map[string]interface{}
+}
+
+// recordingLogger delivers logged entries through a channel.
+type recordingLogger chan logEntry
+
+func (l recordingLogger) log(level, msg string, args []interface{}) {
+	e := logEntry{level: level, msg: msg, args: map[string]interface{}{}}
+	for i := 0; i+1 < len(args); i += 2 {
+		e.args[args[i].(string)] = args[i+1]
+	}
+	l <- e
+}
+
+func (l recordingLogger) Debug(msg string, args ...interface{}) { l.log("debug", msg, args) }
+func (l recordingLogger) Info(msg string, args ...interface{})  { l.log("info", msg, args) }
+func (l recordingLogger) Warn(msg string, args ...interface{})  { l.log("warn", msg, args) }
+func (l recordingLogger) Error(msg string, args ...interface{}) { l.log("error", msg, args) }
+
+// next returns the next entry with a given message, skipping others.
+func (l recordingLogger) next(t *testing.T, msg string) logEntry {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-l:
+			if e.msg == msg {
+				return e
+			}
+		case <-timeout:
+			require.FailNow(t, "entry not logged", msg)
+		}
+	}
+}
+
+// collect returns the next entries with the given messages, regardless of the
+// order they are logged.
+func (l recordingLogger) collect(t *testing.T, msgs ...string) map[string]logEntry {
+	entries := map[string]logEntry{}
+	timeout := time.After(5 * time.Second)
+	for len(entries) < len(msgs) {
+		select {
+		case e := <-l:
+			for _, msg := range msgs {
+				if e.msg == msg {
+					entries[msg] = e
+				}
+			}
+		case <-timeout:
+			require.FailNow(t, "entries not logged", msgs)
+		}
+	}
+	return entries
+}
+
+func TestLogging(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+	RegisterStructType(Upload{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	serverLog := make(recordingLogger, 100)
+	s := NewServer(l.Addr().String(), WithLogger(serverLog), WithSlowRequestThreshold(20*time.Millisecond), WithTimeout(50*time.Millisecond))
+	s.RegisterHandler(0x1, "io.vito.Logging.fast", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		return nil, &SimpleResponse{}, nil
+	})
+	s.RegisterHandler(0x2, "io.vito.Logging.slow", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		time.Sleep(30 * time.Millisecond)
+		return nil, &SimpleResponse{}, nil
+	})
+	s.RegisterHandler(0x3, "io.vito.Logging.fail", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		return nil, nil, Error{Kind: ErrorKindManagedError, Identifier: "fail"}
+	})
+	s.RegisterHandler(0x4, "io.vito.Logging.upload", func(ctx context.Context, headers Header, in *SimpleRequestReceiver) (Header, *SimpleResponse, error) {
+		count := int32(0)
+		for {
+			if _, err := in.Recv(); err == io.EOF {
+				return nil, &SimpleResponse{ID: count}, nil
+			} else if err != nil {
+				return nil, nil, err
+			}
+			count++
+		}
+	})
+	s.RegisterHandler(0x5, "io.vito.Logging.download", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *Upload, error) {
+		return nil, &Upload{Data: NewBlobBytes(make([]byte, 1<<16))}, nil
+	})
+	go func() {
+		_ = s.StartListener(l)
+	}()
+	clientLog := make(recordingLogger, 100)
+	c := NewClient(l.Addr().String(), WithLogger(clientLog), WithSlowRequestThreshold(20*time.Millisecond))
+
+	t.Run("completed", func(t *testing.T) {
+		_, _, err := c.DoRequest(context.Background(), Request{Method: 0x1, MethodFQN: "io.vito.Logging.fast"}, &SimpleRequest{Name: "Paul"})
+		require.NoError(t, err)
+
+		entries := clientLog.collect(t, "connection opened", "request completed", "connection closed")
+		assert.Equal(t, l.Addr().String(), entries["connection opened"].args["peer"])
+		e := entries["request completed"]
+		assert.Equal(t, "debug", e.level)
+		assert.Equal(t, "io.vito.Logging.fast", e.args["method"])
+		assert.Equal(t, uint64(0x1), e.args["method_id"])
+		assert.Equal(t, l.Addr().String(), e.args["peer"])
+		assert.Greater(t, e.args["bytes_read"], int64(0))
+		assert.Greater(t, e.args["bytes_written"], int64(0))
+		e = entries["connection closed"]
+		assert.IsType(t, time.Duration(0), e.args["duration"])
+		assert.Greater(t, e.args["bytes_read"], int64(0))
+
+		entries = serverLog.collect(t, "connection accepted", "request completed", "connection closed")
+		assert.Equal(t, "debug", entries["connection accepted"].level)
+		e = entries["request completed"]
+		assert.Equal(t, "io.vito.Logging.fast", e.args["method"])
+		assert.NotNil(t, e.args["peer"])
+		assert.IsType(t, time.Duration(0), e.args["duration"])
+		assert.Greater(t, e.args["bytes_read"], int64(0))
+		assert.Greater(t, e.args["bytes_written"], int64(0))
+		assert.Greater(t, entries["connection closed"].args["bytes_written"], int64(0))
+	})
+
+	t.Run("client stream", func(t *testing.T) {
+		stream, err := c.NewStream(context.Background(), Request{Method: 0x4})
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&SimpleRequest{Name: "Paul"}))
+		require.NoError(t, stream.Send(&SimpleRequest{Name: "Ringo"}))
+		res, _, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), res.(*SimpleResponse).ID)
+
+		e := clientLog.next(t, "request completed")
+		assert.Equal(t, uint64(0x4), e.args["method_id"])
+		assert.Greater(t, e.args["bytes_read"], int64(0))
+		assert.Greater(t, e.args["bytes_written"], int64(0))
+		assert.Equal(t, "io.vito.Logging.upload", serverLog.next(t, "request completed").args["method"])
+	})
+
+	t.Run("streamed blob", func(t *testing.T) {
+		latest := NewClient(l.Addr().String(), WithLogger(clientLog), WithWireVersion(LatestWireVersion))
+		res, _, err := latest.DoRequest(context.Background(), Request{Method: 0x5}, &SimpleRequest{})
+		require.NoError(t, err)
+		select {
+		case e := <-clientLog:
+			assert.NotEqual(t, "request completed", e.msg, "request logged before its Blob was read")
+		default:
+		}
+		data, err := io.ReadAll(res.(*Upload).Data)
+		require.NoError(t, err)
+		e := clientLog.next(t, "request completed")
+		assert.GreaterOrEqual(t, e.args["bytes_read"], int64(len(data)))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		_, _, err = latest.DoRequest(ctx, Request{Method: 0x5}, &SimpleRequest{})
+		require.NoError(t, err)
+		// Interrupting the request before its Blob is read is reported.
+		cancel()
+		assert.Equal(t, context.Canceled, clientLog.next(t, "request failed").args["error"])
+	})
+
+	t.Run("slow", func(t *testing.T) {
+		_, _, err := c.DoRequest(context.Background(), Request{Method: 0x2}, &SimpleRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, "warn", clientLog.next(t, "slow request").level)
+		e := serverLog.next(t, "slow request")
+		assert.Equal(t, "warn", e.level)
+		assert.Equal(t, "io.vito.Logging.slow", e.args["method"])
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		_, _, err := c.DoRequest(context.Background(), Request{Method: 0x3}, &SimpleRequest{})
+		require.Error(t, err)
+		assert.Equal(t, err, clientLog.next(t, "request failed").args["error"])
+		e := serverLog.next(t, "request failed")
+		assert.Equal(t, "io.vito.Logging.fail", e.args["method"])
+		ok, _ := IsManagedError(e.args["error"].(error))
+		assert.True(t, ok)
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		_, _, err := c.DoRequest(context.Background(), Request{Method: 0x9}, &SimpleRequest{})
+		require.Error(t, err)
+		assert.Equal(t, uint64(0x9), serverLog.next(t, "unknown method").args["method_id"])
+	})
+
+	t.Run("decode failure", func(t *testing.T) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		data, err := Request{Method: 0x1}.Encode()
+		require.NoError(t, err)
+		_, err = conn.Write(append(data, 0xFF))
+		require.NoError(t, err)
+		// The truncated value cannot be decoded.
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+		e := serverLog.next(t, "decode failed")
+		assert.Equal(t, "io.vito.Logging.fast", e.args["method"])
+		assert.Error(t, e.args["error"].(error))
+	})
+
+	t.Run("headers timeout", func(t *testing.T) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, "warn", serverLog.next(t, "headers timeout").level)
+	})
+}
@@ -15,67 +15,98 @@ type MapValue struct {
 
 var reflectedMapValue = reflect.TypeOf(&MapValue{})
 
-func encodeMap(val reflect.Value) ([]byte, error) {
+func (c codec) encodeMap(val reflect.Value) ([]byte, error) {
+	return c.appendMap(nil, val)
+}
+
+func (c codec) appendMap(dst []byte, val reflect.Value) ([]byte, error) {
+	kLen, vLen, err := c.mapBodySize(val)
+	if err != nil {
+		return nil, err
+	}
+
+	if val.Len() == 0 {
+		head := byte(0xc0)
+		if !val.IsNil() && c.emptyContainers() {
+			head |= 0x10
+		}
+		return append(dst, head), nil
+	}
+
+	mLen := sizeInteger(uint64(kLen)) + kLen + sizeInteger(uint64(vLen)) + vLen
+	dst = appendInteger(dst, uint64(mLen), 0xc0)
+
+	// Keys and values are written in two passes, so both must observe the
+	// same iteration order.
+	keys := val.MapKeys()
+	dst = appendUint(dst, uint64(kLen))
+	for _, k := range keys {
+		if dst, err = c.appendEncode(dst, k); err != nil {
+			return nil, err
+		}
+	}
+	dst = appendUint(dst, uint64(vLen))
+	for _, k := range keys {
+		if dst, err = c.appendEncode(dst, val.MapIndex(k)); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+func (c codec) sizeMap(val reflect.Value) (int, error) {
+	kLen, vLen, err := c.mapBodySize(val)
+	if err != nil || val.Len() == 0 {
+		return 1, err
+	}
+	mLen := sizeInteger(uint64(kLen)) + kLen + sizeInteger(uint64(vLen)) + vLen
+	return sizeInteger(uint64(mLen)) + mLen, nil
+}
+
+// mapBodySize type-checks val, and returns the amount of bytes required to
+// encode its keys and values.
+func (c codec) mapBodySize(val reflect.Value) (kLen, vLen int, err error) {
 	if val.Kind() != reflect.Map {
-		return nil, fmt.Errorf("encodeMap invoked for non-map type %s", val.String())
+		return 0, 0, fmt.Errorf("encodeMap invoked for non-map type %s", val.String())
 	}
 
 	kType := val.Type().Key()
 	vType := val.Type().Elem()
 
 	if !validMapKeyType(kType.Kind()) {
-		return nil, fmt.Errorf("encodeMap invoked for map with non-encodable key type %s", kType)
+		return 0, 0, fmt.Errorf("encodeMap invoked for map with non-encodable key type %s", kType)
 	}
 
 	if !canEncode(vType) {
-		return nil, fmt.Errorf("cannot encode map value type %s", vType)
+		return 0, 0, fmt.Errorf("cannot encode map value type %s", vType)
 	}
 
-	var keys []byte
-	var values []byte
-
 	iter := val.MapRange()
 	for iter.Next() {
-		k, err := encode(iter.Key())
+		k, err := c.size(iter.Key())
 		if err != nil {
-			return nil, err
+			return 0, 0, err
 		}
-		v, err := encode(iter.Value())
+		v, err := c.size(iter.Value())
 		if err != nil {
-			return nil, err
+			return 0, 0, err
 		}
-		keys = append(keys, k...)
-		values = append(values, v...)
-	}
-
-	kLen := len(keys)
-	vLen := len(values)
-	mLen := val.Len()
-
-	if mLen == 0 {
-		head := encodeInteger(0)
-		head[0] |= 0xc0
-		return head, nil
+		kLen += k
+		vLen += v
 	}
-
-	kLenBytes := encodeUint(uint64(kLen))
-	vLenBytes := encodeUint(uint64(vLen))
-
-	keys = append(kLenBytes, keys...)
-	values = append(vLenBytes, values...)
-	mLen = len(keys) + len(values)
-	head := encodeInteger(uint64(mLen))
-	head[0] |= 0xc0
-	head = append(head, keys...)
-	return append(head, values...), nil
+	return kLen, vLen, nil
 }
 
-func decodeMap(header byte, r io.Reader) (*MapValue, error) {
-	_, size, err := decodeScalar(header, r)
+func (c codec) decodeMap(header byte, r io.Reader) (*MapValue, error) {
+	empty, size, err := decodeScalar(header, r)
 	if err != nil {
 		return nil, err
 	}
 	if size == 0 {
+		if empty {
+			// Explicitly empty map; see WireVersion4.
+			return &MapValue{}, nil
+		}
 		return nil, nil
 	} else if size >= sizeLimit {
 		return nil, ErrSizeTooLarge
@@ -95,7 +126,7 @@ func decodeMap(header byte, r io.Reader) (*MapValue, error) {
 	mapVal := &MapValue{}
 	keyType := Invalid
 	for {
-		t, v, err := Decode(keyReader)
+		t, v, err := c.decode(keyReader)
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -120,7 +151,7 @@ func decodeMap(header byte, r io.Reader) (*MapValue, error) {
 	valReader := io.LimitReader(r, int64(valLen))
 	valType := Invalid
 	for {
-		t, v, err := Decode(valReader)
+		t, v, err := c.decode(valReader)
 		if err != nil {
 			if err == io.EOF {
 				break
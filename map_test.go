@@ -15,12 +15,12 @@ func TestMap(t *testing.T) {
 		"c": 3,
 		"d": 4,
 	}
-	data, err := encode(reflect.ValueOf(val))
+	data, err := defaultCodec.encode(reflect.ValueOf(val))
 	require.NoError(t, err)
 	// Can't be tested through []byte, since Go's map order is non-deterministic.
 	//assert.Equal(t, []byte{0xc1, 0x22, 0x21, 0x10, 0xa2, 0x61, 0xa2, 0x62, 0xa2, 0x63, 0xa2, 0x64, 0x21, 0xa, 0x32, 0x34, 0x36, 0x31, 0x8}, data)
 	assert.Equal(t, Map, detectType(data[0]))
-	dec, err := decodeMap(data[0], bytes.NewReader(data[1:]))
+	dec, err := defaultCodec.decodeMap(data[0], bytes.NewReader(data[1:]))
 	require.NoError(t, err)
 	for k, v := range val {
 		kOk, vOk := false, false
@@ -40,3 +40,25 @@ func TestMap(t *testing.T) {
 		assert.True(t, vOk, "%#v should be present in %#v", v, dec.Values)
 	}
 }
+
+func TestMapEmpty(t *testing.T) {
+	v4 := newCodec(WireVersion4)
+	encoded, err := v4.encodeMap(reflect.ValueOf(map[string]int(nil)))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xc0}, encoded)
+	dec, err := v4.decodeMap(encoded[0], bytes.NewReader(encoded[1:]))
+	require.NoError(t, err)
+	assert.Nil(t, dec)
+
+	encoded, err = defaultCodec.encodeMap(reflect.ValueOf(map[string]int{}))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xc0}, encoded)
+
+	encoded, err = v4.encodeMap(reflect.ValueOf(map[string]int{}))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xd0}, encoded)
+	dec, err = v4.decodeMap(encoded[0], bytes.NewReader(encoded[1:]))
+	require.NoError(t, err)
+	require.NotNil(t, dec)
+	assert.Empty(t, dec.Keys)
+}
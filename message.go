@@ -0,0 +1,347 @@
+package yarp
+
+import (
+	"bytes"
+	"reflect"
+)
+
+// Equal indicates whether two messages are equal according to their schema.
+// Messages are equal in case they have the same type, and all their indexed
+// fields and UnknownFields are equal. Fields without an index tag, such as
+// oneof Has* flags, are not considered.
+// Nil and empty slices and maps are considered equal, as well as a nil
+// *Structure and one without UnknownFields. Nil pointers are only equal to
+// other nil pointers, since they indicate absent values. Two nil messages are
+// considered equal.
+func Equal(a, b StructValuer) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Type() != vb.Type() {
+		return false
+	}
+	return equalValues(va, vb)
+}
+
+func equalValues(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Pointer:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		switch a.Type() {
+		case reflectedMapValue:
+			return equalMapValues(a.Interface().(*MapValue), b.Interface().(*MapValue))
+		case reflectedOneOfValue:
+			ao, bo := a.Interface().(*OneOfValue), b.Interface().(*OneOfValue)
+			return ao.Index == bo.Index && equalValues(a.Elem().Field(1), b.Elem().Field(1))
+		}
+		return equalValues(a.Elem(), b.Elem())
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		if a.Elem().Type() != b.Elem().Type() {
+			return false
+		}
+		return equalValues(a.Elem(), b.Elem())
+	case reflect.Slice:
+		if a.Type() == reflectedRawMessage {
+			return bytes.Equal(a.Bytes(), b.Bytes())
+		}
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !equalValues(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		iter := a.MapRange()
+		for iter.Next() {
+			bv := b.MapIndex(iter.Key())
+			if !bv.IsValid() || !equalValues(iter.Value(), bv) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		if canEncodeStruct(a.Type()) {
+			return equalStructs(a, b)
+		}
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	default:
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	}
+}
+
+func equalStructs(a, b reflect.Value) bool {
+	fields, err := validateAndExtractStruct(a.Type())
+	if err != nil {
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	}
+	for _, f := range fields {
+		if !f.OneOf {
+			if !equalValues(a.FieldByIndex(f.Field.Index), b.FieldByIndex(f.Field.Index)) {
+				return false
+			}
+			continue
+		}
+		for _, m := range f.OneOfIndexes {
+			if !equalValues(a.FieldByIndex(m.Index), b.FieldByIndex(m.Index)) {
+				return false
+			}
+		}
+	}
+	ua, ub := unknownFieldsOf(a), unknownFieldsOf(b)
+	if len(ua) != len(ub) {
+		return false
+	}
+	for i := range ua {
+		if !equalUnknownFields(ua[i], ub[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalMapValues compares maps decoded into UnknownFields like equalValues
+// compares Go maps, regardless of the order in which their entries were
+// present in the stream.
+func equalMapValues(a, b *MapValue) bool {
+	if len(a.Keys) != len(b.Keys) || len(a.Values) != len(b.Values) {
+		return false
+	}
+	for i := range a.Keys {
+		j := indexOfMapKey(b, a.Keys[i])
+		if j < 0 || i >= len(a.Values) || j >= len(b.Values) ||
+			!equalValues(reflect.ValueOf(&a.Values[i]).Elem(), reflect.ValueOf(&b.Values[j]).Elem()) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexOfMapKey returns the position of key within m's keys, or -1 in case it
+// is absent.
+func indexOfMapKey(m *MapValue, key interface{}) int {
+	k := reflect.ValueOf(&key).Elem()
+	for i := range m.Keys {
+		if equalValues(k, reflect.ValueOf(&m.Keys[i]).Elem()) {
+			return i
+		}
+	}
+	return -1
+}
+
+// equalUnknownFields indicates whether two UnknownFields are equal. Decoded
+// maps are compared regardless of the order of their entries.
+func equalUnknownFields(a, b UnknownField) bool {
+	return a.Index == b.Index && a.Type == b.Type &&
+		equalValues(reflect.ValueOf(&a.Data).Elem(), reflect.ValueOf(&b.Data).Elem())
+}
+
+func unknownFieldsOf(v reflect.Value) []UnknownField {
+	s := v.FieldByName("Structure")
+	if !s.IsValid() || s.IsNil() {
+		return nil
+	}
+	return s.Interface().(*Structure).UnknownFields
+}
+
+// Clone returns a deep copy of a given message, including its Structure and
+// UnknownFields. The returned value has the same type as v.
+func Clone(v StructValuer) StructValuer {
+	if v == nil {
+		return nil
+	}
+	return cloneValue(reflect.ValueOf(v)).Interface().(StructValuer)
+}
+
+func cloneValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		n := reflect.New(v.Type().Elem())
+		n.Elem().Set(cloneValue(v.Elem()))
+		return n
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		n := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			n.Index(i).Set(cloneValue(v.Index(i)))
+		}
+		return n
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		n := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			n.SetMapIndex(iter.Key(), cloneValue(iter.Value()))
+		}
+		return n
+	case reflect.Struct:
+		// Copy the struct as a whole, so unexported fields are also kept, and
+		// replace exported ones with their deep copies.
+		n := reflect.New(v.Type()).Elem()
+		n.Set(v)
+		for i := 0; i < n.NumField(); i++ {
+			if f := n.Field(i); f.CanSet() {
+				f.Set(cloneValue(v.Field(i)))
+			}
+		}
+		return n
+	case reflect.Interface:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		n := reflect.New(v.Type()).Elem()
+		n.Set(cloneValue(v.Elem()))
+		return n
+	default:
+		return v
+	}
+}
+
+// Merge merges all set fields from src into dst, which must be a pointer to a
+// message of the same type as src. Fields are merged according to their
+// types:
+//   - Scalars, floats and strings are overwritten in case they are not zero
+//     in src;
+//   - Pointers are overwritten by a copy of src's value in case they are not
+//     nil in src. When both dst and src point to messages, they are merged
+//     recursively instead;
+//   - Messages held by value are merged recursively;
+//   - Slices have a copy of src's items appended to them;
+//   - Maps have a copy of all src's keys set into them, overwriting existing
+//     keys;
+//   - RawMessage values are overwritten in case they are not empty in src;
+//   - OneOf fields are overwritten in case src has a value set, clearing the
+//     value previously set in dst. In case both dst and src have the same
+//     message member set, they are merged recursively;
+//   - UnknownFields from src are appended to dst's.
+//
+// Returns ErrIncompatibleStruct in case dst is not a pointer, or
+// ErrStructTypeMismatch in case src is a different message type.
+func Merge(dst, src StructValuer) error {
+	d := reflect.ValueOf(dst)
+	if d.Kind() != reflect.Pointer || d.IsNil() || d.Elem().Kind() != reflect.Struct {
+		return ErrIncompatibleStruct
+	}
+	if src == nil {
+		return nil
+	}
+	s := reflect.ValueOf(src)
+	if s.Kind() == reflect.Pointer {
+		if s.IsNil() {
+			return nil
+		}
+		s = s.Elem()
+	}
+	if d.Elem().Type() != s.Type() {
+		return ErrStructTypeMismatch
+	}
+	return mergeStruct(d.Elem(), s)
+}
+
+func mergeStruct(dst, src reflect.Value) error {
+	fields, err := validateAndExtractStruct(dst.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.OneOf {
+			if err = mergeOneOf(dst, src, f); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = mergeValue(dst.FieldByIndex(f.Field.Index), src.FieldByIndex(f.Field.Index)); err != nil {
+			return err
+		}
+	}
+
+	if unknown := unknownFieldsOf(src); len(unknown) > 0 {
+		s := dst.FieldByName("Structure")
+		if s.IsNil() {
+			s.Set(reflect.ValueOf(&Structure{}))
+		}
+		structure := s.Interface().(*Structure)
+		clone := cloneValue(reflect.ValueOf(unknown)).Interface().([]UnknownField)
+		structure.UnknownFields = append(structure.UnknownFields, clone...)
+	}
+	return nil
+}
+
+func mergeOneOf(dst, src reflect.Value, f structField) error {
+	for _, m := range f.OneOfIndexes {
+		sv := src.FieldByIndex(m.Index)
+		if sv.IsNil() {
+			continue
+		}
+		dv := dst.FieldByIndex(m.Index)
+		if !dv.IsNil() && canEncodeStruct(dv.Type().Elem()) {
+			return mergeStruct(dv.Elem(), sv.Elem())
+		}
+		clearOneOf(dst, f)
+		dv.Set(cloneValue(sv))
+		if hasF, ok := dst.Type().FieldByName("Has" + m.Name); ok && hasF.Type.Kind() == reflect.Bool {
+			dst.FieldByIndex(hasF.Index).SetBool(true)
+		}
+		return nil
+	}
+	return nil
+}
+
+func mergeValue(dst, src reflect.Value) error {
+	switch {
+	case src.Type() == reflectedRawMessage:
+		if src.Len() > 0 {
+			dst.Set(cloneValue(src))
+		}
+	case src.Kind() == reflect.Slice:
+		if src.Len() > 0 {
+			dst.Set(reflect.AppendSlice(dst, cloneValue(src)))
+		}
+	case src.Kind() == reflect.Map:
+		if src.Len() == 0 {
+			return nil
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMapWithSize(dst.Type(), src.Len()))
+		}
+		iter := src.MapRange()
+		for iter.Next() {
+			dst.SetMapIndex(iter.Key(), cloneValue(iter.Value()))
+		}
+	case src.Kind() == reflect.Pointer:
+		if src.IsNil() {
+			return nil
+		}
+		if !dst.IsNil() && canEncodeStruct(dst.Type().Elem()) {
+			return mergeStruct(dst.Elem(), src.Elem())
+		}
+		dst.Set(cloneValue(src))
+	case src.Kind() == reflect.Struct:
+		return mergeStruct(dst, src)
+	default:
+		if !src.IsZero() {
+			dst.Set(src)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package yarp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func messageFixture() *TS {
+	str := "test"
+	return &TS{
+		Structure: &Structure{
+			UnknownFields: []UnknownField{{Index: 10, Type: String, Data: "extra"}},
+		},
+		ID:          1,
+		Name:        "Vito",
+		Keys:        []string{"a", "b"},
+		Other:       []OtherTS{{Project: "Foo", Role: "Bar"}},
+		AMap:        map[string]int{"a": 1},
+		OneOfA:      &str,
+		HasOneOfA:   true,
+		SingleOther: OtherTS{Project: "Fuz"},
+		OptionalTS:  &OtherTS{Role: "Baz"},
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a, b := messageFixture(), messageFixture()
+	assert.True(t, Equal(a, b))
+
+	b.Keys = append(b.Keys, "c")
+	assert.False(t, Equal(a, b))
+
+	b = messageFixture()
+	b.OptionalTS.Role = "Other"
+	assert.False(t, Equal(a, b))
+
+	b = messageFixture()
+	b.UnknownFields[0].Data = "changed"
+	assert.False(t, Equal(a, b))
+
+	b = messageFixture()
+	b.HasOneOfA = false
+	assert.True(t, Equal(a, b))
+
+	assert.True(t, Equal(&OtherTS{}, &OtherTS{Structure: &Structure{}}))
+	assert.True(t, Equal(&TS{Keys: []string{}, AMap: map[string]int{}}, &TS{}))
+	assert.False(t, Equal(&TS{OptionalTS: &OtherTS{}}, &TS{}))
+	assert.False(t, Equal(&TS{}, TS{}))
+	assert.False(t, Equal(&TS{}, &OtherTS{}))
+	assert.True(t, Equal((*TS)(nil), (*TS)(nil)))
+}
+
+// unknownMap returns a message holding a map as an UnknownField, whose
+// entries are present in the order of the provided keys.
+func unknownMap(keys ...string) *OtherTS {
+	m := &MapValue{}
+	for _, k := range keys {
+		m.Keys = append(m.Keys, k)
+		m.Values = append(m.Values, &MapValue{Keys: []interface{}{int64(1), int64(2)}, Values: []interface{}{k, k}})
+	}
+	return &OtherTS{Structure: &Structure{UnknownFields: []UnknownField{
+		{Index: 2, Type: Map, Data: m},
+		{Index: 3, Type: Array, Data: []interface{}{m}},
+		{Index: 4, Type: OneOf, Data: &OneOfValue{Index: 1, Data: m}},
+	}}}
+}
+
+func TestEqualUnknownMaps(t *testing.T) {
+	assert.True(t, Equal(unknownMap("a", "b", "c"), unknownMap("c", "a", "b")))
+	assert.False(t, Equal(unknownMap("a", "b", "c"), unknownMap("a", "b")))
+	assert.False(t, Equal(unknownMap("a", "b"), unknownMap("a", "c")))
+
+	a, b := unknownMap("a", "b"), unknownMap("b", "a")
+	inner := b.UnknownFields[0].Data.(*MapValue).Values[0].(*MapValue)
+	inner.Keys[0], inner.Keys[1] = inner.Keys[1], inner.Keys[0]
+	assert.True(t, Equal(a, b))
+	inner.Values[0] = "changed"
+	assert.False(t, Equal(a, b))
+}
+
+func TestClone(t *testing.T) {
+	a := messageFixture()
+	c := Clone(a).(*TS)
+	require.True(t, Equal(a, c))
+	assert.True(t, c.HasOneOfA)
+
+	c.Keys[0] = "z"
+	c.Other[0].Project = "z"
+	c.AMap["a"] = 2
+	*c.OneOfA = "z"
+	c.OptionalTS.Role = "z"
+	c.UnknownFields[0].Data = "z"
+	assert.Equal(t, "a", a.Keys[0])
+	assert.Equal(t, "Foo", a.Other[0].Project)
+	assert.Equal(t, 1, a.AMap["a"])
+	assert.Equal(t, "test", *a.OneOfA)
+	assert.Equal(t, "Baz", a.OptionalTS.Role)
+	assert.Equal(t, "extra", a.UnknownFields[0].Data)
+
+	assert.Nil(t, Clone(nil))
+}
+
+func TestMerge(t *testing.T) {
+	dst := messageFixture()
+	b := 2
+	src := &TS{
+		Structure: &Structure{
+			UnknownFields: []UnknownField{{Index: 11, Type: Scalar, Data: uint64(1)}},
+		},
+		Name:        "Other",
+		Keys:        []string{"c"},
+		AMap:        map[string]int{"a": 10, "b": 20},
+		OneOfB:      &b,
+		SingleOther: OtherTS{Role: "Role"},
+		OptionalTS:  &OtherTS{Project: "Project"},
+	}
+	require.NoError(t, Merge(dst, src))
+	assert.Equal(t, 1, dst.ID)
+	assert.Equal(t, "Other", dst.Name)
+	assert.Equal(t, []string{"a", "b", "c"}, dst.Keys)
+	assert.Equal(t, map[string]int{"a": 10, "b": 20}, dst.AMap)
+	assert.Nil(t, dst.OneOfA)
+	assert.False(t, dst.HasOneOfA)
+	require.NotNil(t, dst.OneOfB)
+	assert.Equal(t, 2, *dst.OneOfB)
+	assert.True(t, dst.HasOneOfB)
+	assert.Equal(t, "Fuz", dst.SingleOther.Project)
+	assert.Equal(t, "Role", dst.SingleOther.Role)
+	assert.Equal(t, "Project", dst.OptionalTS.Project)
+	assert.Equal(t, "Baz", dst.OptionalTS.Role)
+	require.Len(t, dst.UnknownFields, 2)
+	assert.Equal(t, 11, dst.UnknownFields[1].Index)
+
+	*src.OneOfB = 3
+	assert.Equal(t, 2, *dst.OneOfB)
+
+	assert.ErrorIs(t, Merge(TS{}, src), ErrIncompatibleStruct)
+	assert.ErrorIs(t, Merge(dst, &OtherTS{}), ErrStructTypeMismatch)
+}
@@ -0,0 +1,551 @@
+package yarp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// magicMux begins the handshake of a multiplexed connection. Clients send it
+// followed by the version of the multiplexing protocol they implement, and
+// servers reply with the same sequence in case they accept it, or with a
+// version of zero otherwise, closing the connection.
+var magicMux = []byte{0x79, 0x79, 0x6d}
+
+const (
+	muxVersion = 1
+
+	// muxFrameHeaderSize is the size of frame headers, comprised of the
+	// frame's type, its stream ID as a 32-bit little-endian integer, and a
+	// 32-bit little-endian value, which is the size of the payload for data
+	// frames.
+	muxFrameHeaderSize = 9
+
+	// muxMaxFrameSize is the maximum size of the payload of a single data
+	// frame.
+	muxMaxFrameSize = 16 << 10
+
+	// muxWindowSize is the amount of bytes a peer may send through a stream
+	// before the receiving side acknowledges them through a window frame.
+	muxWindowSize = 256 << 10
+)
+
+type muxFrameType byte
+
+const (
+	// muxFrameData carries bytes of a stream. Streams are opened by clients
+	// by sending their first data frame.
+	muxFrameData muxFrameType = iota
+
+	// muxFrameClose indicates that the sender will neither read from nor
+	// write to a stream anymore. Servers refuse streams by closing them
+	// before sending any data.
+	muxFrameClose
+
+	// muxFrameWindow allows the receiver to send more bytes through a stream.
+	muxFrameWindow
+
+	// muxFrameGoAway indicates that the server will not accept streams with
+	// IDs greater than the frame's value, and will close the connection
+	// once current streams are finished.
+	muxFrameGoAway
+)
+
+// muxConn multiplexes streams over a single connection. Each stream behaves
+// like a dedicated connection, and carries a single request along with its
+// response, exactly as in the one-shot protocol. Clients open streams using
+// odd, increasing IDs.
+type muxConn struct {
+	conn   io.ReadWriteCloser
+	client bool
+	accept func(s *muxStream)
+
+	// maxStreams limits how many streams a server accepts concurrently.
+	// Zero means no limit.
+	maxStreams int
+
+	// idleTimeout determines how long the connection is kept open without
+	// streams. Zero means no timeout.
+	idleTimeout time.Duration
+	idle        *time.Timer
+
+	wmu sync.Mutex
+
+	mu        sync.Mutex
+	streams   map[uint32]*muxStream
+	lastID    uint32
+	goingAway bool
+	err       error
+}
+
+func newMuxConn(conn io.ReadWriteCloser, client bool, accept func(s *muxStream)) *muxConn {
+	return &muxConn{
+		conn:    conn,
+		client:  client,
+		accept:  accept,
+		streams: map[uint32]*muxStream{},
+	}
+}
+
+// dialMux performs the client side of the handshake over conn. Returns
+// errMuxUnsupported in case the server does not accept multiplexed
+// connections. The connection is closed once it has no streams for
+// idleTimeout, if non-zero.
+func dialMux(ctx context.Context, conn net.Conn, idleTimeout time.Duration) (*muxConn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	hello := append(append([]byte{}, magicMux...), muxVersion)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, len(hello))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		// Servers unaware of multiplexing drop the connection.
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errMuxUnsupported
+		}
+		return nil, err
+	}
+	if !bytes.Equal(reply, hello) {
+		return nil, errMuxUnsupported
+	}
+	m := newMuxConn(conn, true, nil)
+	m.idleTimeout = idleTimeout
+	go m.run()
+	return m, nil
+}
+
+// acceptMux performs the server side of the handshake over conn, after the
+// client's hello was read.
+func acceptMux(conn io.ReadWriteCloser, version byte, allowed bool, accept func(s *muxStream)) (*muxConn, error) {
+	reply := append(append([]byte{}, magicMux...), muxVersion)
+	if !allowed || version != muxVersion {
+		reply[len(reply)-1] = 0
+		_, _ = conn.Write(reply)
+		return nil, errMuxUnsupported
+	}
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+	return newMuxConn(conn, false, accept), nil
+}
+
+// run reads frames until the connection is closed.
+func (m *muxConn) run() {
+	m.mu.Lock()
+	m.armIdle()
+	m.mu.Unlock()
+	head := make([]byte, muxFrameHeaderSize)
+	for {
+		if _, err := io.ReadFull(m.conn, head); err != nil {
+			m.fail(unexpectedEOF(err))
+			return
+		}
+		t := muxFrameType(head[0])
+		id := binary.LittleEndian.Uint32(head[1:])
+		value := binary.LittleEndian.Uint32(head[5:])
+		var err error
+		switch t {
+		case muxFrameData:
+			if value > muxMaxFrameSize {
+				err = ErrCorruptStream
+				break
+			}
+			payload := make([]byte, value)
+			if _, err = io.ReadFull(m.conn, payload); err != nil {
+				err = unexpectedEOF(err)
+				break
+			}
+			err = m.deliver(id, payload)
+		case muxFrameClose:
+			if s := m.stream(id); s != nil {
+				s.remoteClose(m.client)
+			}
+		case muxFrameWindow:
+			if s := m.stream(id); s != nil {
+				s.grow(int(value))
+			}
+		case muxFrameGoAway:
+			if !m.client {
+				err = ErrCorruptStream
+				break
+			}
+			m.goAwayReceived(value)
+		default:
+			err = ErrCorruptStream
+		}
+		if err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func (m *muxConn) stream(id uint32) *muxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+// deliver hands a data frame to its stream. On servers, frames for unknown
+// streams with IDs greater than any seen so far open new streams, which are
+// refused in case the connection is going away, or maxStreams is reached.
+func (m *muxConn) deliver(id uint32, payload []byte) error {
+	m.mu.Lock()
+	s, ok := m.streams[id]
+	if !ok {
+		if m.client || id <= m.lastID || id%2 == 0 {
+			// Data for a stream closed by this side.
+			m.mu.Unlock()
+			return nil
+		}
+		m.lastID = id
+		if m.goingAway || m.maxStreams > 0 && len(m.streams) >= m.maxStreams {
+			m.mu.Unlock()
+			return m.writeFrame(muxFrameClose, id, 0, nil)
+		}
+		s = newMuxStream(m, id)
+		m.streams[id] = s
+		m.stopIdle()
+		m.mu.Unlock()
+		m.accept(s)
+	} else {
+		m.mu.Unlock()
+	}
+	return s.receive(payload)
+}
+
+// open opens a new stream on a client connection. Streams are announced
+// through an empty data frame as soon as they are opened, since servers
+// consider streams with IDs lower than the last one seen to be closed.
+func (m *muxConn) open() (*muxStream, error) {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	m.mu.Lock()
+	if m.err != nil || m.goingAway || m.lastID >= 1<<31 {
+		m.mu.Unlock()
+		return nil, errStreamRefused
+	}
+	id := m.lastID + 1
+	if m.lastID != 0 {
+		id = m.lastID + 2
+	}
+	m.lastID = id
+	s := newMuxStream(m, id)
+	m.streams[id] = s
+	m.stopIdle()
+	m.mu.Unlock()
+	if err := m.writeFrameLocked(muxFrameData, id, 0, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// usable indicates whether new streams may be opened on m.
+func (m *muxConn) usable() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err == nil && !m.goingAway && m.lastID < 1<<31
+}
+
+// release removes a stream closed by this side, closing the connection in
+// case it is going away and no streams remain.
+func (m *muxConn) release(s *muxStream) {
+	m.mu.Lock()
+	delete(m.streams, s.id)
+	drained := m.goingAway && len(m.streams) == 0
+	if len(m.streams) == 0 {
+		m.armIdle()
+	}
+	m.mu.Unlock()
+	if drained {
+		m.close()
+	}
+}
+
+// armIdle starts the idle timer of a connection without streams. Must be
+// called with m.mu held.
+func (m *muxConn) armIdle() {
+	if m.idleTimeout <= 0 || m.err != nil || m.goingAway {
+		return
+	}
+	m.stopIdle()
+	m.idle = time.AfterFunc(m.idleTimeout, m.closeIdle)
+}
+
+// stopIdle stops the idle timer, if any. Must be called with m.mu held.
+func (m *muxConn) stopIdle() {
+	if m.idle != nil {
+		m.idle.Stop()
+		m.idle = nil
+	}
+}
+
+// closeIdle closes a connection which remained without streams for its idle
+// timeout. Servers go away, so that streams opened concurrently are refused
+// and retried by clients, while clients stop opening streams before closing.
+func (m *muxConn) closeIdle() {
+	m.mu.Lock()
+	if len(m.streams) > 0 || m.err != nil || m.goingAway {
+		m.mu.Unlock()
+		return
+	}
+	if !m.client {
+		m.mu.Unlock()
+		m.goAway()
+		return
+	}
+	m.goingAway = true
+	m.mu.Unlock()
+	m.close()
+}
+
+// goAway stops a server connection from accepting new streams, and closes it
+// once current streams are finished.
+func (m *muxConn) goAway() {
+	m.mu.Lock()
+	if m.goingAway || m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.goingAway = true
+	last := m.lastID
+	drained := len(m.streams) == 0
+	m.mu.Unlock()
+	_ = m.writeFrame(muxFrameGoAway, 0, last, nil)
+	if drained {
+		m.close()
+	}
+}
+
+// goAwayReceived prevents new streams from being opened on a client
+// connection, and refuses streams the server will not accept.
+func (m *muxConn) goAwayReceived(last uint32) {
+	m.mu.Lock()
+	m.goingAway = true
+	var refused []*muxStream
+	for id, s := range m.streams {
+		if id > last {
+			refused = append(refused, s)
+		}
+	}
+	drained := len(m.streams) == len(refused)
+	m.mu.Unlock()
+	for _, s := range refused {
+		s.fail(errStreamRefused)
+	}
+	if drained {
+		m.close()
+	}
+}
+
+func (m *muxConn) writeFrame(t muxFrameType, id, value uint32, payload []byte) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return m.writeFrameLocked(t, id, value, payload)
+}
+
+// writeFrameLocked writes a frame to the connection. Must be called with m.wmu
+// held.
+func (m *muxConn) writeFrameLocked(t muxFrameType, id, value uint32, payload []byte) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var head [muxFrameHeaderSize]byte
+	head[0] = byte(t)
+	binary.LittleEndian.PutUint32(head[1:], id)
+	binary.LittleEndian.PutUint32(head[5:], value)
+	data := append(append((*buf)[:0], head[:]...), payload...)
+	*buf = data
+
+	m.mu.Lock()
+	err := m.err
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, err = m.conn.Write(data); err != nil {
+		m.fail(err)
+	}
+	return err
+}
+
+func (m *muxConn) close() {
+	m.fail(io.ErrClosedPipe)
+}
+
+// fail closes the connection, failing all its streams with err.
+func (m *muxConn) fail(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = map[uint32]*muxStream{}
+	m.stopIdle()
+	m.mu.Unlock()
+	_ = m.conn.Close()
+	for _, s := range streams {
+		s.fail(io.ErrUnexpectedEOF)
+	}
+}
+
+// muxStream represents a stream of a multiplexed connection, and behaves like
+// a dedicated connection.
+type muxStream struct {
+	m  *muxConn
+	id uint32
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	buf          []byte
+	received     bool
+	unacked      int
+	window       int
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newMuxStream(m *muxConn, id uint32) *muxStream {
+	s := &muxStream{m: m, id: id, window: muxWindowSize}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.buf) == 0 && !s.remoteClosed && !s.localClosed && s.err == nil {
+		s.cond.Wait()
+	}
+	switch {
+	case s.localClosed:
+		s.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	case len(s.buf) > 0:
+	case s.err != nil:
+		s.mu.Unlock()
+		return 0, s.err
+	default:
+		s.mu.Unlock()
+		return 0, io.EOF
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	s.unacked += n
+	ack := 0
+	if s.unacked >= muxWindowSize/4 && !s.remoteClosed {
+		ack, s.unacked = s.unacked, 0
+	}
+	s.mu.Unlock()
+	if ack > 0 {
+		_ = s.m.writeFrame(muxFrameWindow, s.id, uint32(ack), nil)
+	}
+	return n, nil
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.window == 0 && !s.remoteClosed && !s.localClosed && s.err == nil {
+			s.cond.Wait()
+		}
+		switch {
+		case s.err != nil:
+			s.mu.Unlock()
+			return written, s.err
+		case s.remoteClosed || s.localClosed:
+			s.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := len(p)
+		if n > s.window {
+			n = s.window
+		}
+		if n > muxMaxFrameSize {
+			n = muxMaxFrameSize
+		}
+		s.window -= n
+		s.mu.Unlock()
+
+		if err := s.m.writeFrame(muxFrameData, s.id, uint32(n), p[:n]); err != nil {
+			return written, err
+		}
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close closes the stream, notifying the peer.
+func (s *muxStream) Close() error {
+	s.mu.Lock()
+	if s.localClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	failed := s.err != nil
+	s.buf = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	var err error
+	if !failed {
+		err = s.m.writeFrame(muxFrameClose, s.id, 0, nil)
+	}
+	s.m.release(s)
+	return err
+}
+
+func (s *muxStream) receive(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.localClosed {
+		return nil
+	}
+	if len(s.buf)+s.unacked+len(payload) > muxWindowSize {
+		return ErrCorruptStream
+	}
+	s.buf = append(s.buf, payload...)
+	s.received = true
+	s.cond.Broadcast()
+	return nil
+}
+
+// remoteClose handles a stream closed by the peer. Since servers always reply
+// to requests, client streams closed before receiving any data were refused.
+func (s *muxStream) remoteClose(client bool) {
+	s.mu.Lock()
+	if client && !s.received && s.err == nil {
+		s.err = errStreamRefused
+	}
+	s.remoteClosed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *muxStream) grow(n int) {
+	s.mu.Lock()
+	s.window += n
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *muxStream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
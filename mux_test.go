@@ -0,0 +1,251 @@
+package yarp
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+func (l *countingListener) count() int {
+	return int(atomic.LoadInt32(&l.accepted))
+}
+
+// startMuxServer starts a Server exposing an echo method (0x1) for Upload
+// values, and a method streaming SimpleResponse values (0x2), whose amount is
+// determined by the request's Name. register may add further handlers.
+func startMuxServer(t *testing.T, register func(s *Server), opts ...Option) (*Server, *countingListener) {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+	RegisterStructType(Upload{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	cl := &countingListener{Listener: l}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	s := NewServer(l.Addr().String(), opts...)
+	s.RegisterHandler(0x1, "io.vito.Mux.echo", func(ctx context.Context, headers Header, req *Upload) (Header, *Upload, error) {
+		read, err := io.ReadAll(req.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &Upload{Name: req.Name, Data: NewBlobBytes(read)}, nil
+	})
+	s.RegisterHandler(0x2, "io.vito.Mux.count", func(ctx context.Context, headers Header, req *SimpleRequest, out *SimpleResponseStreamer) error {
+		n, err := strconv.Atoi(req.Name)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			out.Push(&SimpleResponse{ID: int32(i)})
+		}
+		return nil
+	})
+	if register != nil {
+		register(s)
+	}
+	go func() {
+		_ = s.StartListener(cl)
+	}()
+	return s, cl
+}
+
+func TestMultiplexing(t *testing.T) {
+	_, l := startMuxServer(t, nil, WithMultiplexing())
+	c := NewClient(l.Addr().String(), WithMultiplexing())
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+
+	// Larger than a stream's window
+	data := blobFixture(muxWindowSize*2 + 3)
+	wg := sync.WaitGroup{}
+	for i := 1; i <= 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			name := strconv.Itoa(i)
+			res, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &Upload{Name: name, Data: NewBlobBytes(data)})
+			if !assert.NoError(t, err) {
+				return
+			}
+			u := res.(*Upload)
+			assert.Equal(t, name, u.Name)
+			read, err := io.ReadAll(u.Data)
+			assert.NoError(t, err)
+			assert.Equal(t, data, read)
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			ch, _, err := c.DoRequestStreamed(context.Background(), Request{Method: 0x2}, &SimpleRequest{Name: strconv.Itoa(i)})
+			if !assert.NoError(t, err) {
+				return
+			}
+			count := 0
+			for v := range ch {
+				assert.Equal(t, int32(count), v.(*SimpleResponse).ID)
+				count++
+			}
+			assert.Equal(t, i, count)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, l.count())
+
+	t.Run("reconnects after close", func(t *testing.T) {
+		require.NoError(t, c.Close())
+		res, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &Upload{Name: "a", Data: NewBlobBytes(nil)})
+		require.NoError(t, err)
+		assert.Equal(t, "a", res.(*Upload).Name)
+		assert.Equal(t, 2, l.count())
+	})
+}
+
+func TestMultiplexingFallback(t *testing.T) {
+	_, l := startMuxServer(t, nil)
+	c := NewClient(l.Addr().String(), WithMultiplexing())
+	for i := 0; i < 3; i++ {
+		res, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &Upload{Name: "a", Data: NewBlobBytes(nil)})
+		require.NoError(t, err)
+		assert.Equal(t, "a", res.(*Upload).Name)
+	}
+	assert.False(t, c.multiplexing)
+	// One refused handshake, followed by one connection per request
+	assert.Equal(t, 4, l.count())
+}
+
+func TestMultiplexingShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s, l := startMuxServer(t, func(s *Server) {
+		s.RegisterHandler(0x3, "io.vito.Mux.wait", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+			close(started)
+			<-release
+			return nil, &SimpleResponse{ID: 1}, nil
+		})
+	}, WithMultiplexing())
+	c := NewClient(l.Addr().String(), WithMultiplexing())
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, _, err := c.DoRequest(context.Background(), Request{Method: 0x3}, &SimpleRequest{})
+		if assert.NoError(t, err) {
+			assert.Equal(t, int32(1), res.(*SimpleResponse).ID)
+		}
+	}()
+	<-started
+	c.muxMu.Lock()
+	m := c.mux
+	c.muxMu.Unlock()
+
+	// Shutdown waits for the listener to stop accepting connections.
+	require.NoError(t, l.Close())
+	shut := make(chan struct{})
+	go func() {
+		defer close(shut)
+		s.Shutdown(context.Background())
+	}()
+	require.Eventually(t, func() bool {
+		return !m.usable()
+	}, time.Second, 5*time.Millisecond)
+
+	close(release)
+	<-done
+	select {
+	case <-shut:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+}
+
+func TestMultiplexingMaxStreams(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	_, l := startMuxServer(t, func(s *Server) {
+		s.RegisterHandler(0x3, "io.vito.Mux.wait", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+			close(started)
+			<-release
+			return nil, &SimpleResponse{ID: 1}, nil
+		})
+	}, WithMultiplexing(), WithMaxConcurrentStreams(1))
+	c := NewClient(l.Addr().String(), WithMultiplexing())
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, _, err := c.DoRequest(context.Background(), Request{Method: 0x3}, &SimpleRequest{})
+		if assert.NoError(t, err) {
+			assert.Equal(t, int32(1), res.(*SimpleResponse).ID)
+		}
+	}()
+	<-started
+
+	_, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &Upload{Name: "a", Data: NewBlobBytes(nil)})
+	assert.ErrorIs(t, err, errStreamRefused)
+
+	close(release)
+	<-done
+	res, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &Upload{Name: "a", Data: NewBlobBytes(nil)})
+	require.NoError(t, err)
+	assert.Equal(t, "a", res.(*Upload).Name)
+	assert.Equal(t, 1, l.count())
+}
+
+func TestMultiplexingIdleTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		server, client []Option
+	}{
+		{"server", []Option{WithMultiplexing(), WithIdleTimeout(20 * time.Millisecond)}, []Option{WithMultiplexing()}},
+		{"client", []Option{WithMultiplexing()}, []Option{WithMultiplexing(), WithIdleTimeout(20 * time.Millisecond)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, l := startMuxServer(t, nil, tc.server...)
+			c := NewClient(l.Addr().String(), tc.client...)
+			t.Cleanup(func() {
+				_ = c.Close()
+			})
+
+			res, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &Upload{Name: "a", Data: NewBlobBytes(nil)})
+			require.NoError(t, err)
+			assert.Equal(t, "a", res.(*Upload).Name)
+			c.muxMu.Lock()
+			m := c.mux
+			c.muxMu.Unlock()
+			require.Eventually(t, func() bool {
+				return !m.usable()
+			}, time.Second, 5*time.Millisecond)
+
+			res, _, err = c.DoRequest(context.Background(), Request{Method: 0x1}, &Upload{Name: "b", Data: NewBlobBytes(nil)})
+			require.NoError(t, err)
+			assert.Equal(t, "b", res.(*Upload).Name)
+			assert.Equal(t, 2, l.count())
+		})
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -17,8 +19,22 @@ type netDialer interface {
 type Option func(c *options)
 
 type options struct {
-	timeout   time.Duration
-	tlsConfig *tls.Config
+	timeout        time.Duration
+	tlsConfig      *tls.Config
+	wireVersion    WireVersion
+	multiplexing   bool
+	maxStreams     int
+	idleTimeout    time.Duration
+	handlerTimeout time.Duration
+
+	errorHandler    ErrorHandler
+	developmentMode bool
+
+	logger               Logger
+	slowRequestThreshold time.Duration
+
+	clientInterceptors       []ClientInterceptor
+	clientStreamInterceptors []ClientStreamInterceptor
 }
 
 // WithTimeout determines a timeout value for a given Client or Server, and has
@@ -41,12 +57,142 @@ func WithTLS(config *tls.Config) Option {
 	}
 }
 
+// WithWireVersion determines which wire version is used by a given Client or
+// Server, and has different meanings depending on where it is used:
+// For Server, indicates the highest wire version the server may use to encode
+// responses. Servers always accept requests using any supported version, and
+// reply using the version announced by the client, capped by this value.
+// Defaults to LatestWireVersion.
+// For Client, indicates the version used to encode requests, which is also
+// announced to the server. Since older servers are unable to decode newer
+// versions, this value defaults to WireVersion1.
+func WithWireVersion(v WireVersion) Option {
+	return func(c *options) {
+		c.wireVersion = v
+	}
+}
+
+// WithMultiplexing enables long-lived connections shared by concurrent
+// requests, and has different meanings depending on where it is used:
+// For Server, allows clients to establish multiplexed connections. Servers
+// always accept one-shot connections, and refuse multiplexed ones unless this
+// option is provided.
+// For Client, requests are performed through streams of a single multiplexed
+// connection, which is established on the first request and kept open until
+// Close is called, or the server goes away. In case the server refuses the
+// connection, the Client falls back to one connection per request.
+func WithMultiplexing() Option {
+	return func(c *options) {
+		c.multiplexing = true
+	}
+}
+
+// WithMaxConcurrentStreams determines how many streams a Server accepts
+// concurrently on each multiplexed connection. Streams exceeding the limit
+// are refused, and retried by clients. Zero values, the default, impose no
+// limit. This option has no effect on Clients.
+func WithMaxConcurrentStreams(n int) Option {
+	return func(c *options) {
+		c.maxStreams = n
+	}
+}
+
+// WithIdleTimeout determines how long multiplexed connections are kept open
+// without streams. Servers go away from idle connections, while Clients close
+// them, establishing a new one on their next request. Zero values, the
+// default, keep idle connections open. See WithMultiplexing.
+func WithIdleTimeout(t time.Duration) Option {
+	return func(c *options) {
+		c.idleTimeout = t
+	}
+}
+
+// WithHandlerTimeout determines the maximum duration of handlers executed by a
+// Server. Contexts provided to handlers are done once either this duration, or
+// the deadline provided by the client elapses, whichever comes first. Handlers
+// exceeding their deadline cause the client to receive an Error with
+// ErrorKindDeadlineExceeded. Timeouts of specific methods may be determined
+// through Server.SetMethodTimeout. This option has no effect on Clients.
+func WithHandlerTimeout(t time.Duration) Option {
+	return func(c *options) {
+		c.handlerTimeout = t
+	}
+}
+
+// WithErrorHandler registers a given ErrorHandler to receive reports of
+// internal errors and panics that occur while a Server processes requests.
+// Errors returned as Error values are reported to clients as-is, and are not
+// provided to the ErrorHandler. This option has no effect on Clients.
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(c *options) {
+		c.errorHandler = h
+	}
+}
+
+// WithDevelopmentMode causes a Server to provide clients with a description of
+// internal errors and panics, through the UserData of their Error under
+// ErrorDescriptionKey. Since descriptions may expose implementation details,
+// this option should not be used in production. This option has no effect on
+// Clients.
+func WithDevelopmentMode() Option {
+	return func(c *options) {
+		c.developmentMode = true
+	}
+}
+
+// WithLogger determines the Logger used by a given Client or Server to report
+// their activity. Most entries are logged at the debug level, while failures
+// and slow requests are logged at the warn level. Internal errors and panics
+// of Servers are logged at the error level. By default, nothing is logged.
+func WithLogger(l Logger) Option {
+	return func(c *options) {
+		c.logger = l
+	}
+}
+
+// WithSlowRequestThreshold determines the duration after which requests are
+// logged as slow, and has different meanings depending on where it is used:
+// For Server, indicates the time since a request's connection or stream was
+// accepted, until its response is fully written.
+// For Client, indicates the time since a request started, until its response
+// is fully read, including all values of streamed responses.
+// Zero values, the default, disable slow request logging.
+func WithSlowRequestThreshold(t time.Duration) Option {
+	return func(c *options) {
+		c.slowRequestThreshold = t
+	}
+}
+
+// WithClientInterceptor registers a given ClientInterceptor to wrap requests
+// of unary methods performed by a Client, through DoRequest and
+// DoRequestWithTrailer. Interceptors are invoked in the order they are
+// provided, the first one being the outermost. This option has no effect on
+// Servers.
+func WithClientInterceptor(i ClientInterceptor) Option {
+	return func(c *options) {
+		c.clientInterceptors = append(c.clientInterceptors, i)
+	}
+}
+
+// WithClientStreamInterceptor registers a given ClientStreamInterceptor to
+// wrap requests of server-streaming methods performed by a Client, through
+// DoRequestStreamed and DoRequestStreamedWithStatus. Interceptors are invoked
+// in the order they are provided, the first one being the outermost. This
+// option has no effect on Servers.
+func WithClientStreamInterceptor(i ClientStreamInterceptor) Option {
+	return func(c *options) {
+		c.clientStreamInterceptors = append(c.clientStreamInterceptors, i)
+	}
+}
+
+// bufferedConn represents either a dedicated connection, or a stream of a
+// multiplexed one, along with a read buffer.
 type bufferedConn struct {
 	buf *bufio.Reader
-	net.Conn
+	io.ReadWriteCloser
 }
 
-func newBufferedConn(c net.Conn) bufferedConn {
+func newBufferedConn(c io.ReadWriteCloser) bufferedConn {
 	return bufferedConn{bufio.NewReader(c), c}
 }
 
@@ -54,6 +200,35 @@ func (b bufferedConn) Peek(n int) ([]byte, error) {
 	return b.buf.Peek(n)
 }
 
+func (b bufferedConn) Discard(n int) (int, error) {
+	return b.buf.Discard(n)
+}
+
 func (b bufferedConn) Read(p []byte) (int, error) {
 	return b.buf.Read(p)
 }
+
+// maxPooledBufferSize prevents buffers grown by unusually large messages from
+// being retained by bufferPool.
+const maxPooledBufferSize = 64 << 10
+
+// bufferPool holds buffers used by Client and Server to encode outgoing
+// values.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBufferSize {
+		return
+	}
+	*b = (*b)[:0]
+	bufferPool.Put(b)
+}
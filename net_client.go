@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
-	"fmt"
 	"io"
 	"net"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
 func NewClient(address string, opts ...Option) *Client {
@@ -29,9 +31,22 @@ func NewClient(address string, opts ...Option) *Client {
 		}
 	}
 	c := &Client{
-		address: address,
-		dialer:  dialer,
-		network: "tcp",
+		address:      address,
+		dialer:       dialer,
+		network:      "tcp",
+		codec:        defaultCodec,
+		multiplexing: o.multiplexing,
+		idleTimeout:  o.idleTimeout,
+	}
+	c.interceptors = o.clientInterceptors
+	c.streamInterceptors = o.clientStreamInterceptors
+	c.log = nopLogger{}
+	if o.logger != nil {
+		c.log = o.logger
+	}
+	c.slowThreshold = o.slowRequestThreshold
+	if o.wireVersion != 0 {
+		c.codec = newCodec(o.wireVersion)
 	}
 	if strings.HasPrefix(address, "unix://") {
 		c.network = "unix"
@@ -44,88 +59,356 @@ type Client struct {
 	address string
 	dialer  netDialer
 	network string
+	codec   codec
+
+	multiplexing bool
+	idleTimeout  time.Duration
+	muxMu        sync.Mutex
+	mux          *muxConn
+
+	interceptors       []ClientInterceptor
+	streamInterceptors []ClientStreamInterceptor
+
+	log           Logger
+	slowThreshold time.Duration
 }
 
-func (c *Client) performRequest(ctx context.Context, request Request, v interface{}) (*Response, *bufferedConn, error) {
-	data, err := request.Encode()
+// connect returns a connection able to carry a single request, which is
+// either a new connection, or a new stream of the Client's multiplexed
+// connection.
+func (c *Client) connect(ctx context.Context) (io.ReadWriteCloser, error) {
+	s, err := c.openStream(ctx)
+	switch err {
+	case nil:
+		return s, nil
+	case errMuxUnsupported:
+		return c.dial(ctx)
+	default:
+		return nil, err
+	}
+}
+
+// dial establishes a new connection to the Client's address, logging when it
+// is opened and closed.
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := c.dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	c.log.Debug("connection opened", "peer", c.address)
+	return newLoggedConn(conn, c.log, c.address), nil
+}
+
+func (c *Client) openStream(ctx context.Context) (*muxStream, error) {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	if !c.multiplexing {
+		return nil, errMuxUnsupported
+	}
+	if c.mux == nil || !c.mux.usable() {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		m, err := dialMux(ctx, conn, c.idleTimeout)
+		if err != nil {
+			conn.Close()
+			if err == errMuxUnsupported {
+				// Avoid attempting it again on every request.
+				c.multiplexing = false
+			}
+			return nil, err
+		}
+		c.mux = m
+	}
+	return c.mux.open()
+}
+
+// Close closes the multiplexed connection held by the Client, if any,
+// interrupting requests being performed through it. Clients remain usable
+// after being closed, and establish a new connection when required.
+func (c *Client) Close() error {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	if c.mux != nil {
+		c.mux.close()
+		c.mux = nil
+	}
+	return nil
+}
+
+// requestHeaders returns the headers of a request performed with a given ctx,
+// including reserved headers. Returns ctx's error in case it is already done.
+func (c *Client) requestHeaders(ctx context.Context, headers map[string]string) (map[string]string, error) {
+	deadline, err := formatDeadline(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h := Header(headers).Clone()
+	h.Set(trailersHeader, "1")
+	if c.codec.version > WireVersion1 {
+		h.Set(wireVersionHeader, c.codec.version.String())
+	}
+	if deadline != "" {
+		h.Set(deadlineHeader, deadline)
+	}
+	return h, nil
+}
+
+// performRequest sends a request, and reads its response header. Bytes
+// transferred through its connection are counted by counted.
+func (c *Client) performRequest(ctx context.Context, request Request, v interface{}, counted *countingConn) (*Response, *bufferedConn, error) {
+	var err error
+	if request.Headers, err = c.requestHeaders(ctx, request.Headers); err != nil {
+		return nil, nil, err
+	}
+	dataBuf := getBuffer()
+	defer putBuffer(dataBuf)
+	data, err := request.appendEncode((*dataBuf)[:0])
 	if err != nil {
 		return nil, nil, err
 	}
-	encodedValue, err := Encode(v)
+	enc := c.codec.streaming()
+	data, err = enc.appendEncodeInterface(data, v)
 	if err != nil {
 		return nil, nil, err
 	}
-	data = append(data, encodedValue...)
+	*dataBuf = data
 
-	conn, err := c.dialer.DialContext(ctx, c.network, c.address)
+	for attempt := 1; ; attempt++ {
+		res, buf, err := c.exchange(ctx, data, enc, v, counted)
+		// Streams refused by a server going away were not processed, and
+		// can be retried through a new connection, unless a streamed Blob
+		// was already consumed.
+		if err == errStreamRefused && attempt < maxStreamAttempts && (v == nil || topLevelBlob(reflect.ValueOf(v)) == nil) {
+			continue
+		}
+		return res, buf, contextError(ctx, err)
+	}
+}
+
+// maxStreamAttempts limits how many times a request is attempted in case its
+// streams are refused.
+const maxStreamAttempts = 3
+
+// exchange writes an encoded request to a new connection, and reads the
+// response header. The connection is closed in case ctx is done before the
+// connection is closed by the caller. The connection replaces the one wrapped
+// by counted, which accumulates bytes transferred across attempts.
+func (c *Client) exchange(ctx context.Context, data []byte, enc codec, v interface{}, counted *countingConn) (*Response, *bufferedConn, error) {
+	conn, err := c.connect(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
-	buf := newBufferedConn(conn)
-	_, err = io.Copy(conn, bytes.NewBuffer(data))
+	counted.ReadWriteCloser = watchConn(ctx, conn)
+	buf := newBufferedConn(counted)
+	_, err = counted.Write(data)
+	if err == nil && v != nil {
+		err = enc.writeBlob(counted, reflect.ValueOf(v))
+	}
 	if err != nil {
-		conn.Close()
+		counted.Close()
 		return nil, nil, err
 	}
-	// read header...
-	header, err := buf.Peek(3)
+	response, err := readResponse(buf)
 	if err != nil {
-		conn.Close()
+		counted.Close()
 		return nil, nil, err
 	}
+	return response, &buf, nil
+}
+
+// readResponse reads the response header from buf, returning the Error
+// provided by the server instead, if any.
+func readResponse(buf bufferedConn) (*Response, error) {
+	header, err := buf.Peek(3)
+	if err != nil {
+		return nil, err
+	}
 	switch {
 	case bytes.Equal(header, magicError):
-		defer conn.Close()
 		managedError := Error{}
 		if err = managedError.Decode(buf); err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-		return nil, nil, managedError
+		return nil, managedError
 
 	case bytes.Equal(header, magicResponse):
 		response := Response{}
 		if err = response.Decode(buf); err != nil {
-			conn.Close()
-			return nil, nil, err
+			return nil, err
 		}
-		return &response, &buf, err
+		return &response, nil
 	default:
-		conn.Close()
-		return nil, nil, ErrCorruptStream
+		return nil, ErrCorruptStream
 	}
 }
 
 func (c *Client) DoRequest(ctx context.Context, request Request, v interface{}) (interface{}, map[string]string, error) {
-	r, buf, err := c.performRequest(ctx, request, v)
+	ret, headers, _, err := c.DoRequestWithTrailer(ctx, request, v)
+	return ret, headers, err
+}
+
+// DoRequestWithTrailer performs a request of a unary method, like DoRequest,
+// additionally returning the trailer headers provided by the server after the
+// response's body. The trailer of a response containing a streamed Blob
+// follows the Blob, and is provided by Blob.Trailer instead.
+func (c *Client) DoRequestWithTrailer(ctx context.Context, request Request, v interface{}) (interface{}, map[string]string, map[string]string, error) {
+	var trailer map[string]string
+	invoke := func(ctx context.Context, request Request, v interface{}) (ret interface{}, headers map[string]string, err error) {
+		start := time.Now()
+		counted := &countingConn{}
+		ret, headers, trailer, err = c.doRequest(ctx, request, v, counted, func(err error) {
+			c.logRequest(request, start, counted, err)
+		})
+		return
+	}
+	ret, headers, err := chainClientInterceptors(c.interceptors, invoke)(ctx, request, v)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	return ret, headers, trailer, nil
+}
+
+// doRequest performs a request of a unary method, returning its response,
+// headers and trailer. finish is called with the error that ended the request,
+// if any, once it is finished, which happens after a streamed Blob held by the
+// response is finished.
+func (c *Client) doRequest(ctx context.Context, request Request, v interface{}, counted *countingConn, finish func(err error)) (ret interface{}, headers, trailer map[string]string, err error) {
+	held := false
+	defer func() {
+		if !held {
+			finish(err)
+		}
+	}()
+	r, buf, err := c.performRequest(ctx, request, v, counted)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	defer buf.Close()
 	if r.Stream {
-		return nil, nil, ErrWantsStreamed
+		buf.Close()
+		return nil, nil, nil, ErrWantsStreamed
 	}
 
-	_, ret, err := Decode(buf)
-	return &ret, r.Headers, err
+	resCodec, err := responseCodec(r)
+	if err != nil {
+		buf.Close()
+		return nil, nil, nil, err
+	}
+	if _, ret, err = resCodec.decode(buf); err != nil {
+		buf.Close()
+		return nil, nil, nil, contextError(ctx, err)
+	}
+	if b := topLevelBlob(reflect.ValueOf(ret)); b.streaming() {
+		// The Blob is read from the connection, which must be kept open
+		// until it is consumed.
+		held = true
+		holdConn(ctx, b, func(err error) {
+			buf.Close()
+			finish(err)
+		}, func() (map[string]string, error) {
+			return readTrailer(ctx, *buf, r)
+		})
+		return ret, r.Headers, nil, nil
+	}
+	defer buf.Close()
+	trailer, err = readTrailer(ctx, *buf, r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ret, r.Headers, trailer, nil
 }
 
 func (c *Client) DoRequestStreamed(ctx context.Context, request Request, v interface{}) (<-chan interface{}, map[string]string, error) {
-	r, buf, err := c.performRequest(ctx, request, v)
+	ch, headers, _, err := c.DoRequestStreamedWithStatus(ctx, request, v)
+	return ch, headers, err
+}
+
+// DoRequestStreamedWithStatus performs a request of a server-streaming
+// method, like DoRequestStreamed, additionally returning a StreamStatus which
+// reports whether the stream completed once its channel is closed.
+func (c *Client) DoRequestStreamedWithStatus(ctx context.Context, request Request, v interface{}) (<-chan interface{}, map[string]string, *StreamStatus, error) {
+	var status *StreamStatus
+	invoke := func(ctx context.Context, request Request, v interface{}) (ch <-chan interface{}, headers map[string]string, err error) {
+		ch, headers, status, err = c.doRequestStreamed(ctx, request, v)
+		return
+	}
+	ch, headers, err := chainClientStreamInterceptors(c.streamInterceptors, invoke)(ctx, request, v)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	if status == nil {
+		// An interceptor provided values without performing the request.
+		status = &StreamStatus{done: make(chan struct{})}
+		status.finish(nil, nil)
+	}
+	return ch, headers, status, nil
+}
+
+// doRequestStreamed performs a request of a server-streaming method, returning
+// its values, headers and status.
+func (c *Client) doRequestStreamed(ctx context.Context, request Request, v interface{}) (<-chan interface{}, map[string]string, *StreamStatus, error) {
+	start := time.Now()
+	counted := &countingConn{}
+	r, buf, err := c.performRequest(ctx, request, v, counted)
+	if err != nil {
+		c.logRequest(request, start, counted, err)
+		return nil, nil, nil, err
+	}
+	reader, err := newStreamReader(ctx, *buf, r)
+	if err != nil {
+		buf.Close()
+		c.logRequest(request, start, counted, err)
+		return nil, nil, nil, err
 	}
 	ch := make(chan interface{}, 10)
+	status := &StreamStatus{done: make(chan struct{})}
 	go func() {
 		defer buf.Close()
-		defer close(ch)
 		for {
-			_, v, err := Decode(buf)
-			if err != nil {
-				break
+			v, err := reader.next()
+			if err == nil {
+				select {
+				case ch <- v:
+					continue
+				case <-ctx.Done():
+					err = ctx.Err()
+				}
 			}
-			fmt.Printf("BUG: Pushing %#v\n", v)
-			ch <- v
+			status.finish(reader.trailer, err)
+			c.logRequest(request, start, counted, status.err)
+			close(ch)
+			return
 		}
 	}()
-	return ch, r.Headers, nil
+	return ch, r.Headers, status, nil
+}
+
+// logRequest logs the completion of a given request, reporting it as slow in
+// case its duration exceeds the Client's threshold.
+func (c *Client) logRequest(request Request, start time.Time, counted *countingConn, err error) {
+	d := time.Since(start)
+	read, written := counted.counts()
+	args := []interface{}{"method_id", request.Method, "peer", c.address, "duration", d, "bytes_read", read, "bytes_written", written}
+	if request.MethodFQN != "" {
+		args = append([]interface{}{"method", request.MethodFQN}, args...)
+	}
+	switch {
+	case err != nil:
+		c.log.Warn("request failed", append(args, "error", err)...)
+	case isSlow(d, c.slowThreshold):
+		c.log.Warn("slow request", args...)
+	default:
+		c.log.Debug("request completed", args...)
+	}
+}
+
+// responseCodec returns the codec required to decode the body of a given
+// Response, based on the wire version announced by the server.
+func responseCodec(r *Response) (codec, error) {
+	version, err := parseWireVersion(Header(r.Headers).Get(wireVersionHeader))
+	if err != nil {
+		return codec{}, err
+	}
+	return newCodec(version), nil
 }
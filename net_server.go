@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -44,6 +45,26 @@ func NewServer(bind string, opts ...Option) *Server {
 		handlers:    map[uint64]*serviceHandler{},
 		mu:          &sync.Mutex{},
 		clients:     map[*srvConn]bool{},
+		maxVersion:  LatestWireVersion,
+		muxEnabled:  o.multiplexing,
+		maxStreams:  o.maxStreams,
+		idleTimeout: o.idleTimeout,
+
+		handlerTimeout: o.handlerTimeout,
+		methodTimeouts: map[string]time.Duration{},
+
+		errorHandler:  o.errorHandler,
+		devMode:       o.developmentMode,
+		log:           nopLogger{},
+		slowThreshold: o.slowRequestThreshold,
+	}
+
+	if o.logger != nil {
+		s.log = o.logger
+	}
+
+	if o.wireVersion != 0 {
+		s.maxVersion = o.wireVersion
 	}
 
 	if strings.HasPrefix(bind, "unix://") {
@@ -58,13 +79,14 @@ type handlerFunction struct {
 	fn           reflect.Value
 	usesStreamer bool
 	streamerType reflect.Type
+	receiverType reflect.Type
 	inType       reflect.Type
 	outType      reflect.Type
 }
 
 func (h handlerFunction) String() string {
-	return fmt.Sprintf("handlerFunction{fn: %#v, usesStreamer: %t, streamerType: %s, inType: %s, outType: %s}",
-		h.fn, h.usesStreamer, h.streamerType, h.inType, h.outType)
+	return fmt.Sprintf("handlerFunction{fn: %#v, usesStreamer: %t, streamerType: %s, receiverType: %s, inType: %s, outType: %s}",
+		h.fn, h.usesStreamer, h.streamerType, h.receiverType, h.inType, h.outType)
 }
 
 type serviceHandler struct {
@@ -78,21 +100,46 @@ type internalServer interface {
 	headersTimeout() time.Duration
 	handlerForID(uint64) (*serviceHandler, bool)
 	allMiddlewares() []Middleware
+	allInterceptors() []Interceptor
+	allStreamInterceptors() []StreamInterceptor
+	wireVersion() WireVersion
+	multiplexing() bool
+	maxConcurrentStreams() int
+	muxIdleTimeout() time.Duration
+	maxHandlerTimeout(h *serviceHandler) time.Duration
 	notifyClosed(c *srvConn)
+	reportError(r ErrorReport)
+	developmentMode() bool
+	logger() Logger
+	slowRequestThreshold() time.Duration
 }
 
 // Server represents a server object capable of routing incoming connections and
 // requests.
 type Server struct {
-	address     string
-	network     string
-	tlsConfig   *tls.Config
-	stopChan    chan bool
-	stopping    bool
-	timeout     time.Duration
-	waitClients *sync.WaitGroup
-	middlewares []Middleware
-	handlers    map[uint64]*serviceHandler
+	address            string
+	network            string
+	tlsConfig          *tls.Config
+	stopChan           chan bool
+	stopping           bool
+	timeout            time.Duration
+	waitClients        *sync.WaitGroup
+	middlewares        []Middleware
+	interceptors       []Interceptor
+	streamInterceptors []StreamInterceptor
+	handlers           map[uint64]*serviceHandler
+	maxVersion         WireVersion
+	muxEnabled         bool
+	maxStreams         int
+	idleTimeout        time.Duration
+
+	handlerTimeout time.Duration
+	methodTimeouts map[string]time.Duration
+
+	errorHandler  ErrorHandler
+	devMode       bool
+	log           Logger
+	slowThreshold time.Duration
 
 	mu      *sync.Mutex
 	clients map[*srvConn]bool
@@ -111,6 +158,68 @@ func (s *Server) allMiddlewares() []Middleware {
 	return s.middlewares
 }
 
+func (s *Server) allInterceptors() []Interceptor {
+	return s.interceptors
+}
+
+func (s *Server) allStreamInterceptors() []StreamInterceptor {
+	return s.streamInterceptors
+}
+
+func (s *Server) wireVersion() WireVersion {
+	return s.maxVersion
+}
+
+func (s *Server) multiplexing() bool {
+	return s.muxEnabled
+}
+
+func (s *Server) maxConcurrentStreams() int {
+	return s.maxStreams
+}
+
+func (s *Server) muxIdleTimeout() time.Duration {
+	return s.idleTimeout
+}
+
+func (s *Server) maxHandlerTimeout(h *serviceHandler) time.Duration {
+	if t, ok := s.methodTimeouts[h.fqn]; ok {
+		return t
+	}
+	return s.handlerTimeout
+}
+
+func (s *Server) reportError(r ErrorReport) {
+	args := []interface{}{"method", r.MethodFQN, "peer", r.Peer, "error", r.Err}
+	if r.Panicked() {
+		args = append(args, "stack", string(r.Stack))
+	}
+	s.log.Error("internal error", args...)
+	if s.errorHandler != nil {
+		s.errorHandler(r)
+	}
+}
+
+func (s *Server) developmentMode() bool {
+	return s.devMode
+}
+
+func (s *Server) logger() Logger {
+	return s.log
+}
+
+func (s *Server) slowRequestThreshold() time.Duration {
+	return s.slowThreshold
+}
+
+// SetMethodTimeout determines the maximum duration of the handler of a method
+// identified by its fully-qualified name, overriding the value provided
+// through WithHandlerTimeout. A zero value removes the limit for the method.
+// Like handlers, timeouts must be set before the Server is started.
+func (s *Server) SetMethodTimeout(fqn string, t time.Duration) {
+	s.methodTimeouts[fqn] = t
+}
+
 // Middleware is a simple function that takes an RPCRequest, and either returns
 // the same request and no error, in case the server should continue processing
 // it, or an error, in case the server should stop processing it.
@@ -175,10 +284,15 @@ func (s *Server) StartListener(listener net.Listener) error {
 		connCtx := baseContext
 		tmpDelay = 0
 		c := s.newConn(rw)
+		s.log.Debug("connection accepted", "peer", c.peer)
 		go c.serve(connCtx)
 	}
 }
 
+// isStreamer indicates whether t is a streamer generated for a streamed
+// response. Streamers hold the response headers and a channel receiving
+// pushed values, optionally followed by the handler's context, allowing Push
+// to return an error once the stream is interrupted.
 func isStreamer(t reflect.Type) bool {
 	if t.Kind() != reflect.Pointer {
 		return false
@@ -190,7 +304,8 @@ func isStreamer(t reflect.Type) bool {
 	if headers, push := t.Method(0), t.Method(1); headers.Name != "Headers" ||
 		push.Name != "Push" ||
 		push.Type.NumIn() != 2 ||
-		push.Type.NumOut() != 0 ||
+		push.Type.NumOut() > 1 ||
+		(push.Type.NumOut() == 1 && push.Type.Out(0) != reflectedErrorType) ||
 		headers.Type.NumIn() != 1 ||
 		headers.Type.NumOut() != 1 ||
 		headers.Type.Out(0) != reflectedHeaderType {
@@ -198,7 +313,7 @@ func isStreamer(t reflect.Type) bool {
 	} else if pushIn := push.Type.In(1); !canEncode(pushIn) {
 		return false
 	}
-	if t.NumField() != 2 {
+	if t.NumField() != 2 && t.NumField() != 3 {
 		return false
 	}
 	if h, ch := t.Field(0), t.Field(1); h.Name != "h" ||
@@ -208,9 +323,54 @@ func isStreamer(t reflect.Type) bool {
 		ch.Type.ChanDir() != reflect.SendDir {
 		return false
 	}
+	if t.NumField() == 3 {
+		if ctx := t.Field(2); ctx.Name != "ctx" || ctx.Type != reflectedContextType {
+			return false
+		}
+	}
 	return true
 }
 
+var reflectedContextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+func isReceiver(t reflect.Type) bool {
+	if t.Kind() != reflect.Pointer {
+		return false
+	}
+	t = t.Elem()
+	if t.Kind() != reflect.Struct || t.NumMethod() != 2 {
+		return false
+	}
+	if headers, recv := t.Method(0), t.Method(1); headers.Name != "Headers" ||
+		recv.Name != "Recv" ||
+		recv.Type.NumIn() != 1 ||
+		recv.Type.NumOut() != 2 ||
+		recv.Type.Out(1) != reflectedErrorType ||
+		headers.Type.NumIn() != 1 ||
+		headers.Type.NumOut() != 1 ||
+		headers.Type.Out(0) != reflectedHeaderType {
+		return false
+	} else if !canEncode(recv.Type.Out(0)) {
+		return false
+	}
+	if t.NumField() != 3 {
+		return false
+	}
+	if h, ch, err := t.Field(0), t.Field(1), t.Field(2); h.Name != "h" ||
+		ch.Name != "ch" ||
+		err.Name != "err" ||
+		h.Type != reflectedHeaderType ||
+		ch.Type.Kind() != reflect.Chan ||
+		ch.Type.ChanDir() != reflect.RecvDir ||
+		ch.Type.Elem() != t.Method(1).Type.Out(0) ||
+		err.Type != reflect.PtrTo(reflectedErrorType) {
+		return false
+	}
+	return true
+}
+
+var reflectedErrorType = reflect.TypeOf((*error)(nil)).Elem()
+
 // RegisterHandler registers a given handler identified by k, and named by n,
 // having a given handler function. This function is not intended to be used
 // directly by users, but rather for autogenerated code responsible for
@@ -234,19 +394,21 @@ func (s *Server) RegisterHandler(k uint64, n string, handler interface{}) {
 
 	// When a streamer is used, the only return value possible is an error. If
 	// the argument before the streamer is a header, request type is void.
-	// Otherwise, the n-1 item is the request type.
+	// Otherwise, the n-1 item is either a receiver, for streamed requests, or
+	// the request type.
+	last := numIn - 1
 	if fn.usesStreamer {
-		fn.streamerType = fnType.In(numIn - 1).Elem()
-		if fnType.In(numIn-2) != reflectedHeaderType {
-			fn.inType = fnType.In(numIn - 2)
-		}
-	} else {
-		if fnType.In(numIn-1) != reflectedHeaderType {
-			fn.inType = fnType.In(numIn - 1)
-		}
-		if numOut == 3 {
-			fn.outType = fnType.Out(1)
-		}
+		fn.streamerType = fnType.In(last).Elem()
+		last--
+	} else if numOut == 3 {
+		fn.outType = fnType.Out(1)
+	}
+	switch in := fnType.In(last); {
+	case in == reflectedHeaderType:
+	case isReceiver(in):
+		fn.receiverType = in.Elem()
+	default:
+		fn.inType = in
 	}
 
 	c := strings.Split(n, ".")
@@ -260,10 +422,15 @@ func (s *Server) RegisterHandler(k uint64, n string, handler interface{}) {
 
 func (s *Server) newConn(rw net.Conn) *srvConn {
 	s.waitClients.Add(1)
+	counted := &countingConn{ReadWriteCloser: rw}
 	c := &srvConn{
-		server: s,
-		rw:     rw,
-		mu:     &sync.Mutex{},
+		server:  s,
+		rw:      newBufferedConn(counted),
+		mu:      &sync.Mutex{},
+		codec:   defaultCodec,
+		peer:    rw.RemoteAddr(),
+		counted: counted,
+		started: time.Now(),
 	}
 	s.mu.Lock()
 	s.clients[c] = true
@@ -283,6 +450,11 @@ func (s *Server) Shutdown(ctx context.Context) {
 	s.stopping = true
 	s.stopChan <- true
 	close(s.stopChan)
+	s.mu.Lock()
+	for c := range s.clients {
+		c.drain()
+	}
+	s.mu.Unlock()
 	poll := time.NewTicker(1 * time.Second)
 	defer poll.Stop()
 	for {
@@ -291,7 +463,10 @@ func (s *Server) Shutdown(ctx context.Context) {
 			s.forceShutdown()
 			return
 		case <-poll.C:
-			if len(s.clients) == 0 {
+			s.mu.Lock()
+			remaining := len(s.clients)
+			s.mu.Unlock()
+			if remaining == 0 {
 				return
 			}
 		}
@@ -307,6 +482,8 @@ func (s *Server) forceShutdown() {
 }
 
 func (s *Server) notifyClosed(c *srvConn) {
+	read, written := c.counted.counts()
+	s.log.Debug("connection closed", "peer", c.peer, "duration", time.Since(c.started), "bytes_read", read, "bytes_written", written)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.clients, c)
@@ -328,9 +505,45 @@ const (
 
 type srvConn struct {
 	server internalServer
-	rw     net.Conn
+	rw     io.ReadWriteCloser
 	mu     *sync.Mutex
 	state  connState
+	codec  codec
+	mask   *FieldMask
+	mux    *muxConn
+
+	// reqCodec is used to decode streamed requests.
+	reqCodec codec
+	// cancel cancels the context provided to the handler.
+	cancel context.CancelFunc
+	// trailers indicates whether the client supports trailers.
+	trailers bool
+	// method is the fully-qualified name of the requested method.
+	method string
+	// peer is the address of the client.
+	peer net.Addr
+	// counted counts bytes transferred through rw.
+	counted *countingConn
+	// started is the time the connection was accepted.
+	started time.Time
+	// failure is the error that caused the request to fail, if any.
+	failure error
+}
+
+// streamServer serves streams of a multiplexed connection, which are closed
+// along with their connection.
+type streamServer struct {
+	internalServer
+}
+
+func (streamServer) multiplexing() bool      { return false }
+func (streamServer) notifyClosed(c *srvConn) {}
+
+// incomingHeader represents either a Request, or the beginning of a
+// multiplexed connection.
+type incomingHeader struct {
+	request    *Request
+	muxVersion byte
 }
 
 func (c *srvConn) setState(new connState) {
@@ -341,41 +554,94 @@ func (c *srvConn) setState(new connState) {
 
 func (c *srvConn) serve(ctx context.Context) {
 	defer func() {
-		if err := recover(); err != nil {
-			if e, ok := err.(error); ok {
-				c.handleError(e)
-				return
-			}
-			c.handleError(fmt.Errorf("panic on non-error value: %s", err))
+		if v := recover(); v != nil {
+			c.handlePanic(v, debug.Stack())
+		}
+		if c.method != "" {
+			c.logRequest()
 		}
 	}()
 
 	c.setState(connStateWaitingHeaders)
 	headersTimeout := time.NewTimer(c.server.headersTimeout())
 	var request *Request
-	reqChan := make(chan *Request)
+	reqChan := make(chan incomingHeader)
 	go c.readHeader(reqChan)
 	select {
 	case <-headersTimeout.C:
+		c.server.logger().Warn("headers timeout", "peer", c.peer)
 		c.close()
 		return
-	case req := <-reqChan:
+	case in := <-reqChan:
 		headersTimeout.Stop()
-		if req == nil {
+		if in.muxVersion != 0 {
+			c.serveMux(ctx, in.muxVersion)
+			return
+		}
+		if in.request == nil {
 			c.close()
 			return
 		}
 		c.setState(connStateReceivedHeaders)
-		request = req
+		request = in.request
 	}
 
 	handler, ok := c.server.handlerForID(request.Method)
 	if !ok {
+		c.server.logger().Warn("unknown method", "peer", c.peer, "method_id", request.Method)
 		c.handleError(Error{
 			Kind: ErrorKindUnimplementedMethod,
 		})
 		return
 	}
+	c.method = handler.fqn
+
+	version, err := parseWireVersion(Header(request.Headers).Get(wireVersionHeader))
+	if err != nil {
+		c.handleError(Error{
+			Kind:       ErrorKindBadRequest,
+			Identifier: err.Error(),
+		})
+		return
+	}
+	reqCodec := newCodec(version)
+	if max := c.server.wireVersion(); version > max {
+		version = max
+	}
+	c.codec = newCodec(version)
+
+	if m := Header(request.Headers).Get(FieldMaskHeader); m != "" {
+		mask, err := ParseFieldMask(m)
+		if err != nil {
+			c.handleError(Error{
+				Kind:       ErrorKindBadRequest,
+				Identifier: err.Error(),
+			})
+			return
+		}
+		c.mask = &mask
+	}
+
+	deadline, err := parseDeadline(Header(request.Headers).Get(deadlineHeader))
+	if err != nil {
+		c.handleError(Error{
+			Kind:       ErrorKindBadRequest,
+			Identifier: err.Error(),
+		})
+		return
+	}
+	var cancel context.CancelFunc
+	if timeout := capTimeout(deadline, c.server.maxHandlerTimeout(handler)); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	c.cancel = cancel
+	if Header(request.Headers).Get(trailersHeader) != "" {
+		c.trailers = true
+		ctx = context.WithValue(ctx, trailerContextKey, &trailerSetter{h: Header{}})
+	}
 
 	req := &RPCRequest{
 		ctx:        ctx,
@@ -386,35 +652,106 @@ func (c *srvConn) serve(ctx context.Context) {
 	}
 
 	for _, m := range c.server.allMiddlewares() {
-		var err error
 		req, err = m(req)
 		if err != nil {
 			c.handleError(err)
 			return
 		}
 	}
-	c.setState(connStateReceivingBody)
-	_, data, err := Decode(c.rw)
-	if err != nil {
-		c.handleError(err)
+	if streamed := Header(request.Headers).Get(requestStreamHeader) != ""; streamed != (handler.handler.receiverType != nil) {
+		c.handleError(Error{Kind: ErrorKindTypeMismatch})
 		return
 	}
+	c.setState(connStateReceivingBody)
+	var data interface{}
+	if handler.handler.receiverType == nil {
+		if _, data, err = reqCodec.decode(c.rw); err != nil {
+			c.logDecodeError(err)
+			c.handleError(err)
+			return
+		}
+		go c.awaitPeer(ctx, topLevelBlob(reflect.ValueOf(data)))
+	}
+	c.reqCodec = reqCodec
 	c.setState(connStateReceivedBody)
-	if err = c.apply(handler.handler, req.ctx, req.Headers, data); err != nil {
+	if err = c.apply(handler.handler, req, data); err != nil {
 		c.handleError(err)
 		return
 	}
 	c.close()
 }
 
-func (c srvConn) readHeader(ch chan<- *Request) {
+func (c srvConn) readHeader(ch chan<- incomingHeader) {
 	req := Request{}
 	defer close(ch)
+	if b, ok := c.rw.(bufferedConn); ok {
+		hello, err := b.Peek(len(magicMux) + 1)
+		if err == nil && bytes.Equal(hello[:len(magicMux)], magicMux) && hello[len(magicMux)] != 0 {
+			_, _ = b.Discard(len(hello))
+			ch <- incomingHeader{muxVersion: hello[len(magicMux)]}
+			return
+		}
+	}
 	if err := req.Decode(c.rw); err != nil {
-		ch <- nil
+		ch <- incomingHeader{}
 		return
 	}
-	ch <- &req
+	ch <- incomingHeader{request: &req}
+}
+
+// serveMux serves a multiplexed connection, handling each of its streams as a
+// dedicated connection.
+func (c *srvConn) serveMux(ctx context.Context, version byte) {
+	m, err := acceptMux(c.rw, version, c.server.multiplexing(), func(s *muxStream) {
+		counted := &countingConn{ReadWriteCloser: s}
+		sc := &srvConn{
+			server:  streamServer{c.server},
+			rw:      newBufferedConn(counted),
+			mu:      &sync.Mutex{},
+			codec:   defaultCodec,
+			peer:    c.peer,
+			counted: counted,
+			started: time.Now(),
+		}
+		go sc.serve(ctx)
+	})
+	if err != nil {
+		c.close()
+		return
+	}
+	m.maxStreams, m.idleTimeout = c.server.maxConcurrentStreams(), c.server.muxIdleTimeout()
+	c.mu.Lock()
+	c.mux = m
+	c.mu.Unlock()
+	m.run()
+	c.close()
+}
+
+// awaitPeer cancels the handler's context once the client closes the
+// connection. Since clients do not send further data after a request, reads
+// only complete once the connection is closed by either side. In case the
+// request holds a streamed Blob, the connection is only watched after it is
+// consumed.
+func (c *srvConn) awaitPeer(ctx context.Context, b *Blob) {
+	if b.streaming() {
+		select {
+		case <-b.done():
+		case <-ctx.Done():
+			return
+		}
+	}
+	_, _ = c.rw.Read(make([]byte, 1))
+	c.cancel()
+}
+
+// drain closes c once its current requests are finished.
+func (c *srvConn) drain() {
+	c.mu.Lock()
+	m := c.mux
+	c.mu.Unlock()
+	if m != nil {
+		go m.goAway()
+	}
 }
 
 func (c *srvConn) close() {
@@ -428,21 +765,83 @@ func (c *srvConn) close() {
 	go c.server.notifyClosed(c)
 }
 
-func (c *srvConn) handleError(err error) {
-	defer c.close()
-	var managed Error
+// managedError converts err into the Error reported to clients. Errors other
+// than Error values are reported as internal errors, omitting their details
+// unless the Server is in development mode.
+func (c *srvConn) managedError(err error) Error {
 	if man, ok := err.(Error); ok {
-		managed = man
-	} else {
-		managed = Error{
-			Kind:       ErrorKindInternalError,
-			Headers:    nil,
-			Identifier: "",
-			UserData:   nil,
-		}
+		return man
+	}
+	return c.internalError(ErrorReport{Err: err})
+}
+
+// internalError reports r to the Server's ErrorHandler, and returns the Error
+// reported to the client.
+func (c *srvConn) internalError(r ErrorReport) Error {
+	r.MethodFQN, r.Peer = c.method, c.peer
+	c.server.reportError(r)
+	managed := Error{Kind: ErrorKindInternalError}
+	if c.server.developmentMode() {
+		managed.UserData = map[string]string{ErrorDescriptionKey: describeError(r)}
+	}
+	return managed
+}
+
+func (c *srvConn) handleError(err error) {
+	c.setFailure(err)
+	c.writeError(c.managedError(err))
+}
+
+// handlePanic handles a value recovered from a panic, given the stack trace of
+// the goroutine that panicked.
+func (c *srvConn) handlePanic(v interface{}, stack []byte) {
+	err, ok := v.(error)
+	if !ok {
+		err = fmt.Errorf("panic on non-error value: %s", v)
+	}
+	c.setFailure(err)
+	c.writeError(c.internalError(ErrorReport{Err: err, Stack: stack}))
+}
+
+// setFailure records the error that caused the request to fail, unless one
+// was already recorded.
+func (c *srvConn) setFailure(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failure == nil {
+		c.failure = err
 	}
+}
 
-	// TODO: Log, report?
+// logRequest logs the completion of the request, reporting it as slow in
+// case its duration exceeds the Server's threshold.
+func (c *srvConn) logRequest() {
+	c.mu.Lock()
+	failure := c.failure
+	c.mu.Unlock()
+	d := time.Since(c.started)
+	read, written := c.counted.counts()
+	args := []interface{}{"method", c.method, "peer", c.peer, "duration", d, "bytes_read", read, "bytes_written", written}
+	log := c.server.logger()
+	switch {
+	case failure != nil:
+		log.Warn("request failed", append(args, "error", failure)...)
+	case isSlow(d, c.server.slowRequestThreshold()):
+		log.Warn("slow request", args...)
+	default:
+		log.Debug("request completed", args...)
+	}
+}
+
+// logDecodeError logs a failure to decode a request value.
+func (c *srvConn) logDecodeError(err error) {
+	c.server.logger().Warn("decode failed", "method", c.method, "peer", c.peer, "error", err)
+}
+
+// writeError writes a given Error to the client, in case the response was not
+// yet written, and closes the connection.
+func (c *srvConn) writeError(managed Error) {
+	defer c.close()
 
 	// There's no point in writing an error value in case c's state does not
 	// match the following condition.
@@ -456,116 +855,368 @@ func (c *srvConn) handleError(err error) {
 	}
 }
 
-func (c *srvConn) apply(handler handlerFunction, ctx context.Context, h Header, data interface{}) error {
-	applyParams := make([]reflect.Value, 0, 4)
-	applyParams = append(applyParams, reflect.ValueOf(ctx), reflect.ValueOf(h))
+func (c *srvConn) apply(handler handlerFunction, req *RPCRequest, data interface{}) error {
+	ctx, h := req.ctx, req.Headers
+	var msg interface{}
 	if handler.inType != nil {
-		if data == nil {
-			return Error{Kind: ErrorKindTypeMismatch}
-		}
-		dataVal := reflect.ValueOf(data)
-		dataTyp := dataVal.Type()
-		if handler.inType.Kind() == reflect.Pointer && dataTyp.Kind() != reflect.Pointer {
-			ptr := reflect.New(dataTyp)
-			ptr.Elem().Set(dataVal)
-			dataTyp = ptr.Type()
-			dataVal = ptr
-		}
-		if !dataTyp.ConvertibleTo(handler.inType) {
-			return Error{Kind: ErrorKindTypeMismatch}
+		dataVal, err := convertRequest(data, handler.inType)
+		if err != nil {
+			return err
 		}
-		applyParams = append(applyParams, dataVal.Convert(handler.inType))
+		msg = dataVal.Interface()
+	}
+	if handler.receiverType != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		msg = c.startReceiver(ctx, handler.receiverType, h, stop).Interface()
 	}
 
 	if handler.usesStreamer {
-		vPtr := reflect.New(handler.streamerType)
-		tChan := reflect.ChanOf(reflect.BothDir, handler.streamerType.Field(1).Type.Elem())
-		vChan := reflect.MakeChan(tChan, 10)
-		hVal := reflect.ValueOf(h)
-		v := vPtr.Elem()
-		reflect.NewAt(v.Field(0).Type(), unsafe.Pointer(v.Field(0).UnsafeAddr())).Elem().Set(hVal)
-		reflect.NewAt(v.Field(1).Type(), unsafe.Pointer(v.Field(1).UnsafeAddr())).Elem().Set(vChan)
-
-		wg := sync.WaitGroup{}
-		wg.Add(1)
-		go c.serviceStreamer(vChan, h, wg.Done)
-
-		applyParams = append(applyParams, vPtr)
-		retVals := handler.fn.Call(applyParams)
-		vChan.Close()
-		wg.Wait()
-		if !retVals[0].IsNil() {
-			if err := retVals[0].Interface().(error); err != nil {
+		call := func(ctx context.Context, req *RPCRequest, msg interface{}, stream ServerStream) error {
+			applyParams, err := handler.params(ctx, req.Headers, msg)
+			if err != nil {
 				return err
 			}
+			vPtr := reflect.New(handler.streamerType)
+			tChan := reflect.ChanOf(reflect.BothDir, handler.streamerType.Field(1).Type.Elem())
+			vChan := reflect.MakeChan(tChan, 10)
+			hVal := reflect.ValueOf(req.Headers)
+			v := vPtr.Elem()
+			reflect.NewAt(v.Field(0).Type(), unsafe.Pointer(v.Field(0).UnsafeAddr())).Elem().Set(hVal)
+			reflect.NewAt(v.Field(1).Type(), unsafe.Pointer(v.Field(1).UnsafeAddr())).Elem().Set(vChan)
+			if v.NumField() == 3 {
+				reflect.NewAt(v.Field(2).Type(), unsafe.Pointer(v.Field(2).UnsafeAddr())).Elem().Set(reflect.ValueOf(&ctx).Elem())
+			}
+
+			pushed := make(chan error, 1)
+			go func() {
+				pushed <- c.serviceStreamer(vChan, stream)
+			}()
+
+			applyParams = append(applyParams, vPtr)
+			var retVals []reflect.Value
+			func() {
+				// Pushed values are delivered before a panic is
+				// recovered, so that writes do not overlap.
+				defer func() {
+					vChan.Close()
+					err = <-pushed
+				}()
+				retVals = handler.fn.Call(applyParams)
+			}()
+			if err != nil {
+				return err
+			}
+			if !retVals[0].IsNil() {
+				return retVals[0].Interface().(error)
+			}
+			return nil
 		}
-		c.setState(connStateWroteResponse)
-		return nil
+		stream := &serverStream{c: c, h: h}
+		err := chainStreamInterceptors(c.server.allStreamInterceptors(), call)(ctx, req, msg, stream)
+		if ctx.Err() == context.DeadlineExceeded {
+			err = Error{Kind: ErrorKindDeadlineExceeded}
+		}
+		return c.finishStream(ctx, h, err)
 	}
 
-	retVal := handler.fn.Call(applyParams)
-	errVal := retVal[len(retVal)-1]
-	if !errVal.IsNil() {
-		if err := errVal.Interface().(error); err != nil {
-			return err
+	call := func(ctx context.Context, req *RPCRequest, msg interface{}) (Header, interface{}, error) {
+		applyParams, err := handler.params(ctx, req.Headers, msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		retVal := handler.fn.Call(applyParams)
+		errVal := retVal[len(retVal)-1]
+		if !errVal.IsNil() {
+			err = errVal.Interface().(error)
+		}
+		var res interface{}
+		if handler.outType != nil {
+			res = retVal[1].Interface()
 		}
+		return retVal[0].Interface().(Header), res, err
+	}
+	respHeaders, res, err := chainInterceptors(c.server.allInterceptors(), call)(ctx, req, msg)
+	if ctx.Err() == context.DeadlineExceeded {
+		// The client gave up on the request, or the handler exceeded its
+		// maximum duration; in either case, its result is discarded.
+		return Error{Kind: ErrorKindDeadlineExceeded}
+	}
+	if err != nil {
+		return err
 	}
 
-	respHeaders := retVal[len(retVal)-2].Interface().(Header)
-	var respData []byte
-	var err error
-	if handler.outType == nil {
-		respData = encodeVoid()
-	} else if respData, err = encode(retVal[0]); err != nil {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	respData := appendVoid((*buf)[:0])
+	enc := c.codec.streaming()
+	var out reflect.Value
+	if handler.outType != nil && res != nil {
+		if out, err = c.trimResponse(reflect.ValueOf(res)); err != nil {
+			return err
+		}
+		if respData, err = enc.appendEncode((*buf)[:0], out); err != nil {
+			return err
+		}
+	}
+	*buf = respData
+	if err := c.writeResponseHeader(respHeaders, false); err != nil {
 		return err
 	}
-	if err = c.writeResponseHeader(respHeaders, false); err != nil {
+	if _, err := c.rw.Write(respData); err != nil {
 		return err
 	}
-	_, err = io.Copy(c.rw, bytes.NewReader(respData))
-	return err
+	if err := enc.writeBlob(c.rw, out); err != nil {
+		return err
+	}
+	if c.trailers {
+		return c.writeTrailer(ctx, nil)
+	}
+	return nil
+}
+
+// params returns the parameters provided to the handler, given its context,
+// headers, and request message or receiver.
+func (handler handlerFunction) params(ctx context.Context, h Header, msg interface{}) ([]reflect.Value, error) {
+	params := make([]reflect.Value, 0, 4)
+	params = append(params, reflect.ValueOf(ctx), reflect.ValueOf(h))
+	switch {
+	case handler.inType != nil:
+		dataVal, err := convertRequest(msg, handler.inType)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, dataVal)
+	case handler.receiverType != nil:
+		if reflect.TypeOf(msg) != reflect.PtrTo(handler.receiverType) {
+			return nil, Error{Kind: ErrorKindTypeMismatch}
+		}
+		params = append(params, reflect.ValueOf(msg))
+	}
+	return params, nil
+}
+
+// convertRequest converts a decoded request value into the type expected by a
+// handler.
+func convertRequest(data interface{}, typ reflect.Type) (reflect.Value, error) {
+	if data == nil {
+		return reflect.Value{}, Error{Kind: ErrorKindTypeMismatch}
+	}
+	dataVal := reflect.ValueOf(data)
+	dataTyp := dataVal.Type()
+	if typ.Kind() == reflect.Pointer && dataTyp.Kind() != reflect.Pointer {
+		ptr := reflect.New(dataTyp)
+		ptr.Elem().Set(dataVal)
+		dataTyp = ptr.Type()
+		dataVal = ptr
+	}
+	if !dataTyp.ConvertibleTo(typ) {
+		return reflect.Value{}, Error{Kind: ErrorKindTypeMismatch}
+	}
+	return dataVal.Convert(typ), nil
 }
 
-func (c *srvConn) serviceStreamer(stream reflect.Value, h Header, done func()) {
-	errored := false
+// startReceiver creates a receiver of a given type, and starts decoding
+// streamed requests into it until the client ends the stream, an error
+// occurs, or stop is closed.
+func (c *srvConn) startReceiver(ctx context.Context, typ reflect.Type, h Header, stop <-chan struct{}) reflect.Value {
+	vPtr := reflect.New(typ)
+	itemType := typ.Field(1).Type.Elem()
+	vChan := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, itemType), 10)
+	var recvErr error
+	v := vPtr.Elem()
+	reflect.NewAt(v.Field(0).Type(), unsafe.Pointer(v.Field(0).UnsafeAddr())).Elem().Set(reflect.ValueOf(h))
+	reflect.NewAt(v.Field(1).Type(), unsafe.Pointer(v.Field(1).UnsafeAddr())).Elem().Set(vChan)
+	reflect.NewAt(v.Field(2).Type(), unsafe.Pointer(v.Field(2).UnsafeAddr())).Elem().Set(reflect.ValueOf(&recvErr))
+
+	go func() {
+		// recvErr is only read once vChan is closed.
+		defer vChan.Close()
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectSend, Chan: vChan},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stop)},
+		}
+		for {
+			t, data, err := c.reqCodec.decode(c.rw)
+			if err == nil && t == Void {
+				err = io.EOF
+			} else if err == nil {
+				cases[0].Send, err = convertRequest(data, itemType)
+			} else if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				recvErr = err
+				if err == io.EOF {
+					go c.awaitPeer(ctx, nil)
+				} else {
+					c.logDecodeError(err)
+					c.cancel()
+				}
+				return
+			}
+			if chosen, _, _ := reflect.Select(cases); chosen == 1 {
+				recvErr = io.EOF
+				return
+			}
+			if b := topLevelBlob(cases[0].Send); b.streaming() {
+				// Items following a streamed Blob can only be read once it
+				// is consumed.
+				select {
+				case <-b.done():
+				case <-stop:
+					recvErr = io.EOF
+					return
+				}
+			}
+		}
+	}()
+	return vPtr
+}
+
+// serviceStreamer delivers values pushed by a handler through stream, until
+// values is closed. Returns the first error returned by Push, after which the
+// handler is interrupted, and further values are discarded.
+func (c *srvConn) serviceStreamer(values reflect.Value, stream ServerStream) error {
+	var pushErr error
 	for {
-		v, ok := stream.Recv()
+		v, ok := values.Recv()
 		if !ok {
-			break
+			return pushErr
 		}
-		if errored {
+		if pushErr != nil {
 			continue
 		}
-		if c.state == connStateReceivedBody {
-			// Flush headers
-			if err := c.writeResponseHeader(h, true); err != nil {
-				c.handleError(err)
-				errored = true
-				continue
-			}
+		if pushErr = stream.Push(v.Interface()); pushErr != nil && c.cancel != nil {
+			c.cancel()
 		}
-		data, err := encode(v)
-		if err != nil {
-			c.handleError(err)
-			errored = true
-			continue
+	}
+}
+
+// writeStreamValue writes a value of a streamed response, preceded by the
+// response header in case it was not yet written.
+func (c *srvConn) writeStreamValue(h Header, v reflect.Value) error {
+	if c.state == connStateReceivedBody {
+		// Flush headers
+		if err := c.writeResponseHeader(h, true); err != nil {
+			return err
 		}
-		_, err = io.Copy(c.rw, bytes.NewBuffer(data))
-		if err != nil {
-			c.handleError(err)
-			errored = true
+	}
+	v, err := c.trimResponse(v)
+	if err != nil {
+		return err
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	enc := c.codec.streaming()
+	data, err := enc.appendEncode((*buf)[:0], v)
+	if err != nil {
+		return err
+	}
+	*buf = data
+	if _, err = c.rw.Write(data); err != nil {
+		return err
+	}
+	return enc.writeBlob(c.rw, v)
+}
+
+// finishStream ends a streamed response once its handler returns, given the
+// error it returned, if any. Clients supporting trailers receive the error
+// through a Trailer. For other clients, errors can only be reported before the
+// response header is written.
+func (c *srvConn) finishStream(ctx context.Context, h Header, err error) error {
+	if c.state == connStateClosed {
+		// Writing values failed, and the connection was closed.
+		return nil
+	}
+	if err != nil && !c.trailers {
+		return err
+	}
+	if c.state < connStateWritingResponse {
+		// Streams without values still provide a header.
+		if err := c.writeResponseHeader(h, true); err != nil {
+			return err
 		}
 	}
-	done()
+	if c.trailers {
+		if err := c.writeTrailer(ctx, err); err != nil {
+			return err
+		}
+	}
+	c.setState(connStateWroteResponse)
+	return nil
+}
+
+// writeTrailer writes the Trailer of a response, comprised of the headers set
+// by its handler through SetTrailer, and the error it returned, if any.
+func (c *srvConn) writeTrailer(ctx context.Context, err error) error {
+	t := Trailer{}
+	if setter, ok := ctx.Value(trailerContextKey).(*trailerSetter); ok {
+		t.Headers = setter.headers()
+	}
+	if err != nil {
+		managed := c.managedError(err)
+		t.Err = &managed
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	data, err := t.appendEncode((*buf)[:0])
+	if err != nil {
+		return err
+	}
+	*buf = data
+	_, err = c.rw.Write(data)
+	return err
+}
+
+// trimResponse returns a copy of a given response value holding only fields
+// included in the FieldMask provided by the client, if any. Values other than
+// messages are returned as-is.
+func (c *srvConn) trimResponse(v reflect.Value) (reflect.Value, error) {
+	if c.mask == nil || !v.IsValid() {
+		return v, nil
+	}
+	isPtr := v.Kind() == reflect.Pointer
+	base := v
+	if isPtr {
+		if v.IsNil() {
+			return v, nil
+		}
+		base = v.Elem()
+	}
+	if base.Kind() != reflect.Struct || !canEncodeStruct(base.Type()) {
+		return v, nil
+	}
+	masked, err := maskedCopy(base, NewProjection(c.mask.Paths...))
+	if err != nil {
+		return v, err
+	}
+	if isPtr {
+		ptr := reflect.New(base.Type())
+		ptr.Elem().Set(masked)
+		return ptr, nil
+	}
+	return masked, nil
 }
 
 func (c *srvConn) writeResponseHeader(headers Header, streaming bool) error {
-	data, err := Response{headers, streaming}.Encode()
+	if c.codec.version > WireVersion1 || c.trailers {
+		headers = headers.Clone()
+	}
+	if c.codec.version > WireVersion1 {
+		headers.Set(wireVersionHeader, c.codec.version.String())
+	}
+	if c.trailers {
+		headers.Set(trailersHeader, "1")
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	data, err := Response{headers, streaming}.appendEncode((*buf)[:0])
 	if err != nil {
 		return err
 	}
-	buf := bytes.NewReader(data)
-	_, err = io.Copy(c.rw, buf)
+	*buf = data
+	_, err = c.rw.Write(data)
 	if err == nil {
 		c.state = connStateWritingResponse
 	}
@@ -37,6 +37,21 @@ type ResponseTypeStreamer struct {
 func (i ResponseTypeStreamer) Headers() Header      { return i.h }
 func (i ResponseTypeStreamer) Push(v *ResponseType) { i.ch <- v }
 
+type RequestTypeReceiver struct {
+	h   Header
+	ch  <-chan *RequestType
+	err *error
+}
+
+func (i RequestTypeReceiver) Headers() Header { return i.h }
+func (i RequestTypeReceiver) Recv() (*RequestType, error) {
+	v, ok := <-i.ch
+	if !ok {
+		return nil, *i.err
+	}
+	return v, nil
+}
+
 func TestServerRegisterReflect(t *testing.T) {
 	t.Run("request, response, no stream", func(t *testing.T) {
 		handler := func(ctx context.Context, headers Header, req *RequestType) (Header, *ResponseType, error) {
@@ -102,14 +117,52 @@ func TestServerRegisterReflect(t *testing.T) {
 		assert.Zero(t, hnd.inType)
 		assert.Zero(t, hnd.outType)
 	})
+
+	t.Run("request stream, response, no stream", func(t *testing.T) {
+		handler := func(ctx context.Context, headers Header, req *RequestTypeReceiver) (Header, *ResponseType, error) {
+			return nil, nil, nil
+		}
+		s := NewServer("")
+		s.RegisterHandler(0, "", handler)
+		hnd := s.handlers[0].handler
+		assert.False(t, hnd.usesStreamer)
+		assert.Equal(t, reflect.TypeOf(RequestTypeReceiver{}), hnd.receiverType)
+		assert.Zero(t, hnd.inType)
+		assert.Equal(t, reflect.TypeOf(&ResponseType{}), hnd.outType)
+	})
+
+	t.Run("request stream, response, stream", func(t *testing.T) {
+		handler := func(ctx context.Context, headers Header, req *RequestTypeReceiver, res *ResponseTypeStreamer) error {
+			return nil
+		}
+		s := NewServer("")
+		s.RegisterHandler(0, "", handler)
+		hnd := s.handlers[0].handler
+		assert.True(t, hnd.usesStreamer)
+		assert.Equal(t, reflect.TypeOf(ResponseTypeStreamer{}), hnd.streamerType)
+		assert.Equal(t, reflect.TypeOf(RequestTypeReceiver{}), hnd.receiverType)
+		assert.Zero(t, hnd.inType)
+		assert.Zero(t, hnd.outType)
+	})
 }
 
 type fakeServer struct{}
 
-func (f fakeServer) headersTimeout() time.Duration                 { return 15 * time.Second }
-func (f fakeServer) handlerForID(u uint64) (*serviceHandler, bool) { return nil, false }
-func (f fakeServer) allMiddlewares() []Middleware                  { return nil }
-func (f fakeServer) notifyClosed(c *srvConn)                       {}
+func (f fakeServer) headersTimeout() time.Duration                   { return 15 * time.Second }
+func (f fakeServer) handlerForID(u uint64) (*serviceHandler, bool)   { return nil, false }
+func (f fakeServer) allMiddlewares() []Middleware                    { return nil }
+func (f fakeServer) allInterceptors() []Interceptor                  { return nil }
+func (f fakeServer) allStreamInterceptors() []StreamInterceptor      { return nil }
+func (f fakeServer) wireVersion() WireVersion                        { return LatestWireVersion }
+func (f fakeServer) multiplexing() bool                              { return false }
+func (f fakeServer) maxConcurrentStreams() int                       { return 0 }
+func (f fakeServer) muxIdleTimeout() time.Duration                   { return 0 }
+func (f fakeServer) maxHandlerTimeout(*serviceHandler) time.Duration { return 0 }
+func (f fakeServer) notifyClosed(c *srvConn)                         {}
+func (f fakeServer) reportError(r ErrorReport)                       {}
+func (f fakeServer) developmentMode() bool                           { return false }
+func (f fakeServer) logger() Logger                                  { return nopLogger{} }
+func (f fakeServer) slowRequestThreshold() time.Duration             { return 0 }
 
 func makeConnection() *srvConn {
 	r, w := net.Pipe()
@@ -138,7 +191,7 @@ func TestServerApplyReflect(t *testing.T) {
 		hnd := s.handlers[0].handler
 		c := makeConnection()
 		ctx := context.Background()
-		err := c.apply(hnd, ctx, map[string]string{"test": "yes"}, nil)
+		err := c.apply(hnd, &RPCRequest{ctx: ctx, Headers: map[string]string{"test": "yes"}}, nil)
 		require.NoError(t, err)
 		assert.True(t, invoked)
 	})
@@ -155,7 +208,7 @@ func TestServerApplyReflect(t *testing.T) {
 		hnd := s.handlers[0].handler
 		c := makeConnection()
 		ctx := context.Background()
-		err := c.apply(hnd, ctx, map[string]string{"test": "yes"}, &RequestType{})
+		err := c.apply(hnd, &RPCRequest{ctx: ctx, Headers: map[string]string{"test": "yes"}}, &RequestType{})
 		assert.NoError(t, err)
 		assert.True(t, invoked)
 	})
@@ -172,7 +225,7 @@ func TestServerApplyReflect(t *testing.T) {
 		hnd := s.handlers[0].handler
 		c := makeConnection()
 		ctx := context.Background()
-		err := c.apply(hnd, ctx, map[string]string{"test": "yes"}, nil)
+		err := c.apply(hnd, &RPCRequest{ctx: ctx, Headers: map[string]string{"test": "yes"}}, nil)
 		assert.NoError(t, err)
 		assert.True(t, invoked)
 	})
@@ -234,3 +287,167 @@ func TestFullServer(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, int32(1), val.ID)
 }
+
+func TestFullServerWireVersion(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	srv := SimpleServerImpl{}
+	s := NewServer(l.Addr().String())
+	RegisterSimpleService(s, &srv)
+	go func() {
+		_ = s.StartListener(l)
+	}()
+	RegisterMessages()
+	c := NewSimpleServiceClient(l.Addr().String(), WithWireVersion(WireVersion2))
+	res, headers, err := c.DeregisterUser(context.Background(), &SimpleRequest{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "2", headers.Get(wireVersionHeader))
+	assert.Equal(t, int32(0), res.ID)
+
+	res, _, err = c.DeregisterUser(context.Background(), &SimpleRequest{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(-1), res.ID)
+}
+
+type SimpleResponseContextStreamer struct {
+	h   Header
+	ch  chan<- *SimpleResponse
+	ctx context.Context
+}
+
+func (i SimpleResponseContextStreamer) Headers() Header { return i.h }
+func (i SimpleResponseContextStreamer) Push(v *SimpleResponse) error {
+	select {
+	case i.ch <- v:
+		return nil
+	case <-i.ctx.Done():
+		return i.ctx.Err()
+	}
+}
+
+func TestHandlerCancellation(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	started, finished := make(chan struct{}, 1), make(chan error, 1)
+	s := NewServer(l.Addr().String(), WithMultiplexing())
+	s.RegisterHandler(0x1, "io.vito.Cancel.wait", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		finished <- ctx.Err()
+		return nil, nil, ctx.Err()
+	})
+	s.RegisterHandler(0x2, "io.vito.Cancel.push", func(ctx context.Context, headers Header, req *SimpleRequest, out *SimpleResponseContextStreamer) error {
+		started <- struct{}{}
+		for i := 0; ; i++ {
+			if err := out.Push(&SimpleResponse{ID: int32(i)}); err != nil {
+				finished <- err
+				return err
+			}
+		}
+	})
+	go func() {
+		_ = s.StartListener(l)
+	}()
+
+	clients := map[string]*Client{
+		"dedicated":   NewClient(l.Addr().String()),
+		"multiplexed": NewClient(l.Addr().String(), WithMultiplexing()),
+	}
+	for name, c := range clients {
+		c := c
+		t.Cleanup(func() {
+			_ = c.Close()
+		})
+		t.Run(name, func(t *testing.T) {
+			t.Run("unary", func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				go func() {
+					<-started
+					cancel()
+				}()
+				_, _, err := c.DoRequest(ctx, Request{Method: 0x1}, &SimpleRequest{})
+				assert.Equal(t, context.Canceled, err)
+				select {
+				case err := <-finished:
+					assert.Equal(t, context.Canceled, err)
+				case <-time.After(5 * time.Second):
+					t.Fatal("handler was not cancelled")
+				}
+			})
+
+			t.Run("stream", func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				ch, _, err := c.DoRequestStreamed(ctx, Request{Method: 0x2}, &SimpleRequest{})
+				require.NoError(t, err)
+				<-started
+				for i := 0; i < 3; i++ {
+					v := <-ch
+					assert.Equal(t, int32(i), v.(*SimpleResponse).ID)
+				}
+				cancel()
+				select {
+				case err := <-finished:
+					assert.Error(t, err)
+				case <-time.After(5 * time.Second):
+					t.Fatal("Push did not fail")
+				}
+				for range ch {
+				}
+			})
+		})
+	}
+
+	t.Run("registration", func(t *testing.T) {
+		hnd := s.handlers[0x2].handler
+		assert.True(t, hnd.usesStreamer)
+		assert.Equal(t, reflect.TypeOf(SimpleResponseContextStreamer{}), hnd.streamerType)
+	})
+}
+
+// startUnaryServer starts a Server with a single unary method 0x1, returning
+// both response headers and a response value.
+func startUnaryServer(t *testing.T) *Client {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	s := NewServer(l.Addr().String())
+	s.RegisterHandler(0x1, "io.vito.Unary.echo", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		return Header{"Name": req.Name}, &SimpleResponse{ID: 7}, nil
+	})
+	go func() {
+		_ = s.StartListener(l)
+	}()
+	return NewClient(l.Addr().String())
+}
+
+func TestUnaryHandlerReturnValues(t *testing.T) {
+	// Handlers return their headers first, followed by the response value.
+	c := startUnaryServer(t)
+	res, headers, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &SimpleRequest{Name: "Vito"})
+	require.NoError(t, err)
+	assert.Equal(t, "Vito", Header(headers).Get("Name"))
+	assert.Equal(t, int32(7), res.(*SimpleResponse).ID)
+}
+
+func TestDoRequestReturnsDecodedValue(t *testing.T) {
+	// DoRequest returns the decoded value itself, rather than a pointer to
+	// an interface holding it.
+	c := startUnaryServer(t)
+	res, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &SimpleRequest{})
+	require.NoError(t, err)
+	assert.IsType(t, &SimpleResponse{}, res)
+}
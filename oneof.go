@@ -15,24 +15,51 @@ type OneOfValue struct {
 	Data  interface{}
 }
 
-func encodeOneOf(ov *OneOfValue) ([]byte, error) {
-	if t := reflect.TypeOf(ov.Data); !canEncode(t) {
-		return nil, fmt.Errorf("cannot encode value of type %s", t)
-	}
+var reflectedOneOfValue = reflect.TypeOf(&OneOfValue{})
+
+func (c codec) encodeOneOf(ov *OneOfValue) ([]byte, error) {
+	return c.appendOneOf(nil, ov)
+}
 
-	rv := reflect.ValueOf(ov.Data)
-	v, err := encode(rv)
+func (c codec) appendOneOf(dst []byte, ov *OneOfValue) ([]byte, error) {
+	size, err := c.oneOfBodySize(ov)
 	if err != nil {
 		return nil, err
 	}
-	idx := encodeUint(uint64(ov.Index))
-	v = append(idx, v...)
-	head := encodeInteger(uint64(len(v)))
-	head[0] |= 0xE0
-	return append(head, v...), nil
+	if size == 0 {
+		// No member is set; an empty oneof is decoded as nil.
+		return append(dst, 0xE0), nil
+	}
+	dst = appendInteger(dst, uint64(size), 0xE0)
+	dst = appendUint(dst, uint64(ov.Index))
+	return c.appendEncode(dst, reflect.ValueOf(ov.Data))
+}
+
+func (c codec) sizeOneOf(ov *OneOfValue) (int, error) {
+	size, err := c.oneOfBodySize(ov)
+	if err != nil || size == 0 {
+		return 1, err
+	}
+	return sizeInteger(uint64(size)) + size, nil
+}
+
+// oneOfBodySize returns the amount of bytes required to encode ov's index and
+// value, or zero, in case no member is set.
+func (c codec) oneOfBodySize(ov *OneOfValue) (int, error) {
+	if ov.Data == nil {
+		return 0, nil
+	}
+	if t := reflect.TypeOf(ov.Data); !canEncode(t) {
+		return 0, fmt.Errorf("cannot encode value of type %s", t)
+	}
+	size, err := c.size(reflect.ValueOf(ov.Data))
+	if err != nil {
+		return 0, err
+	}
+	return sizeInteger(uint64(ov.Index)) + size, nil
 }
 
-func decodeOneOf(header byte, r io.Reader) (*OneOfValue, error) {
+func (c codec) decodeOneOf(header byte, r io.Reader) (*OneOfValue, error) {
 	_, size, err := decodeScalar(header, r)
 	if err != nil {
 		return nil, err
@@ -51,7 +78,7 @@ func decodeOneOf(header byte, r io.Reader) (*OneOfValue, error) {
 	if err != nil {
 		return nil, err
 	}
-	_, val, err := Decode(reader)
+	_, val, err := c.decode(reader)
 	if err != nil {
 		return nil, err
 	}
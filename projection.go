@@ -0,0 +1,194 @@
+package yarp
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// Projection represents a set of fields to be decoded from a struct. Fields
+// absent from a Projection are skipped using the length prefixes present in
+// the stream, without being decoded. See NewProjection and DecodeFields.
+type Projection struct {
+	fields map[int]*Projection
+}
+
+// NewProjection creates a new Projection including all provided paths. Each
+// path is a list of field indexes, in which each item after the first one
+// refers to a field of the struct held by the previous one. For instance,
+// []int{1, 0} includes only the first field of the struct held by the second
+// field of the decoded struct. A path comprised of a single index includes the
+// whole field, along with all its contents.
+func NewProjection(paths ...[]int) *Projection {
+	p := &Projection{fields: map[int]*Projection{}}
+	for _, path := range paths {
+		p.include(path)
+	}
+	return p
+}
+
+func (p *Projection) include(path []int) {
+	if len(path) == 0 {
+		return
+	}
+	nested, ok := p.fields[path[0]]
+	if ok && nested == nil {
+		// The whole field is already included.
+		return
+	}
+	if len(path) == 1 {
+		p.fields[path[0]] = nil
+		return
+	}
+	if nested == nil {
+		nested = &Projection{fields: map[int]*Projection{}}
+		p.fields[path[0]] = nested
+	}
+	nested.include(path[1:])
+}
+
+// field indicates whether a given field index is included by the receiver,
+// and returns a nested Projection, in case only part of the field should be
+// decoded. A nil receiver includes all fields.
+func (p *Projection) field(index int) (*Projection, bool) {
+	if p == nil {
+		return nil, true
+	}
+	nested, ok := p.fields[index]
+	return nested, ok
+}
+
+// Decode reads a single struct from r, and decodes all fields included in the
+// receiver into dst, which must be a pointer to a struct of the same type as
+// the one present in the stream. Fields not included in the Projection are
+// left untouched. Returns ErrStructTypeMismatch in case the stream contains a
+// different struct type. Like Decode, it expects values written using
+// WireVersion1; use DecodeVersion to read values written using other versions.
+func (p *Projection) Decode(r io.Reader, dst StructValuer) error {
+	return p.decode(defaultCodec, r, dst)
+}
+
+// DecodeVersion works like Decode, but reads r expecting values written using
+// the provided wire version.
+func (p *Projection) DecodeVersion(r io.Reader, dst StructValuer, version WireVersion) error {
+	if version < WireVersion1 || version > LatestWireVersion {
+		return ErrUnsupportedWireVersion
+	}
+	return p.decode(newCodec(version), r, dst)
+}
+
+func (p *Projection) decode(c codec, r io.Reader, dst StructValuer) (err error) {
+	defer func() {
+		if rawErr := recover(); rawErr != nil {
+			if innerErr, ok := rawErr.(error); ok {
+				err = innerErr
+				return
+			}
+
+			err = fmt.Errorf("unexpected error during decode operation: %s", rawErr)
+		}
+	}()
+
+	into := reflect.ValueOf(dst)
+	if into.Kind() != reflect.Pointer || into.IsNil() || into.Elem().Kind() != reflect.Struct {
+		return ErrIncompatibleStruct
+	}
+	header := []byte{0x00}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if detectType(header[0]) != Struct {
+		return ErrStructTypeMismatch
+	}
+	str, err := c.decodeProjectedStruct(header[0], r, p)
+	if err != nil {
+		return err
+	}
+	if str.id != dst.YarpID() {
+		return ErrStructTypeMismatch
+	}
+	return applyStruct(into.Elem(), str, false)
+}
+
+// DecodeFields reads a single struct from r, decoding only fields identified
+// by the provided indexes into dst. See Projection.Decode.
+func DecodeFields(r io.Reader, dst StructValuer, indexes ...int) error {
+	return fieldsProjection(indexes).Decode(r, dst)
+}
+
+// DecodeFieldsVersion works like DecodeFields, but reads r expecting values
+// written using the provided wire version.
+func DecodeFieldsVersion(r io.Reader, dst StructValuer, version WireVersion, indexes ...int) error {
+	return fieldsProjection(indexes).DecodeVersion(r, dst, version)
+}
+
+// fieldsProjection returns a Projection including each of the provided field
+// indexes as a whole.
+func fieldsProjection(indexes []int) *Projection {
+	paths := make([][]int, len(indexes))
+	for i, idx := range indexes {
+		paths[i] = []int{idx}
+	}
+	return NewProjection(paths...)
+}
+
+// decodeNestedProjection decodes a value from r, applying p in case it is a
+// struct. Other types are decoded as a whole.
+func (c codec) decodeNestedProjection(r io.Reader, p *Projection) (Type, interface{}, error) {
+	header := []byte{0x00}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Invalid, nil, err
+	}
+	if detectType(header[0]) != Struct {
+		return c.decodeWithHeader(header, r)
+	}
+	v, err := c.decodeProjectedConcrete(header[0], r, p)
+	return Struct, v, err
+}
+
+// Skip reads and discards a single value from r. Arrays, structs, strings,
+// maps and oneofs are skipped as a whole using their length prefixes, without
+// decoding their contents. Returns io.EOF in case r has no more values.
+func Skip(r io.Reader) error {
+	header := []byte{0x00}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	switch detectType(header[0]) {
+	case Void:
+		return nil
+	case Scalar:
+		_, _, err := decodeScalar(header[0], r)
+		return unexpectedEOF(err)
+	case Float:
+		if header[0]&0x8 == 0x8 {
+			return nil
+		}
+		if header[0]&0x10 == 0x10 {
+			return discard(r, 8)
+		}
+		return discard(r, 4)
+	case Array, Struct, String, Map, OneOf:
+		if header[0] == 0xB0 {
+			return skipBlob(r)
+		}
+		_, size, err := decodeScalar(header[0], r)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if size >= sizeLimit {
+			return ErrSizeTooLarge
+		}
+		return discard(r, size)
+	default:
+		return ErrInvalidType
+	}
+}
+
+func discard(r io.Reader, size uint64) error {
+	n, err := io.CopyN(io.Discard, r, int64(size))
+	if err == io.EOF || (err == nil && uint64(n) < size) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package yarp
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func projectionFixture(t *testing.T) []byte {
+	b := 10
+	data, err := Encode(TS{
+		ID:      1,
+		Name:    "Vito",
+		Email:   "hey@vito.io",
+		Keys:    []string{"a", "b"},
+		Other:   []OtherTS{{Project: "Foo", Role: "Bar"}},
+		AMap:    map[string]int{"a": 1},
+		OneOfB:  &b,
+		IsAdmin: true,
+		SingleOther: OtherTS{
+			Project: "Fuz",
+			Role:    "Baz",
+		},
+	})
+	require.NoError(t, err)
+	return data
+}
+
+func TestDecodeFields(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(TS{}, OtherTS{})
+	data := projectionFixture(t)
+
+	v := &TS{}
+	err := DecodeFields(bytes.NewReader(data), v, 1, 6, 8)
+	require.NoError(t, err)
+	assert.Zero(t, v.ID)
+	assert.Equal(t, "Vito", v.Name)
+	assert.Empty(t, v.Email)
+	assert.Nil(t, v.Keys)
+	assert.Nil(t, v.AMap)
+	require.NotNil(t, v.OneOfB)
+	assert.Equal(t, 10, *v.OneOfB)
+	assert.True(t, v.HasOneOfB)
+	assert.False(t, v.IsAdmin)
+	assert.Equal(t, "Fuz", v.SingleOther.Project)
+	assert.Equal(t, "Baz", v.SingleOther.Role)
+	assert.Empty(t, v.UnknownFields)
+
+	err = DecodeFields(bytes.NewReader(data), &OtherTS{}, 0)
+	assert.ErrorIs(t, err, ErrStructTypeMismatch)
+}
+
+func TestProjectionNested(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(TS{}, OtherTS{})
+	data := projectionFixture(t)
+
+	v := &TS{}
+	p := NewProjection([]int{0}, []int{8, 1})
+	require.NoError(t, p.Decode(bytes.NewReader(data), v))
+	assert.Equal(t, 1, v.ID)
+	assert.Empty(t, v.Name)
+	assert.Empty(t, v.SingleOther.Project)
+	assert.Equal(t, "Baz", v.SingleOther.Role)
+}
+
+func TestDecodeFieldsVersion(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(TS{}, OtherTS{})
+	b := -7
+	data, err := EncodeVersion(TS{
+		ID:      -1,
+		Name:    "Vito",
+		AMap:    map[string]int{"a": -3},
+		OneOfB:  &b,
+		IsAdmin: true,
+	}, LatestWireVersion)
+	require.NoError(t, err)
+
+	v := &TS{}
+	err = DecodeFieldsVersion(bytes.NewReader(data), v, LatestWireVersion, 0, 5, 6)
+	require.NoError(t, err)
+	assert.Equal(t, -1, v.ID)
+	assert.Empty(t, v.Name)
+	assert.Equal(t, map[string]int{"a": -3}, v.AMap)
+	require.NotNil(t, v.OneOfB)
+	assert.Equal(t, -7, *v.OneOfB)
+	assert.False(t, v.IsAdmin)
+
+	v = &TS{}
+	p := NewProjection([]int{0})
+	require.NoError(t, p.DecodeVersion(bytes.NewReader(data), v, LatestWireVersion))
+	assert.Equal(t, -1, v.ID)
+
+	err = p.DecodeVersion(bytes.NewReader(data), v, LatestWireVersion+1)
+	assert.Equal(t, ErrUnsupportedWireVersion, err)
+}
+
+func TestSkip(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(TS{}, OtherTS{})
+	data := projectionFixture(t)
+	tail, err := Encode("tail")
+	require.NoError(t, err)
+	data = append(data, tail...)
+
+	r := bytes.NewReader(data)
+	require.NoError(t, Skip(r))
+	_, v, err := Decode(r)
+	require.NoError(t, err)
+	assert.Equal(t, "tail", v)
+	assert.Equal(t, io.EOF, Skip(r))
+
+	assert.Equal(t, io.ErrUnexpectedEOF, Skip(bytes.NewReader(data[:10])))
+}
@@ -0,0 +1,208 @@
+package yarp
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// RawMessage represents a single encoded YARP value. When used as a struct
+// field, or as the element type of a slice field, the decoder captures the
+// exact bytes of the value instead of decoding it, and the encoder writes it
+// back verbatim. This allows a given payload to be forwarded without being
+// decoded and re-encoded, and to be decoded at a later moment through Decode.
+// RawMessage values are spliced as-is, and are therefore expected to be
+// encoded using the same wire version used by the enclosing message, which
+// must also be provided to DecodeVersion when decoding them. Void
+// values are represented by an empty RawMessage, and vice versa.
+type RawMessage []byte
+
+var reflectedRawMessage = reflect.TypeOf(RawMessage{})
+var reflectedRawMessageSlice = reflect.TypeOf([]RawMessage{})
+
+// Type returns the type of the value held by the RawMessage, or Invalid, in
+// case it is empty.
+func (m RawMessage) Type() Type {
+	if len(m) == 0 {
+		return Invalid
+	}
+	return detectType(m[0])
+}
+
+// Decode decodes the value held by the RawMessage using WireVersion1. See
+// Decode.
+func (m RawMessage) Decode() (Type, interface{}, error) {
+	return Decode(bytes.NewReader(m))
+}
+
+// DecodeVersion decodes the value held by the RawMessage using a given wire
+// version, which must be the one used to encode the message it was captured
+// from. See DecodeVersion.
+func (m RawMessage) DecodeVersion(version WireVersion) (Type, interface{}, error) {
+	return DecodeVersion(bytes.NewReader(m), version)
+}
+
+// rawMessage returns raw as a RawMessage, mapping Void values to nil so that
+// they survive a round-trip through the encoder.
+func rawMessage(raw []byte) RawMessage {
+	if detectType(raw[0]) == Void {
+		return nil
+	}
+	return raw
+}
+
+// readRaw reads a single value from r, returning its encoded representation
+// without decoding it. Returns io.EOF in case r has no more values.
+func readRaw(r io.Reader) ([]byte, error) {
+	header := []byte{0x00}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	return readRawWithHeader(header[0], r)
+}
+
+// readRawWithHeader works like readRaw, but takes a header that was already
+// consumed from r.
+func readRawWithHeader(header byte, r io.Reader) ([]byte, error) {
+	data := []byte{header}
+	switch detectType(header) {
+	case Void:
+		return data, nil
+	case Scalar:
+		data, _, err := readRawInteger(data, r)
+		return data, err
+	case Float:
+		if header&0x8 == 0x8 {
+			return data, nil
+		}
+		size := 4
+		if header&0x10 == 0x10 {
+			size = 8
+		}
+		return readRawBytes(data, r, uint64(size))
+	case Array, Struct, String, Map, OneOf:
+		data, size, err := readRawInteger(data, r)
+		if err != nil {
+			return nil, err
+		}
+		if size >= sizeLimit {
+			return nil, ErrSizeTooLarge
+		}
+		return readRawBytes(data, r, size)
+	default:
+		return nil, ErrInvalidType
+	}
+}
+
+// readRawInteger reads the remaining bytes of an integer whose header is the
+// last byte of data, appending them to data. Returns the updated slice along
+// with the decoded value.
+func readRawInteger(data []byte, r io.Reader) ([]byte, uint64, error) {
+	header := data[len(data)-1]
+	value := uint64(header&0xE) >> 1
+	if header&0x1 != 0x1 {
+		return data, value, nil
+	}
+	b := []byte{0x00}
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, 0, unexpectedEOF(err)
+		}
+		data = append(data, b[0])
+		value = value<<7 | uint64(b[0])>>1
+		if b[0]&0x01 != 0x01 {
+			break
+		}
+	}
+	return data, value, nil
+}
+
+func readRawBytes(data []byte, r io.Reader, size uint64) ([]byte, error) {
+	start := len(data)
+	data = append(data, make([]byte, size)...)
+	if _, err := io.ReadFull(r, data[start:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return data, nil
+}
+
+// unexpectedEOF converts io.EOF into io.ErrUnexpectedEOF, for cases in which a
+// value was only partially read.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// splitRawArray takes an encoded array and returns each of its items as a
+// RawMessage.
+func splitRawArray(raw []byte) ([]interface{}, error) {
+	r := bytes.NewReader(raw[1:])
+	if _, _, err := decodeScalar(raw[0], r); err != nil {
+		return nil, err
+	}
+	var items []interface{}
+	for {
+		item, err := readRaw(r)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		items = append(items, rawMessage(item))
+	}
+	return items, nil
+}
+
+// rawFieldsOf returns the indexes of fields in t holding either RawMessage or
+// []RawMessage values, mapped to their types.
+func rawFieldsOf(t reflect.Type) map[int]reflect.Type {
+	if fields, ok := rawFieldsCache.Load(t); ok {
+		return fields.(map[int]reflect.Type)
+	}
+	fields := extractRawFields(t)
+	rawFieldsCache.Store(t, fields)
+	return fields
+}
+
+func extractRawFields(t reflect.Type) map[int]reflect.Type {
+	var fields map[int]reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type != reflectedRawMessage && f.Type != reflectedRawMessageSlice {
+			continue
+		}
+		tag, ok := f.Tag.Lookup("index")
+		if !ok || strings.ContainsRune(tag, ',') {
+			continue
+		}
+		idx, err := strconv.Atoi(tag)
+		if err != nil {
+			continue
+		}
+		if fields == nil {
+			fields = map[int]reflect.Type{}
+		}
+		fields[idx] = f.Type
+	}
+	return fields
+}
+
+// decodeRawField reads a single value from r into a RawMessage, or, in case
+// t is []RawMessage, into a list of RawMessage items.
+func decodeRawField(t reflect.Type, r io.Reader) (Type, interface{}, error) {
+	raw, err := readRaw(r)
+	if err != nil {
+		return Invalid, nil, err
+	}
+	kind := detectType(raw[0])
+	if t == reflectedRawMessageSlice && kind == Array {
+		items, err := splitRawArray(raw)
+		return kind, items, err
+	}
+	return kind, rawMessage(raw), nil
+}
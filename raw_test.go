@@ -0,0 +1,146 @@
+package yarp
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type Envelope struct {
+	*Structure
+	Route   string       `index:"0"`
+	Payload RawMessage   `index:"1"`
+	Parts   []RawMessage `index:"2"`
+}
+
+func (Envelope) YarpID() uint64         { return 0x4 }
+func (Envelope) YarpPackage() string    { return "io.vito" }
+func (Envelope) YarpStructName() string { return "Envelope" }
+
+func TestRawMessage(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(Envelope{}, OtherTS{})
+
+	payload, err := Encode(OtherTS{Project: "Foo", Role: "Bar"})
+	require.NoError(t, err)
+	partA, err := Encode(-1)
+	require.NoError(t, err)
+	partB, err := Encode(map[string]float64{"pi": 3.14})
+	require.NoError(t, err)
+
+	data, err := Encode(Envelope{
+		Route:   "a.b",
+		Payload: payload,
+		Parts:   []RawMessage{partA, partB},
+	})
+	require.NoError(t, err)
+
+	_, decoded, err := Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	env := decoded.(*Envelope)
+	assert.Equal(t, "a.b", env.Route)
+	assert.Equal(t, RawMessage(payload), env.Payload)
+	assert.Equal(t, Struct, env.Payload.Type())
+	require.Len(t, env.Parts, 2)
+	assert.Equal(t, RawMessage(partA), env.Parts[0])
+	assert.Equal(t, RawMessage(partB), env.Parts[1])
+	assert.Empty(t, env.UnknownFields)
+
+	ty, inner, err := env.Payload.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, Struct, ty)
+	assert.Equal(t, "Foo", inner.(*OtherTS).Project)
+
+	reencoded, err := Encode(env)
+	require.NoError(t, err)
+	assert.Equal(t, data, reencoded)
+}
+
+func TestReadRaw(t *testing.T) {
+	values := []interface{}{
+		nil, 0, -1, uint64(1 << 40), true, float32(0), float32(1.5), 2.5,
+		"hello", []string{"a", "b"}, map[string]int{"a": 1},
+	}
+	var stream []byte
+	var encoded [][]byte
+	for _, v := range values {
+		var data []byte
+		if v == nil {
+			data = encodeVoid()
+		} else {
+			var err error
+			data, err = Encode(v)
+			require.NoError(t, err)
+		}
+		encoded = append(encoded, data)
+		stream = append(stream, data...)
+	}
+
+	r := bytes.NewReader(stream)
+	for _, want := range encoded {
+		raw, err := readRaw(r)
+		require.NoError(t, err)
+		assert.Equal(t, want, raw)
+	}
+	_, err := readRaw(r)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRawMessageVoid(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(Envelope{}, OtherTS{})
+
+	part, err := Encode(1)
+	require.NoError(t, err)
+	env := Envelope{Route: "a.b", Parts: []RawMessage{nil, part}}
+	data, err := Encode(env)
+	require.NoError(t, err)
+
+	_, decoded, err := Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	got := decoded.(*Envelope)
+	assert.Nil(t, got.Payload)
+	assert.Equal(t, Invalid, got.Payload.Type())
+	require.Len(t, got.Parts, 2)
+	assert.Nil(t, got.Parts[0])
+	assert.Equal(t, RawMessage(part), got.Parts[1])
+
+	reencoded, err := Encode(got)
+	require.NoError(t, err)
+	assert.Equal(t, data, reencoded)
+}
+
+func TestRawMessageDecodeVersion(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(Envelope{}, OtherTS{})
+
+	part, err := EncodeVersion(-42, LatestWireVersion)
+	require.NoError(t, err)
+	data, err := EncodeVersion(Envelope{Route: "a.b", Parts: []RawMessage{part}}, LatestWireVersion)
+	require.NoError(t, err)
+
+	_, decoded, err := DecodeVersion(bytes.NewReader(data), LatestWireVersion)
+	require.NoError(t, err)
+	got := decoded.(*Envelope)
+	require.Len(t, got.Parts, 1)
+	ty, v, err := got.Parts[0].DecodeVersion(LatestWireVersion)
+	require.NoError(t, err)
+	assert.Equal(t, Scalar, ty)
+	assert.Equal(t, int64(-42), v)
+
+	_, _, err = got.Parts[0].DecodeVersion(LatestWireVersion + 1)
+	assert.ErrorIs(t, err, ErrUnsupportedWireVersion)
+}
+
+func TestRawFieldsCache(t *testing.T) {
+	typ := reflect.TypeOf(Envelope{})
+	fields := rawFieldsOf(typ)
+	assert.Equal(t, map[int]reflect.Type{1: reflectedRawMessage, 2: reflectedRawMessageSlice}, fields)
+	cached, ok := rawFieldsCache.Load(typ)
+	require.True(t, ok)
+	assert.Equal(t, fields, cached)
+	assert.Nil(t, rawFieldsOf(reflect.TypeOf(OtherTS{})))
+}
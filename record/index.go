@@ -0,0 +1,82 @@
+package record
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+const indexEntrySize = 16
+
+// IndexPath returns the path of the index maintained by Append for the record
+// file at path.
+func IndexPath(path string) string {
+	return path + ".idx"
+}
+
+// IndexEntry represents the offset of a given record within a file.
+type IndexEntry struct {
+	Record uint64
+	Offset int64
+}
+
+// Index represents a sparse index of a record file. Indexes are comprised of
+// IndexEntry values, each one encoded as two 64-bit little-endian integers.
+type Index struct {
+	Entries []IndexEntry
+}
+
+// ReadIndex reads an Index from r. A trailing entry that was only partially
+// written is ignored.
+func ReadIndex(r io.Reader) (*Index, error) {
+	idx := &Index{}
+	entry := make([]byte, indexEntrySize)
+	for {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return idx, nil
+			}
+			return nil, err
+		}
+		e := IndexEntry{
+			Record: binary.LittleEndian.Uint64(entry),
+			Offset: int64(binary.LittleEndian.Uint64(entry[8:])),
+		}
+		// Entries may only be appended in order; anything else indicates
+		// corruption, and is discarded along with what follows it.
+		if last, ok := idx.last(); ok && (e.Record <= last.Record || e.Offset <= last.Offset) {
+			return idx, nil
+		}
+		idx.Entries = append(idx.Entries, e)
+	}
+}
+
+func (i *Index) last() (IndexEntry, bool) {
+	if i == nil || len(i.Entries) == 0 {
+		return IndexEntry{}, false
+	}
+	return i.Entries[len(i.Entries)-1], true
+}
+
+// Lookup returns the entry for the closest record preceding or matching n.
+// Returns false in case no such entry exists.
+func (i *Index) Lookup(n uint64) (IndexEntry, bool) {
+	if i == nil {
+		return IndexEntry{}, false
+	}
+	pos := sort.Search(len(i.Entries), func(j int) bool {
+		return i.Entries[j].Record > n
+	})
+	if pos == 0 {
+		return IndexEntry{}, false
+	}
+	return i.Entries[pos-1], true
+}
+
+func writeIndexEntry(w io.Writer, e IndexEntry) error {
+	entry := make([]byte, indexEntrySize)
+	binary.LittleEndian.PutUint64(entry, e.Record)
+	binary.LittleEndian.PutUint64(entry[8:], uint64(e.Offset))
+	_, err := w.Write(entry)
+	return err
+}
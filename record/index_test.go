@@ -0,0 +1,46 @@
+package record
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	buf := &bytes.Buffer{}
+	entries := []IndexEntry{{10, 100}, {20, 200}, {30, 300}}
+	for _, e := range entries {
+		require.NoError(t, writeIndexEntry(buf, e))
+	}
+	// Partially written entry
+	buf.Write([]byte{0x01, 0x02})
+
+	idx, err := ReadIndex(buf)
+	require.NoError(t, err)
+	assert.Equal(t, entries, idx.Entries)
+
+	_, ok := idx.Lookup(9)
+	assert.False(t, ok)
+	e, ok := idx.Lookup(10)
+	assert.True(t, ok)
+	assert.Equal(t, entries[0], e)
+	e, ok = idx.Lookup(29)
+	assert.True(t, ok)
+	assert.Equal(t, entries[1], e)
+	e, ok = idx.Lookup(1000)
+	assert.True(t, ok)
+	assert.Equal(t, entries[2], e)
+
+	_, ok = (*Index)(nil).Lookup(10)
+	assert.False(t, ok)
+}
+
+func TestIndexOutOfOrder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeIndexEntry(buf, IndexEntry{20, 200}))
+	require.NoError(t, writeIndexEntry(buf, IndexEntry{10, 300}))
+	idx, err := ReadIndex(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []IndexEntry{{20, 200}}, idx.Entries)
+}
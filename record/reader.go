@@ -0,0 +1,296 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/OneOfOne/xxhash"
+	"github.com/libyarp/yarp"
+	"io"
+	"os"
+)
+
+// errCorrupt indicates that the current record is invalid, and the reader
+// must resynchronise.
+var errCorrupt = fmt.Errorf("corrupt record")
+
+// Reader reads records from a record file. Records that fail validation are
+// skipped by scanning for the next sync marker, and are only accounted for by
+// Skipped. Record numbers only take into account records that could be read.
+type Reader struct {
+	r       io.Reader
+	br      *bufio.Reader
+	version yarp.WireVersion
+	index   *Index
+	closer  io.Closer
+
+	// pending holds bytes already read from br that must be consumed
+	// before reading from it again, after resynchronising.
+	pending []byte
+	frame   []byte
+	offset  int64
+	record  uint64
+	skipped int
+}
+
+// NewReader returns a new Reader reading records from r, after validating the
+// file header.
+func NewReader(r io.Reader) (*Reader, error) {
+	version, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return newReader(r, version, recordStartSize), nil
+}
+
+func newReader(r io.Reader, version yarp.WireVersion, offset int64) *Reader {
+	return &Reader{
+		r:       r,
+		br:      bufio.NewReader(r),
+		version: version,
+		offset:  offset,
+	}
+}
+
+// Open opens the record file at path for reading, along with its index, in
+// case one exists. See IndexPath.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.closer = f
+
+	idx, err := os.Open(IndexPath(path))
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		f.Close()
+		return nil, err
+	}
+	defer idx.Close()
+	if r.index, err = ReadIndex(idx); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// WireVersion returns the wire version used by messages in the file.
+func (r *Reader) WireVersion() yarp.WireVersion {
+	return r.version
+}
+
+// SetIndex determines the Index used by Seek.
+func (r *Reader) SetIndex(idx *Index) {
+	r.index = idx
+}
+
+// Record returns the number of the next record to be read.
+func (r *Reader) Record() uint64 {
+	return r.record
+}
+
+// Skipped returns how many times the Reader had to skip invalid data.
+func (r *Reader) Skipped() int {
+	return r.skipped
+}
+
+// Next returns the contents of the next record. Returns io.EOF once all
+// records were read, or ErrTruncated in case the file ends with a partial
+// record.
+func (r *Reader) Next() ([]byte, error) {
+	for {
+		data, err := r.readFrame()
+		if err == nil {
+			r.record++
+			return data, nil
+		}
+		if err != errCorrupt {
+			return nil, err
+		}
+		if err = r.resync(); err != nil {
+			return nil, err
+		}
+		r.skipped++
+	}
+}
+
+// Read decodes the next record. See Next.
+func (r *Reader) Read() (interface{}, error) {
+	data, err := r.Next()
+	if err != nil {
+		return nil, err
+	}
+	_, v, err := yarp.DecodeVersion(bytes.NewReader(data), r.version)
+	return v, err
+}
+
+// Seek moves the Reader to the record numbered n, using the closest entry of
+// its Index, if any, and reading records from there. The underlying reader
+// must implement io.Seeker. Returns io.EOF in case the file has less than n
+// records.
+func (r *Reader) Seek(n uint64) error {
+	s, ok := r.r.(io.Seeker)
+	if !ok {
+		return ErrNotSeekable
+	}
+	entry, ok := r.index.Lookup(n)
+	if !ok {
+		entry = IndexEntry{Offset: recordStartSize}
+	}
+	if _, err := s.Seek(entry.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.br.Reset(r.r)
+	r.pending = nil
+	r.offset = entry.Offset
+	r.record = entry.Record
+	for r.record < n {
+		if _, err := r.Next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the file opened by Open. It is a no-op for Readers obtained
+// through NewReader.
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+const readChunkSize = 32 << 10
+
+// take appends the next n bytes to r.frame, returning them.
+func (r *Reader) take(n int) ([]byte, error) {
+	start := len(r.frame)
+	for len(r.frame)-start < n {
+		want := n - (len(r.frame) - start)
+		if len(r.pending) > 0 {
+			if want > len(r.pending) {
+				want = len(r.pending)
+			}
+			r.frame = append(r.frame, r.pending[:want]...)
+			r.pending = r.pending[want:]
+			r.offset += int64(want)
+			continue
+		}
+		// Grow the frame as data is read, instead of trusting its length.
+		if want > readChunkSize {
+			want = readChunkSize
+		}
+		need := len(r.frame) + want
+		if cap(r.frame) < need {
+			grown := make([]byte, len(r.frame), need)
+			copy(grown, r.frame)
+			r.frame = grown
+		}
+		buf := r.frame[len(r.frame):need]
+		read, err := io.ReadFull(r.br, buf)
+		r.frame = r.frame[:len(r.frame)+read]
+		r.offset += int64(read)
+		if err != nil {
+			if err == io.EOF && len(r.frame) > start {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return r.frame[start:], nil
+}
+
+func (r *Reader) readFrame() ([]byte, error) {
+	r.frame = r.frame[:0]
+	head, err := r.take(frameHeaderSize)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, eofCorrupt(err)
+	}
+	length := binary.LittleEndian.Uint32(head)
+	sum := binary.LittleEndian.Uint64(head[4:])
+	if length > MaxRecordSize {
+		return nil, errCorrupt
+	}
+	data, err := r.take(int(length))
+	if err != nil {
+		return nil, eofCorrupt(err)
+	}
+	if xxhash.Checksum64(data) != sum {
+		return nil, errCorrupt
+	}
+	marker, err := r.take(len(syncMarker))
+	if err != nil {
+		return nil, eofCorrupt(err)
+	}
+	if !bytes.Equal(marker, syncMarker) {
+		return nil, errCorrupt
+	}
+	ret := make([]byte, length)
+	copy(ret, r.frame[frameHeaderSize:])
+	return ret, nil
+}
+
+// eofCorrupt converts errors caused by reaching the end of the stream in the
+// middle of a record into errCorrupt, so that the Reader attempts to find
+// further records.
+func eofCorrupt(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errCorrupt
+	}
+	return err
+}
+
+// resync looks for the next sync marker within the bytes of the invalid frame
+// that was just read, and then in the rest of the stream, placing the Reader
+// right after it. Returns ErrTruncated in case no marker is found.
+func (r *Reader) resync() error {
+	frameStart := r.offset - int64(len(r.frame))
+	if i := bytes.Index(r.frame, syncMarker); i >= 0 {
+		rest := r.frame[i+len(syncMarker):]
+		r.pending = append(append([]byte{}, rest...), r.pending...)
+		r.offset = frameStart + int64(i+len(syncMarker))
+		return nil
+	}
+
+	// Keep the tail of the frame, as it may hold the beginning of the
+	// marker.
+	window := r.frame
+	if len(window) > len(syncMarker)-1 {
+		window = window[len(window)-len(syncMarker)+1:]
+	}
+	window = append([]byte{}, window...)
+	for {
+		var b byte
+		if len(r.pending) > 0 {
+			b, r.pending = r.pending[0], r.pending[1:]
+		} else {
+			var err error
+			if b, err = r.br.ReadByte(); err != nil {
+				if err == io.EOF {
+					return ErrTruncated
+				}
+				return err
+			}
+		}
+		r.offset++
+		window = append(window, b)
+		if len(window) > len(syncMarker) {
+			window = window[1:]
+		}
+		if bytes.Equal(window, syncMarker) {
+			return nil
+		}
+	}
+}
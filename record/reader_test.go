@@ -0,0 +1,104 @@
+package record
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func writeEvents(t *testing.T, count int, opts ...Option) []byte {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, opts...)
+	require.NoError(t, err)
+	for i := 0; i < count; i++ {
+		_, err = w.Write(event(i))
+		require.NoError(t, err)
+	}
+	return buf.Bytes()
+}
+
+func TestReaderInvalidHeader(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte("YREC")))
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+
+	data := writeEvents(t, 0)
+	data[4] = FormatVersion + 1
+	_, err = NewReader(bytes.NewReader(data))
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+func TestReaderCorruption(t *testing.T) {
+	data := writeEvents(t, 3)
+	first := recordStartSize + frameHeaderSize
+
+	t.Run("checksum", func(t *testing.T) {
+		corrupt := append([]byte{}, data...)
+		corrupt[first] ^= 0xff
+		r, err := NewReader(bytes.NewReader(corrupt))
+		require.NoError(t, err)
+		events := readAll(t, r)
+		require.Len(t, events, 2)
+		assert.Equal(t, int64(1), events[0].Sequence)
+		assert.Equal(t, int64(2), events[1].Sequence)
+		assert.Equal(t, 1, r.Skipped())
+	})
+
+	t.Run("length", func(t *testing.T) {
+		corrupt := append([]byte{}, data...)
+		// Claims to span over the following records
+		corrupt[recordStartSize] = 0xf0
+		r, err := NewReader(bytes.NewReader(corrupt))
+		require.NoError(t, err)
+		events := readAll(t, r)
+		require.Len(t, events, 2)
+		assert.Equal(t, int64(1), events[0].Sequence)
+		assert.Equal(t, 1, r.Skipped())
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		r, err := NewReader(bytes.NewReader(data[:len(data)-5]))
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			_, err = r.Next()
+			require.NoError(t, err)
+		}
+		_, err = r.Next()
+		assert.ErrorIs(t, err, ErrTruncated)
+		_, err = r.Next()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestReaderSeek(t *testing.T) {
+	idx := &bytes.Buffer{}
+	data := writeEvents(t, 100, WithIndex(10, idx))
+
+	index, err := ReadIndex(idx)
+	require.NoError(t, err)
+	require.Len(t, index.Entries, 9)
+
+	for _, withIndex := range []bool{false, true} {
+		r, err := NewReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		if withIndex {
+			r.SetIndex(index)
+		}
+		for _, n := range []uint64{57, 3, 99, 0, 10} {
+			require.NoError(t, r.Seek(n))
+			assert.Equal(t, n, r.Record())
+			v, err := r.Read()
+			require.NoError(t, err)
+			assert.Equal(t, int64(n), v.(*Event).Sequence)
+		}
+		require.NoError(t, r.Seek(100))
+		_, err = r.Next()
+		assert.ErrorIs(t, err, io.EOF)
+		assert.ErrorIs(t, r.Seek(101), io.EOF)
+	}
+
+	r, err := NewReader(bytes.NewBuffer(data))
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.Seek(1), ErrNotSeekable)
+}
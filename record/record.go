@@ -0,0 +1,136 @@
+// Package record implements an append-only file format for persisting YARP
+// messages.
+//
+// A record file starts with a header comprised of a magic sequence, the
+// format version and the wire version used to encode its messages, followed
+// by a sync marker. Each record is then comprised of its length as a 32-bit
+// little-endian integer, the xxhash64 checksum of its contents as a 64-bit
+// little-endian integer, the encoded message, and a sync marker:
+//
+//	+--------+---------+--------+------------+---------+------+-----+
+//	| "YREC" | version | wire v | sync       | length  | hash | ... |
+//	+--------+---------+--------+------------+---------+------+-----+
+//	 4 bytes  1 byte    1 byte   16 bytes     4 bytes   8 b.
+//
+// Sync markers allow readers to resume after records that were partially
+// written, for instance due to a crash, by scanning for the next marker.
+// Writers may also maintain a sparse index, mapping record numbers to their
+// offsets in the file, which is used by Reader.Seek. See WithIndex.
+package record
+
+import (
+	"fmt"
+	"github.com/libyarp/yarp"
+	"io"
+)
+
+// FormatVersion represents the version of the record file format written by
+// this package.
+const FormatVersion = 1
+
+// MaxRecordSize determines the maximum size of a single record. Larger lengths
+// are considered to be corruption.
+const MaxRecordSize = 64 << 20
+
+var magic = []byte("YREC")
+
+// syncMarker follows the file header and every record. Its first bytes never
+// represent a valid record length, so that repeated markers are skipped by
+// readers.
+var syncMarker = []byte{
+	0xff, 0xff, 0xff, 0xff, 0x59, 0x41, 0x52, 0x50,
+	0x9c, 0x3e, 0x51, 0xd7, 0x08, 0xa4, 0x6b, 0xe2,
+}
+
+const (
+	headerSize      = 6
+	recordStartSize = headerSize + 16
+	frameHeaderSize = 12
+)
+
+// ErrInvalidHeader indicates that a file does not start with a valid record
+// file header, or was written using an unsupported format version.
+var ErrInvalidHeader = fmt.Errorf("invalid record file header")
+
+// ErrRecordTooLarge indicates that a message exceeds MaxRecordSize.
+var ErrRecordTooLarge = fmt.Errorf("record is too large")
+
+// ErrTruncated indicates that the last record of a file was only partially
+// written.
+var ErrTruncated = fmt.Errorf("truncated record")
+
+// ErrNotSeekable indicates that Reader.Seek was invoked on a Reader whose
+// underlying reader does not implement io.Seeker.
+var ErrNotSeekable = fmt.Errorf("reader is not seekable")
+
+// Option represents an arbitrary option to be set on a Writer. See
+// WithWireVersion and WithIndex.
+type Option func(o *options)
+
+type options struct {
+	wireVersion   yarp.WireVersion
+	indexInterval uint64
+	index         io.Writer
+}
+
+func newOptions(opts []Option) options {
+	o := options{wireVersion: yarp.LatestWireVersion}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	return o
+}
+
+// WithWireVersion determines the wire version used to encode messages written
+// to a new file. Defaults to yarp.LatestWireVersion. Files opened through
+// Append keep the version they were created with.
+func WithWireVersion(v yarp.WireVersion) Option {
+	return func(o *options) {
+		o.wireVersion = v
+	}
+}
+
+// WithIndex enables the sparse index, adding an entry for every interval
+// records. When used with NewWriter, entries are written to w. Append ignores
+// w, and maintains the index in a file beside the record file instead. See
+// IndexPath.
+func WithIndex(interval uint64, w io.Writer) Option {
+	return func(o *options) {
+		o.indexInterval = interval
+		o.index = w
+	}
+}
+
+func writeHeader(w io.Writer, version yarp.WireVersion) error {
+	header := make([]byte, 0, recordStartSize)
+	header = append(header, magic...)
+	header = append(header, FormatVersion, byte(version))
+	header = append(header, syncMarker...)
+	_, err := w.Write(header)
+	return err
+}
+
+func readHeader(r io.Reader) (yarp.WireVersion, error) {
+	header := make([]byte, recordStartSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, ErrInvalidHeader
+		}
+		return 0, err
+	}
+	for i, b := range magic {
+		if header[i] != b {
+			return 0, ErrInvalidHeader
+		}
+	}
+	version := yarp.WireVersion(header[5])
+	if header[4] != FormatVersion || version < yarp.WireVersion1 || version > yarp.LatestWireVersion {
+		return 0, ErrInvalidHeader
+	}
+	for i, b := range syncMarker {
+		if header[headerSize+i] != b {
+			return 0, ErrInvalidHeader
+		}
+	}
+	return version, nil
+}
@@ -0,0 +1,239 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/OneOfOne/xxhash"
+	"github.com/libyarp/yarp"
+	"io"
+	"os"
+	"sync"
+)
+
+// Writer appends records to a record file. Writers are safe for concurrent
+// use.
+type Writer struct {
+	mu       sync.Mutex
+	w        io.Writer
+	version  yarp.WireVersion
+	offset   int64
+	count    uint64
+	interval uint64
+	index    io.Writer
+	buf      []byte
+	files    []*os.File
+}
+
+// NewWriter returns a new Writer writing records to w, after writing the file
+// header.
+func NewWriter(w io.Writer, opts ...Option) (*Writer, error) {
+	o := newOptions(opts)
+	wr := &Writer{w: w}
+	if err := wr.start(o.wireVersion); err != nil {
+		return nil, err
+	}
+	if o.index != nil && o.indexInterval > 0 {
+		wr.index, wr.interval = o.index, o.indexInterval
+	}
+	return wr, nil
+}
+
+// Append opens the record file at path for appending, creating it in case it
+// does not exist. Records already present are counted, so that numbering
+// continues from the last valid record. In case the file ends with a partial
+// record, a sync marker is written before new records, allowing readers to
+// skip it. When WithIndex is provided, the index is kept at IndexPath(path).
+func Append(path string, opts ...Option) (*Writer, error) {
+	o := newOptions(opts)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{w: f, files: []*os.File{f}}
+	if err = w.open(f, path, o); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// start writes the file header.
+func (w *Writer) start(version yarp.WireVersion) error {
+	if version < yarp.WireVersion1 || version > yarp.LatestWireVersion {
+		return yarp.ErrUnsupportedWireVersion
+	}
+	if err := writeHeader(w.w, version); err != nil {
+		return err
+	}
+	w.version, w.offset = version, recordStartSize
+	return nil
+}
+
+// open prepares w to append records to f, which is either empty or an
+// existing record file.
+func (w *Writer) open(f *os.File, path string, o options) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if err = w.start(o.wireVersion); err != nil {
+			return err
+		}
+		if o.indexInterval == 0 {
+			return nil
+		}
+		idx, err := os.OpenFile(IndexPath(path), os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		w.files = append(w.files, idx)
+		w.index, w.interval = idx, o.indexInterval
+		return nil
+	}
+
+	if w.version, err = readHeader(f); err != nil {
+		return err
+	}
+	var idx *Index
+	if o.indexInterval > 0 {
+		if idx, err = w.openIndex(path, info.Size(), o.indexInterval); err != nil {
+			return err
+		}
+	}
+
+	// Count records from the last indexed one onwards.
+	entry, ok := idx.last()
+	if !ok {
+		entry = IndexEntry{Offset: recordStartSize}
+	}
+	if _, err = f.Seek(entry.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := newReader(f, w.version, entry.Offset)
+	r.record = entry.Record
+	for {
+		if _, err = r.Next(); err == io.EOF || err == ErrTruncated {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	w.count = r.record
+
+	w.offset = info.Size()
+	tail := make([]byte, len(syncMarker))
+	if _, err = f.ReadAt(tail, w.offset-int64(len(tail))); err != nil {
+		return err
+	}
+	if !bytes.Equal(tail, syncMarker) {
+		if _, err = f.Write(syncMarker); err != nil {
+			return err
+		}
+		w.offset += int64(len(syncMarker))
+	}
+	return nil
+}
+
+// openIndex opens the index of a record file of a given size, discarding
+// entries that were partially written, or that point past the end of the
+// file.
+func (w *Writer) openIndex(path string, size int64, interval uint64) (*Index, error) {
+	f, err := os.OpenFile(IndexPath(path), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w.files = append(w.files, f)
+	idx, err := ReadIndex(f)
+	if err != nil {
+		return nil, err
+	}
+	for len(idx.Entries) > 0 && idx.Entries[len(idx.Entries)-1].Offset >= size {
+		idx.Entries = idx.Entries[:len(idx.Entries)-1]
+	}
+	if err = f.Truncate(int64(len(idx.Entries) * indexEntrySize)); err != nil {
+		return nil, err
+	}
+	w.index, w.interval = f, interval
+	return idx, nil
+}
+
+// Write encodes v and appends it as a new record, returning its number.
+func (w *Writer) Write(v interface{}) (uint64, error) {
+	data, err := yarp.EncodeVersion(v, w.version)
+	if err != nil {
+		return 0, err
+	}
+	return w.WriteRaw(data)
+}
+
+// WriteRaw appends data as a new record, returning its number. data must hold
+// a message encoded using the Writer's wire version. See WireVersion.
+func (w *Writer) WriteRaw(data []byte) (uint64, error) {
+	if len(data) > MaxRecordSize {
+		return 0, ErrRecordTooLarge
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var head [frameHeaderSize]byte
+	binary.LittleEndian.PutUint32(head[:], uint32(len(data)))
+	binary.LittleEndian.PutUint64(head[4:], xxhash.Checksum64(data))
+	w.buf = append(w.buf[:0], head[:]...)
+	w.buf = append(w.buf, data...)
+	w.buf = append(w.buf, syncMarker...)
+	if _, err := w.w.Write(w.buf); err != nil {
+		return 0, err
+	}
+
+	n, offset := w.count, w.offset
+	w.count++
+	w.offset += int64(len(w.buf))
+	if w.index != nil && n > 0 && n%w.interval == 0 {
+		if err := writeIndexEntry(w.index, IndexEntry{Record: n, Offset: offset}); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// WireVersion returns the wire version used to encode messages.
+func (w *Writer) WireVersion() yarp.WireVersion {
+	return w.version
+}
+
+// Count returns the amount of records in the file, which is also the number
+// of the next record to be written.
+func (w *Writer) Count() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count
+}
+
+// Sync commits the files opened by Append to stable storage. It is a no-op
+// for Writers obtained through NewWriter.
+func (w *Writer) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, f := range w.files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the files opened by Append. It is a no-op for Writers obtained
+// through NewWriter.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	for _, f := range w.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	w.files = nil
+	return err
+}
@@ -0,0 +1,126 @@
+package record
+
+import (
+	"bytes"
+	"github.com/libyarp/yarp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+type Event struct {
+	*yarp.Structure
+	Sequence int64  `index:"0"`
+	Name     string `index:"1"`
+}
+
+func (Event) YarpID() uint64         { return 0x45 }
+func (Event) YarpPackage() string    { return "io.vito" }
+func (Event) YarpStructName() string { return "Event" }
+
+func init() {
+	yarp.RegisterStructType(Event{})
+}
+
+func event(i int) Event {
+	return Event{Sequence: int64(i), Name: "event " + strconv.Itoa(i)}
+}
+
+func readAll(t *testing.T, r *Reader) []*Event {
+	var events []*Event
+	for {
+		v, err := r.Read()
+		if err == io.EOF {
+			return events
+		}
+		require.NoError(t, err)
+		events = append(events, v.(*Event))
+	}
+}
+
+func TestWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, WithWireVersion(yarp.WireVersion2))
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		n, err := w.Write(event(i))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i), n)
+	}
+	assert.Equal(t, uint64(10), w.Count())
+	require.NoError(t, w.Close())
+
+	r, err := NewReader(buf)
+	require.NoError(t, err)
+	assert.Equal(t, yarp.WireVersion2, r.WireVersion())
+	events := readAll(t, r)
+	require.Len(t, events, 10)
+	for i, e := range events {
+		assert.Equal(t, int64(i), e.Sequence)
+		assert.Equal(t, "event "+strconv.Itoa(i), e.Name)
+	}
+	assert.Equal(t, uint64(10), r.Record())
+	assert.Zero(t, r.Skipped())
+}
+
+func TestWriterInvalid(t *testing.T) {
+	_, err := NewWriter(&bytes.Buffer{}, WithWireVersion(yarp.LatestWireVersion+1))
+	assert.ErrorIs(t, err, yarp.ErrUnsupportedWireVersion)
+
+	w, err := NewWriter(&bytes.Buffer{})
+	require.NoError(t, err)
+	_, err = w.WriteRaw(make([]byte, MaxRecordSize+1))
+	assert.ErrorIs(t, err, ErrRecordTooLarge)
+}
+
+func TestAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.yrec")
+
+	w, err := Append(path, WithIndex(4, nil))
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = w.Write(event(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Sync())
+	require.NoError(t, w.Close())
+
+	// Simulate a crash in the middle of a write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	data, err := yarp.Encode(event(99))
+	require.NoError(t, err)
+	_, err = f.Write(append(make([]byte, frameHeaderSize), data[:len(data)/2]...))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, err = Append(path, WithIndex(4, nil))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), w.Count())
+	for i := 10; i < 20; i++ {
+		n, err := w.Write(event(i))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i), n)
+	}
+	require.NoError(t, w.Close())
+
+	r, err := Open(path)
+	require.NoError(t, err)
+	defer r.Close()
+	events := readAll(t, r)
+	require.Len(t, events, 20)
+	for i, e := range events {
+		assert.Equal(t, int64(i), e.Sequence)
+	}
+	assert.Equal(t, 1, r.Skipped())
+	assert.Equal(t, []IndexEntry{
+		{Record: 4, Offset: r.index.Entries[0].Offset},
+		{Record: 8, Offset: r.index.Entries[1].Offset},
+		{Record: 12, Offset: r.index.Entries[2].Offset},
+		{Record: 16, Offset: r.index.Entries[3].Offset},
+	}, r.index.Entries)
+}
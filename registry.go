@@ -4,6 +4,22 @@ import "reflect"
 
 var registry = map[uint64]reflect.Type{}
 
+func init() {
+	registerWellKnownTypes()
+}
+
+// YarpIDs reserved for well-known messages provided by this package, which
+// must not be used by other messages.
+const (
+	// AnyID identifies Any.
+	AnyID uint64 = 0x3e91b2fa14bee879
+)
+
+// registerWellKnownTypes registers messages provided by this package.
+func registerWellKnownTypes() {
+	RegisterStructType(Any{})
+}
+
 // TryRegisterStructType takes an arbitrary number of StructValuer instances,
 // validates them, and registers them to be able to decode streams into their
 // respective types. Returns an error in case a struct is invalid.
@@ -34,4 +50,8 @@ func resetRegistry() {
 	for k := range registry {
 		delete(registry, k)
 	}
+	for k := range enumRegistry {
+		delete(enumRegistry, k)
+	}
+	registerWellKnownTypes()
 }
@@ -0,0 +1,57 @@
+package yarp
+
+import (
+	"net"
+	"strings"
+	"unicode"
+)
+
+// ErrorReport describes an error that occurred while a Server processed a
+// request, and that was reported to the client as an internal error.
+type ErrorReport struct {
+	// Err is the error that occurred. For panics, Err describes the
+	// recovered value.
+	Err error
+	// Stack holds the stack trace of the goroutine that panicked, and is nil
+	// for other errors.
+	Stack []byte
+	// MethodFQN is the fully-qualified name of the requested method, and is
+	// empty in case the error occurred before the method was identified.
+	MethodFQN string
+	// Peer is the address of the client, if known.
+	Peer net.Addr
+}
+
+// Panicked returns whether the ErrorReport describes a recovered panic.
+func (r ErrorReport) Panicked() bool {
+	return r.Stack != nil
+}
+
+// ErrorHandler receives ErrorReports from a Server. ErrorHandlers are invoked
+// by the goroutine serving the failed request, and must be safe for concurrent
+// use.
+type ErrorHandler func(r ErrorReport)
+
+// ErrorDescriptionKey is the UserData key of Errors used by Servers in
+// development mode to provide a description of internal errors to clients.
+const ErrorDescriptionKey = "description"
+
+// maxErrorDescription limits the length of descriptions provided through
+// ErrorDescriptionKey.
+const maxErrorDescription = 1024
+
+// describeError returns a description of a given ErrorReport suitable to be
+// provided to clients. Non-printable characters are replaced, and long
+// descriptions are truncated. Stack traces are never included.
+func describeError(r ErrorReport) string {
+	d := strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return ' '
+	}, strings.ToValidUTF8(r.Err.Error(), "?"))
+	if len(d) > maxErrorDescription {
+		d = strings.ToValidUTF8(d[:maxErrorDescription], "") + "..."
+	}
+	return d
+}
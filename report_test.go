@@ -0,0 +1,96 @@
+package yarp
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDescribeError(t *testing.T) {
+	d := describeError(ErrorReport{Err: fmt.Errorf("bad\x00input\n\xff")})
+	assert.Equal(t, "bad input ?", d)
+
+	d = describeError(ErrorReport{Err: fmt.Errorf("%s", strings.Repeat("é", maxErrorDescription))})
+	assert.True(t, strings.HasSuffix(d, "..."))
+	assert.LessOrEqual(t, len(d), maxErrorDescription+3)
+	assert.Equal(t, strings.Repeat("é", maxErrorDescription/2)+"...", d)
+}
+
+func TestErrorHandler(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+
+	start := func(t *testing.T, opts ...Option) (*Client, <-chan ErrorReport) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = l.Close()
+		})
+		reports := make(chan ErrorReport, 1)
+		s := NewServer(l.Addr().String(), append(opts, WithErrorHandler(func(r ErrorReport) {
+			reports <- r
+		}))...)
+		s.RegisterHandler(0x1, "io.vito.Errors.fail", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+			return nil, nil, fmt.Errorf("database unavailable")
+		})
+		s.RegisterHandler(0x2, "io.vito.Errors.panic", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+			panic("boom")
+		})
+		s.RegisterHandler(0x3, "io.vito.Errors.managed", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+			return nil, nil, Error{Kind: ErrorKindManagedError, Identifier: "managed"}
+		})
+		go func() {
+			_ = s.StartListener(l)
+		}()
+		return NewClient(l.Addr().String()), reports
+	}
+
+	internalError := func(t *testing.T, err error) Error {
+		ok, managed := IsManagedError(err)
+		require.True(t, ok, err)
+		assert.Equal(t, ErrorKind(ErrorKindInternalError), managed.Kind)
+		return managed
+	}
+
+	t.Run("reports", func(t *testing.T) {
+		c, reports := start(t)
+		_, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &SimpleRequest{})
+		managed := internalError(t, err)
+		assert.Empty(t, managed.UserData)
+		r := <-reports
+		assert.EqualError(t, r.Err, "database unavailable")
+		assert.Equal(t, "io.vito.Errors.fail", r.MethodFQN)
+		assert.NotNil(t, r.Peer)
+		assert.False(t, r.Panicked())
+
+		_, _, err = c.DoRequest(context.Background(), Request{Method: 0x2}, &SimpleRequest{})
+		internalError(t, err)
+		r = <-reports
+		assert.EqualError(t, r.Err, "panic on non-error value: boom")
+		assert.Equal(t, "io.vito.Errors.panic", r.MethodFQN)
+		assert.True(t, r.Panicked())
+		assert.Contains(t, string(r.Stack), "report_test.go")
+
+		_, _, err = c.DoRequest(context.Background(), Request{Method: 0x3}, &SimpleRequest{})
+		ok, _ := IsManagedError(err)
+		require.True(t, ok, err)
+		assert.Empty(t, reports)
+	})
+
+	t.Run("development mode", func(t *testing.T) {
+		c, reports := start(t, WithDevelopmentMode())
+		_, _, err := c.DoRequest(context.Background(), Request{Method: 0x1}, &SimpleRequest{})
+		managed := internalError(t, err)
+		assert.Equal(t, "database unavailable", managed.UserData[ErrorDescriptionKey])
+		<-reports
+
+		_, _, err = c.DoRequest(context.Background(), Request{Method: 0x2}, &SimpleRequest{})
+		managed = internalError(t, err)
+		assert.Equal(t, "panic on non-error value: boom", managed.UserData[ErrorDescriptionKey])
+		<-reports
+	})
+}
@@ -0,0 +1,71 @@
+package yarp
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// DecodeReuse reads a single struct from r into dst, which must be a pointer
+// to a struct of the same type as the one present in the stream. Unlike
+// Decode, DecodeReuse overwrites the provided instance instead of allocating
+// a new one: nested messages held by fields, either by value, pointer or
+// interface, are decoded into whenever they have the same type as the ones
+// present in the stream, slices reuse their current backing arrays whenever
+// they have enough capacity, and maps are cleared and refilled. Fields absent
+// from the stream, or holding values that could not be applied, are reset to
+// their zero values. Callers must not retain references to slices, maps or
+// nested messages from dst between calls. Returns
+// ErrStructTypeMismatch in case the stream contains a different struct type,
+// in which case dst is left untouched.
+// Like Decode, DecodeReuse expects values written using WireVersion1. Use
+// DecodeReuseVersion to read values written using other versions.
+func DecodeReuse(r io.Reader, dst StructValuer) error {
+	return defaultCodec.decodeReuse(r, dst)
+}
+
+// DecodeReuseVersion works like DecodeReuse, but reads r expecting values
+// written using the provided wire version.
+func DecodeReuseVersion(r io.Reader, dst StructValuer, version WireVersion) error {
+	if version < WireVersion1 || version > LatestWireVersion {
+		return ErrUnsupportedWireVersion
+	}
+	return newCodec(version).decodeReuse(r, dst)
+}
+
+func (c codec) decodeReuse(r io.Reader, dst StructValuer) (err error) {
+	defer func() {
+		if rawErr := recover(); rawErr != nil {
+			if innerErr, ok := rawErr.(error); ok {
+				err = innerErr
+				return
+			}
+
+			err = fmt.Errorf("unexpected error during decode operation: %s", rawErr)
+		}
+	}()
+
+	into := reflect.ValueOf(dst)
+	if into.Kind() != reflect.Pointer || into.IsNil() || into.Elem().Kind() != reflect.Struct {
+		return ErrIncompatibleStruct
+	}
+	header := []byte{0x00}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if detectType(header[0]) != Struct {
+		return ErrStructTypeMismatch
+	}
+	sparse, id, body, err := decodeStructHeader(header[0], r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if id != dst.YarpID() {
+		return ErrStructTypeMismatch
+	}
+	str, err := c.decodeStructBody(id, sparse, body, nil, into.Elem())
+	if err != nil {
+		return err
+	}
+	return applyStruct(into.Elem(), str, true)
+}
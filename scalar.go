@@ -8,10 +8,16 @@ import (
 // encoded buffer. Callers must manually add required headers into the first 4
 // bits of the first byte in the provided buffer.
 func encodeInteger(value uint64) []byte {
+	return appendInteger(nil, value, 0x00)
+}
+
+// appendInteger works like encodeInteger, but appends the encoded value to dst,
+// setting the provided header flags into its first byte.
+func appendInteger(dst []byte, value uint64, flags byte) []byte {
 	const maxLen = 16
 	pos := maxLen - 1
-	data := make([]byte, maxLen)
-	for (value << 1) > 0x7 {
+	var data [maxLen]byte
+	for value > 0x3 {
 		data[pos] = uint8(value&0x7F) << 1
 		if pos != maxLen-1 {
 			data[pos] = data[pos] | 0x1
@@ -23,26 +29,65 @@ func encodeInteger(value uint64) []byte {
 	if pos < maxLen-1 {
 		data[pos] |= 0x1
 	}
-	return data[pos:]
+	data[pos] |= flags
+	return append(dst, data[pos:]...)
+}
+
+// sizeInteger returns the amount of bytes required by encodeInteger to encode
+// a given value.
+func sizeInteger(value uint64) int {
+	n := 1
+	for value > 0x3 {
+		n++
+		value >>= 7
+	}
+	return n
 }
 
 func encodeInt(value int64) []byte {
-	data := encodeInteger(uint64(value))
-	data[0] = data[0] | 0x30
-	return data
+	return appendInt(nil, value)
+}
+
+func appendInt(dst []byte, value int64) []byte {
+	return appendInteger(dst, uint64(value), 0x30)
+}
+
+// encodeZigZag encodes a signed value using ZigZag encoding, mapping values
+// with small magnitudes to small unsigned values (0, -1, 1, -2... becomes
+// 0, 1, 2, 3...). See WireVersion2.
+func encodeZigZag(value int64) []byte {
+	return appendZigZag(nil, value)
+}
+
+func appendZigZag(dst []byte, value int64) []byte {
+	return appendInteger(dst, zigZag(value), 0x30)
+}
+
+func zigZag(value int64) uint64 {
+	return uint64(value<<1) ^ uint64(value>>63)
+}
+
+func decodeZigZag(value uint64) int64 {
+	return int64(value>>1) ^ -int64(value&0x1)
 }
 
 func encodeUint(value uint64) []byte {
-	data := encodeInteger(value)
-	data[0] = data[0] | 0x20
-	return data
+	return appendUint(nil, value)
+}
+
+func appendUint(dst []byte, value uint64) []byte {
+	return appendInteger(dst, value, 0x20)
 }
 
 func encodeBool(value bool) []byte {
+	return appendBool(nil, value)
+}
+
+func appendBool(dst []byte, value bool) []byte {
 	if value {
-		return []byte{0x30}
+		return append(dst, 0x30)
 	} else {
-		return []byte{0x20}
+		return append(dst, 0x20)
 	}
 }
 
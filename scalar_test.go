@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"math"
 	"testing"
 )
 
@@ -21,6 +22,16 @@ func TestScalarUint(t *testing.T) {
 	}
 }
 
+func TestScalarLargeUint(t *testing.T) {
+	for _, v := range []uint64{math.MaxUint32, 1 << 62, 1 << 63, 1<<63 | 1, math.MaxUint64} {
+		buf := encodeUint(v)
+		assert.Equal(t, sizeInteger(v), len(buf))
+		_, decoded, err := decodeScalar(buf[0], bytes.NewReader(buf[1:]))
+		require.NoError(t, err)
+		assert.Equal(t, v, decoded, "Buffer data is %#v", buf)
+	}
+}
+
 func TestScalarInt(t *testing.T) {
 	for i := -512; i < 512; i++ {
 		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
@@ -45,3 +56,39 @@ func TestScalarBool(t *testing.T) {
 	assert.Equal(t, uint8(0x20), buf[0])
 	assert.Equal(t, Scalar, detectType(buf[0]))
 }
+
+func TestScalarZigZag(t *testing.T) {
+	for i := -512; i < 512; i++ {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			buf := encodeZigZag(int64(i))
+			s, v, err := decodeScalar(buf[0], bytes.NewReader(buf[1:]))
+			require.NoError(t, err)
+			require.True(t, s)
+			assert.Equal(t, Scalar, detectType(buf[0]))
+			assert.Equal(t, int64(i), decodeZigZag(v), "Buffer data is %#v", buf)
+		})
+	}
+
+	assert.Equal(t, []byte{0x32}, encodeZigZag(-1))
+	assert.Len(t, encodeInt(-1), 10)
+}
+
+func TestWireVersion(t *testing.T) {
+	for _, v := range []int64{-1, 0, 1, -300, 300, math.MinInt64, math.MaxInt64} {
+		t.Run(fmt.Sprintf("%d", v), func(t *testing.T) {
+			buf, err := EncodeVersion(v, WireVersion2)
+			require.NoError(t, err)
+			ty, dec, err := DecodeVersion(bytes.NewReader(buf), WireVersion2)
+			require.NoError(t, err)
+			assert.Equal(t, Scalar, ty)
+			assert.Equal(t, v, dec)
+		})
+	}
+
+	buf, err := EncodeVersion(true, WireVersion2)
+	require.NoError(t, err)
+	assert.Equal(t, encodeBool(true), buf)
+
+	_, err = EncodeVersion(1, WireVersion(42))
+	assert.ErrorIs(t, err, ErrUnsupportedWireVersion)
+}
@@ -0,0 +1,233 @@
+package yarp
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// requestStreamHeader is the reserved header used by clients to indicate that
+// a request is comprised of a stream of values, instead of a single one.
+// Streamed values are followed by a void value, indicating the end of the
+// stream.
+const requestStreamHeader = "Yarp-Request-Stream"
+
+// ClientStream represents a request comprised of multiple values, used by
+// client-streaming and bidirectional-streaming methods. Values are sent
+// through Send, and CloseSend indicates that no further values will be sent.
+// Client-streaming methods obtain their response through CloseAndRecv, while
+// bidirectional-streaming methods may call Recv concurrently with Send.
+// ClientStreams are closed once their response is fully read. Otherwise,
+// Close must be called to release their connection.
+type ClientStream struct {
+	ctx  context.Context
+	conn bufferedConn
+	enc  codec
+
+	// log logs the completion of the request once the ClientStream is
+	// closed, given the error that ended it, if any.
+	log     func(err error)
+	logOnce sync.Once
+
+	sendMu     sync.Mutex
+	sendClosed bool
+
+	resOnce sync.Once
+	res     *Response
+	reader  *streamReader
+	resErr  error
+}
+
+// NewStream starts a request of a client-streaming or bidirectional-streaming
+// method, returning a ClientStream used to send values and read responses.
+// The request header is sent before NewStream returns, but the server's
+// response is only read by Headers, Recv, or CloseAndRecv.
+func (c *Client) NewStream(ctx context.Context, request Request) (*ClientStream, error) {
+	headers, err := c.requestHeaders(ctx, request.Headers)
+	if err != nil {
+		return nil, err
+	}
+	headers = Header(headers).Clone()
+	Header(headers).Set(requestStreamHeader, "1")
+	request.Headers = headers
+
+	data, err := request.Encode()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	conn, err := c.connect(ctx)
+	if err != nil {
+		c.logRequest(request, start, nil, err)
+		return nil, err
+	}
+	counted := &countingConn{ReadWriteCloser: watchConn(ctx, conn)}
+	if _, err = counted.Write(data); err != nil {
+		counted.Close()
+		err = contextError(ctx, err)
+		c.logRequest(request, start, counted, err)
+		return nil, err
+	}
+	return &ClientStream{
+		ctx:  ctx,
+		conn: newBufferedConn(counted),
+		enc:  c.codec.streaming(),
+		log: func(err error) {
+			c.logRequest(request, start, counted, err)
+		},
+	}, nil
+}
+
+// Send sends a given value to the server. In case it contains a streamed Blob,
+// Send returns once the Blob is fully transmitted. Returns ErrSendClosed in
+// case CloseSend was already called.
+func (s *ClientStream) Send(v interface{}) error {
+	if isNilValue(v) {
+		// Void values are reserved for the end of the stream.
+		return ErrInvalidType
+	}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.sendClosed {
+		return ErrSendClosed
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	data, err := s.enc.appendEncodeInterface((*buf)[:0], v)
+	if err != nil {
+		return err
+	}
+	*buf = data
+	if _, err = s.conn.Write(data); err == nil {
+		err = s.enc.writeBlob(s.conn, reflect.ValueOf(v))
+	}
+	return contextError(s.ctx, err)
+}
+
+// CloseSend indicates to the server that no further values will be sent.
+// Calling CloseSend more than once has no effect.
+func (s *ClientStream) CloseSend() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.sendClosed {
+		return nil
+	}
+	s.sendClosed = true
+	_, err := s.conn.Write(encodeVoid())
+	return contextError(s.ctx, err)
+}
+
+// readHeader reads the response header once. Servers of
+// bidirectional-streaming methods only provide a header along with their
+// first value, so a connection closed before one is provided indicates an
+// empty stream.
+func (s *ClientStream) readHeader() error {
+	s.resOnce.Do(func() {
+		s.res, s.resErr = readResponse(s.conn)
+		if s.resErr == io.EOF && s.ctx.Err() == nil {
+			s.res, s.resErr = &Response{Stream: true}, nil
+		}
+		if s.resErr == nil {
+			s.reader, s.resErr = newStreamReader(s.ctx, s.conn, s.res)
+		}
+		s.resErr = contextError(s.ctx, s.resErr)
+	})
+	return s.resErr
+}
+
+// Headers waits for the server to respond, and returns the response's
+// headers.
+func (s *ClientStream) Headers() (map[string]string, error) {
+	if err := s.readHeader(); err != nil {
+		return nil, err
+	}
+	return s.res.Headers, nil
+}
+
+// Recv returns the next value provided by the server of a
+// bidirectional-streaming method. Returns io.EOF once the server completes its
+// stream, the Error provided by the server in case it failed, or
+// ErrStreamTruncated in case it was interrupted. The ClientStream is closed
+// once Recv returns an error. In case the last value returned contains a
+// streamed Blob, Recv blocks until it is consumed.
+func (s *ClientStream) Recv() (interface{}, error) {
+	if err := s.readHeader(); err != nil {
+		s.finish(err)
+		return nil, err
+	}
+	v, err := s.reader.next()
+	if err != nil {
+		s.finish(err)
+		return nil, err
+	}
+	return v, nil
+}
+
+// Trailer returns the trailer headers provided by the server, once Recv
+// returns io.EOF or an Error, or once CloseAndRecv returns. The trailer of a
+// response containing a streamed Blob is provided by Blob.Trailer instead.
+func (s *ClientStream) Trailer() map[string]string {
+	if s.reader == nil {
+		return nil
+	}
+	return s.reader.trailer
+}
+
+// CloseAndRecv calls CloseSend and returns the response provided by the server
+// of a client-streaming method, along with its headers. The ClientStream is
+// closed once the response is read.
+func (s *ClientStream) CloseAndRecv() (interface{}, map[string]string, error) {
+	if err := s.CloseSend(); err != nil {
+		s.finish(err)
+		return nil, nil, err
+	}
+	if err := s.readHeader(); err != nil {
+		s.finish(err)
+		return nil, nil, err
+	}
+	if s.res.Stream {
+		s.finish(ErrWantsStreamed)
+		return nil, nil, ErrWantsStreamed
+	}
+	_, ret, err := s.reader.codec.decode(s.conn)
+	if err != nil {
+		err = contextError(s.ctx, err)
+		s.finish(err)
+		return nil, nil, err
+	}
+	if b := topLevelBlob(reflect.ValueOf(ret)); b.streaming() {
+		holdConn(s.ctx, b, func(err error) { s.finish(err) }, func() (map[string]string, error) {
+			return readTrailer(s.ctx, s.conn, s.res)
+		})
+		return ret, s.res.Headers, nil
+	}
+	if s.reader.trailer, err = readTrailer(s.ctx, s.conn, s.res); err != nil {
+		s.finish(err)
+		return nil, nil, err
+	}
+	s.finish(nil)
+	return ret, s.res.Headers, nil
+}
+
+// Close closes the ClientStream's connection, interrupting the request in
+// case it is still being performed.
+func (s *ClientStream) Close() error {
+	return s.finish(nil)
+}
+
+// finish closes the ClientStream's connection, logging the completion of its
+// request along with the error that ended it, if any. Only the first call is
+// logged.
+func (s *ClientStream) finish(err error) error {
+	if err == io.EOF {
+		err = nil
+	}
+	s.logOnce.Do(func() {
+		if s.log != nil {
+			s.log(err)
+		}
+	})
+	return s.conn.Close()
+}
@@ -0,0 +1,220 @@
+package yarp
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+type SimpleRequestReceiver struct {
+	h   Header
+	ch  <-chan *SimpleRequest
+	err *error
+}
+
+func (i SimpleRequestReceiver) Headers() Header { return i.h }
+func (i SimpleRequestReceiver) Recv() (*SimpleRequest, error) {
+	v, ok := <-i.ch
+	if !ok {
+		return nil, *i.err
+	}
+	return v, nil
+}
+
+type UploadReceiver struct {
+	h   Header
+	ch  <-chan *Upload
+	err *error
+}
+
+func (i UploadReceiver) Headers() Header { return i.h }
+func (i UploadReceiver) Recv() (*Upload, error) {
+	v, ok := <-i.ch
+	if !ok {
+		return nil, *i.err
+	}
+	return v, nil
+}
+
+// startStreamServer starts a Server exposing a client-streaming method (0x1)
+// counting received values, a bidirectional-streaming method (0x2) replying
+// to each value with its Name, a client-streaming method (0x3) concatenating
+// received blobs, and a unary method (0x4).
+func startStreamServer(t *testing.T, opts ...Option) (string, <-chan error) {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+	RegisterStructType(Upload{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	// recvErrs receives the error that ended each stream read by 0x1.
+	recvErrs := make(chan error, 1)
+	s := NewServer(l.Addr().String(), opts...)
+	s.RegisterHandler(0x1, "io.vito.Streams.count", func(ctx context.Context, headers Header, in *SimpleRequestReceiver) (Header, *SimpleResponse, error) {
+		count := 0
+		for {
+			_, err := in.Recv()
+			if err != nil {
+				recvErrs <- err
+				if err != io.EOF {
+					return nil, nil, err
+				}
+				break
+			}
+			count++
+		}
+		return Header{"Count": strconv.Itoa(count)}, &SimpleResponse{ID: int32(count)}, nil
+	})
+	s.RegisterHandler(0x2, "io.vito.Streams.echo", func(ctx context.Context, headers Header, in *SimpleRequestReceiver, out *SimpleResponseStreamer) error {
+		for {
+			req, err := in.Recv()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			id, err := strconv.Atoi(req.Name)
+			if err != nil {
+				return err
+			}
+			out.Push(&SimpleResponse{ID: int32(id)})
+		}
+	})
+	s.RegisterHandler(0x3, "io.vito.Streams.concat", func(ctx context.Context, headers Header, in *UploadReceiver) (Header, *Upload, error) {
+		var data []byte
+		for {
+			u, err := in.Recv()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, nil, err
+			}
+			read, err := io.ReadAll(u.Data)
+			if err != nil {
+				return nil, nil, err
+			}
+			data = append(data, read...)
+		}
+		return nil, &Upload{Data: NewBlobBytes(data)}, nil
+	})
+	s.RegisterHandler(0x4, "io.vito.Streams.unary", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		return nil, &SimpleResponse{}, nil
+	})
+	go func() {
+		_ = s.StartListener(l)
+	}()
+	return l.Addr().String(), recvErrs
+}
+
+func TestClientStream(t *testing.T) {
+	addr, recvErrs := startStreamServer(t, WithMultiplexing())
+	clients := map[string]*Client{
+		"dedicated":   NewClient(addr),
+		"multiplexed": NewClient(addr, WithMultiplexing(), WithWireVersion(LatestWireVersion)),
+	}
+	for name, c := range clients {
+		c := c
+		t.Cleanup(func() {
+			_ = c.Close()
+		})
+		t.Run(name, func(t *testing.T) {
+			t.Run("client streaming", func(t *testing.T) {
+				s, err := c.NewStream(context.Background(), Request{Method: 0x1})
+				require.NoError(t, err)
+				for i := 0; i < 5; i++ {
+					require.NoError(t, s.Send(&SimpleRequest{Name: strconv.Itoa(i)}))
+				}
+				res, headers, err := s.CloseAndRecv()
+				require.NoError(t, err)
+				assert.Equal(t, int32(5), res.(*SimpleResponse).ID)
+				assert.Equal(t, "5", Header(headers).Get("Count"))
+				assert.Equal(t, io.EOF, <-recvErrs)
+				assert.Equal(t, ErrSendClosed, s.Send(&SimpleRequest{}))
+			})
+
+			t.Run("empty client stream", func(t *testing.T) {
+				s, err := c.NewStream(context.Background(), Request{Method: 0x1})
+				require.NoError(t, err)
+				res, _, err := s.CloseAndRecv()
+				require.NoError(t, err)
+				assert.Equal(t, int32(0), res.(*SimpleResponse).ID)
+				assert.Equal(t, io.EOF, <-recvErrs)
+			})
+
+			t.Run("bidirectional streaming", func(t *testing.T) {
+				s, err := c.NewStream(context.Background(), Request{Method: 0x2})
+				require.NoError(t, err)
+				// Values are exchanged one at a time, requiring both sides
+				// to be processed concurrently.
+				for i := 0; i < 5; i++ {
+					require.NoError(t, s.Send(&SimpleRequest{Name: strconv.Itoa(i)}))
+					v, err := s.Recv()
+					require.NoError(t, err)
+					assert.Equal(t, int32(i), v.(*SimpleResponse).ID)
+				}
+				require.NoError(t, s.CloseSend())
+				_, err = s.Recv()
+				assert.Equal(t, io.EOF, err)
+			})
+
+			t.Run("empty bidirectional stream", func(t *testing.T) {
+				s, err := c.NewStream(context.Background(), Request{Method: 0x2})
+				require.NoError(t, err)
+				require.NoError(t, s.CloseSend())
+				_, err = s.Recv()
+				assert.Equal(t, io.EOF, err)
+			})
+
+			t.Run("blobs", func(t *testing.T) {
+				data := blobFixture(blobChunkSize*2 + 1)
+				s, err := c.NewStream(context.Background(), Request{Method: 0x3})
+				require.NoError(t, err)
+				for i := 0; i < 3; i++ {
+					require.NoError(t, s.Send(&Upload{Data: NewBlobBytes(data)}))
+				}
+				res, _, err := s.CloseAndRecv()
+				require.NoError(t, err)
+				read, err := io.ReadAll(res.(*Upload).Data)
+				require.NoError(t, err)
+				assert.Equal(t, append(append(data, data...), data...), read)
+			})
+
+			t.Run("truncated stream", func(t *testing.T) {
+				s, err := c.NewStream(context.Background(), Request{Method: 0x1})
+				require.NoError(t, err)
+				require.NoError(t, s.Send(&SimpleRequest{}))
+				require.NoError(t, s.Close())
+				assert.Equal(t, io.ErrUnexpectedEOF, <-recvErrs)
+			})
+
+			t.Run("type mismatch", func(t *testing.T) {
+				s, err := c.NewStream(context.Background(), Request{Method: 0x4})
+				require.NoError(t, err)
+				_, _, err = s.CloseAndRecv()
+				ok, managed := IsManagedError(err)
+				require.True(t, ok)
+				assert.Equal(t, ErrorKind(ErrorKindTypeMismatch), managed.Kind)
+
+				_, _, err = c.DoRequest(context.Background(), Request{Method: 0x1}, &SimpleRequest{})
+				ok, managed = IsManagedError(err)
+				require.True(t, ok)
+				assert.Equal(t, ErrorKind(ErrorKindTypeMismatch), managed.Kind)
+			})
+
+			t.Run("void values", func(t *testing.T) {
+				s, err := c.NewStream(context.Background(), Request{Method: 0x2})
+				require.NoError(t, err)
+				defer s.Close()
+				assert.Equal(t, ErrInvalidType, s.Send(nil))
+				assert.Equal(t, ErrInvalidType, s.Send((*SimpleRequest)(nil)))
+			})
+		})
+	}
+}
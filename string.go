@@ -3,9 +3,16 @@ package yarp
 import "io"
 
 func encodeString(str string) []byte {
-	header := encodeInteger(uint64(len(str)))
-	header[0] |= 0xA0
-	return append(header, []byte(str)...)
+	return appendString(nil, str)
+}
+
+func appendString(dst []byte, str string) []byte {
+	dst = appendInteger(dst, uint64(len(str)), 0xA0)
+	return append(dst, str...)
+}
+
+func sizeString(str string) int {
+	return sizeInteger(uint64(len(str))) + len(str)
 }
 
 func decodeString(header byte, r io.Reader) (string, error) {
@@ -10,7 +10,7 @@ import (
 
 func TestString(t *testing.T) {
 	val := "Hello, World!"
-	v, err := encode(reflect.ValueOf(val))
+	v, err := defaultCodec.encode(reflect.ValueOf(val))
 	require.NoError(t, err)
 	assert.Equal(t, []byte{0xa1, 0x1a, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x2c, 0x20, 0x57, 0x6f, 0x72, 0x6c, 0x64, 0x21}, v)
 	ty, s, err := Decode(bytes.NewReader(v))
@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // StructValuer represents a struct that can be encoded into a YARP stream.
@@ -30,6 +31,20 @@ type Structure struct {
 	UnknownFields []UnknownField
 }
 
+// SparseStructValuer may be implemented by structs that are expected to have
+// most of their fields unset. When the negotiated wire version allows it (see
+// WireVersion3), such structs are encoded using a sparse layout, in which only
+// fields holding non-zero values are written, each one preceded by its index.
+// Both layouts decode into the same Go types.
+type SparseStructValuer interface {
+	StructValuer
+	YarpSparse() bool
+}
+
+// maxSparseIndex limits field indexes accepted from sparse structs, preventing
+// corrupt streams from causing large allocations.
+const maxSparseIndex = 1 << 16
+
 var reflectedValuer = reflect.TypeOf((*StructValuer)(nil)).Elem()
 var reflectedStructure = reflect.TypeOf(&Structure{})
 
@@ -46,7 +61,28 @@ type structField struct {
 	OneOfIndexes map[int]reflect.StructField
 }
 
+// structFieldsCache holds results of validateAndExtractStruct for types that
+// were successfully validated, since every encode and decode operation needs
+// them.
+var structFieldsCache sync.Map // map[reflect.Type][]structField
+
+// rawFieldsCache holds results of rawFieldsOf, which is consulted whenever a
+// registered struct is decoded.
+var rawFieldsCache sync.Map // map[reflect.Type]map[int]reflect.Type
+
 func validateAndExtractStruct(t reflect.Type) ([]structField, error) {
+	if fields, ok := structFieldsCache.Load(t); ok {
+		return fields.([]structField), nil
+	}
+	fields, err := extractStruct(t)
+	if err != nil {
+		return nil, err
+	}
+	structFieldsCache.Store(t, fields)
+	return fields, nil
+}
+
+func extractStruct(t reflect.Type) ([]structField, error) {
 	if !t.Implements(reflectedValuer) {
 		return nil, ErrIncompatibleStruct
 	}
@@ -131,81 +167,296 @@ func validateAndExtractStruct(t reflect.Type) ([]structField, error) {
 	allFields := make([]structField, maxField+1)
 	for i := 0; i <= maxField; i++ {
 		allFields[i] = fields[i]
+		f := allFields[i]
+		if f.OneOf {
+			for _, m := range f.OneOfIndexes {
+				if m.Type == reflectedBlobPtr {
+					return nil, ErrInvalidBlobField
+				}
+			}
+		} else if f.Field.Type == reflectedBlobPtr && i != maxField {
+			return nil, ErrInvalidBlobField
+		}
 	}
 	return allFields, nil
 }
 
-func encodeStruct(v reflect.Value) ([]byte, error) {
+func (c codec) encodeStruct(v reflect.Value) ([]byte, error) {
+	return c.appendStruct(nil, v)
+}
+
+func (c codec) appendStruct(dst []byte, v reflect.Value) ([]byte, error) {
+	iv := v.Interface()
+	if fe, ok := iv.(FastEncoder); ok {
+		return c.appendFast(dst, fe)
+	}
 	fields, err := validateAndExtractStruct(v.Type())
 	if err != nil {
 		return nil, err
 	}
+	sparse := c.isSparse(iv)
+	size, err := c.structBodySize(v, fields, sparse)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := byte(0x80)
+	if sparse {
+		flags |= 0x10
+	}
+	dst = appendInteger(dst, uint64(size)+8, flags) // ID + body
+	var id [8]byte
+	binary.LittleEndian.PutUint64(id[:], iv.(StructValuer).YarpID())
+	dst = append(dst, id[:]...)
+
 	// Encode all values in order
-	var body []byte
+	nested := c.nested()
 	for _, f := range fields {
-		var b []byte
+		if sparse && structFieldIsZero(v, f) {
+			continue
+		}
+		if sparse {
+			dst = appendUint(dst, uint64(f.Index))
+		}
 		if f.OneOf {
-			oo := &OneOfValue{Index: -1}
-			for k, f := range f.OneOfIndexes {
-				val := v.FieldByIndex(f.Index)
-				if val.IsNil() {
-					continue
-				}
-				oo.Index = k
-				oo.Data = val.Interface()
-				break
-			}
-			b, err = encodeOneOf(oo)
+			dst, err = nested.appendOneOf(dst, oneOfValueOf(v, f))
 		} else {
-			b, err = encode(v.FieldByIndex(f.Field.Index))
+			dst, err = c.fieldCodec(f).appendEncode(dst, v.FieldByIndex(f.Field.Index))
 		}
 		if err != nil {
 			return nil, err
 		}
-		body = append(body, b...)
 	}
-	header := encodeInteger(uint64(len(body)) + 8) // ID + body
-	header[0] |= 0x80
-	id := make([]byte, 8)
-	binary.LittleEndian.PutUint64(id, v.Interface().(StructValuer).YarpID())
-	header = append(header, id...)
-	return append(header, body...), nil
+	return dst, nil
+}
+
+func (c codec) sizeStruct(v reflect.Value) (int, error) {
+	iv := v.Interface()
+	if fe, ok := iv.(FastEncoder); ok {
+		// FastEncoder provides no means to compute sizes without encoding.
+		data, err := c.appendFast(nil, fe)
+		return len(data), err
+	}
+	fields, err := validateAndExtractStruct(v.Type())
+	if err != nil {
+		return 0, err
+	}
+	size, err := c.structBodySize(v, fields, c.isSparse(iv))
+	if err != nil {
+		return 0, err
+	}
+	return sizeInteger(uint64(size)+8) + 8 + size, nil
+}
+
+// structBodySize returns the amount of bytes required to encode v's fields.
+func (c codec) structBodySize(v reflect.Value, fields []structField, sparse bool) (int, error) {
+	size := 0
+	nested := c.nested()
+	for _, f := range fields {
+		if sparse && structFieldIsZero(v, f) {
+			continue
+		}
+		if sparse {
+			size += sizeInteger(uint64(f.Index))
+		}
+		var n int
+		var err error
+		if f.OneOf {
+			n, err = nested.sizeOneOf(oneOfValueOf(v, f))
+		} else {
+			n, err = c.fieldCodec(f).size(v.FieldByIndex(f.Field.Index))
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// nested returns the codec used for values nested within a struct, in which
+// Blobs are never streamed.
+func (c codec) nested() codec {
+	c.streamBlobs = false
+	return c
+}
+
+// fieldCodec returns the codec used to encode a given field. Only *Blob fields
+// of the top-level struct may be streamed; validateAndExtractStruct ensures
+// such fields are the last ones.
+func (c codec) fieldCodec(f structField) codec {
+	if f.Field.Type == reflectedBlobPtr {
+		return c
+	}
+	return c.nested()
+}
+
+func (c codec) isSparse(v interface{}) bool {
+	if sv, ok := v.(SparseStructValuer); ok && c.sparseStructs() {
+		return sv.YarpSparse()
+	}
+	return false
+}
+
+// oneOfValueOf returns a OneOfValue holding the member of oneof field f set in
+// v, if any.
+func oneOfValueOf(v reflect.Value, f structField) *OneOfValue {
+	oo := &OneOfValue{Index: -1}
+	for k, f := range f.OneOfIndexes {
+		val := v.FieldByIndex(f.Index)
+		if val.IsNil() {
+			continue
+		}
+		oo.Index = k
+		oo.Data = val.Interface()
+		break
+	}
+	return oo
+}
+
+func structFieldIsZero(v reflect.Value, f structField) bool {
+	if !f.OneOf {
+		return v.FieldByIndex(f.Field.Index).IsZero()
+	}
+	for _, f := range f.OneOfIndexes {
+		if !v.FieldByIndex(f.Index).IsNil() {
+			return false
+		}
+	}
+	return true
+}
+
+func (c codec) decodeStruct(header byte, r io.Reader) (*encodedStruct, error) {
+	return c.decodeProjectedStruct(header, r, nil)
 }
 
-func decodeStruct(header byte, r io.Reader) (*encodedStruct, error) {
-	_, size, err := decodeScalar(header, r)
+// decodeProjectedStruct works like decodeStruct, but only decodes fields
+// included in p, skipping all others. A nil p includes all fields.
+func (c codec) decodeProjectedStruct(header byte, r io.Reader, p *Projection) (*encodedStruct, error) {
+	sparse, id, r, err := decodeStructHeader(header, r)
 	if err != nil {
 		return nil, err
 	}
+	return c.decodeStructBody(id, sparse, r, p, reflect.Value{})
+}
+
+// decodeStructHeader reads a struct's size and ID, returning whether it uses
+// the sparse layout, along with a reader limited to its body.
+func decodeStructHeader(header byte, r io.Reader) (sparse bool, id uint64, body io.Reader, err error) {
+	sparse, size, err := decodeScalar(header, r)
+	if err != nil {
+		return false, 0, nil, err
+	}
 
 	if size >= sizeLimit {
-		return nil, ErrSizeTooLarge
+		return false, 0, nil, ErrSizeTooLarge
 	}
-	r = io.LimitReader(r, int64(size))
-	id := make([]byte, 8)
-	if _, err := io.ReadFull(r, id); err != nil {
-		return nil, err
+	body = io.LimitReader(r, int64(size))
+	rawID := make([]byte, 8)
+	if _, err = io.ReadFull(body, rawID); err != nil {
+		return false, 0, nil, err
 	}
+	return sparse, binary.LittleEndian.Uint64(rawID), body, nil
+}
+
+// decodeStructBody decodes fields of a struct whose header was already
+// consumed from r. When into is valid, it holds the struct the result will be
+// applied to, whose nested messages are decoded into whenever possible. See
+// decodeReusing.
+func (c codec) decodeStructBody(id uint64, sparse bool, r io.Reader, p *Projection, into reflect.Value) (*encodedStruct, error) {
+	var err error
 	str := &encodedStruct{
-		id: binary.LittleEndian.Uint64(id),
+		id: id,
+	}
+	var fields []structField
+	var rawFields map[int]reflect.Type
+	if into.IsValid() {
+		if fields, err = validateAndExtractStruct(into.Type()); err != nil {
+			return nil, err
+		}
+		rawFields = rawFieldsOf(into.Type())
+	} else if t, ok := registry[str.id]; ok {
+		rawFields = rawFieldsOf(t)
 	}
-	for {
-		t, v, err := Decode(r)
+	for position := 0; ; position++ {
+		index := position
+		if sparse {
+			head := []byte{0x00}
+			if _, err := io.ReadFull(r, head); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			_, idx, err := decodeScalar(head[0], r)
+			if err != nil {
+				return nil, err
+			}
+			if idx >= maxSparseIndex {
+				return nil, ErrCorruptStream
+			}
+			index = int(idx)
+		}
+		var t Type
+		var v interface{}
+		nested, included := p.field(index)
+		if rt, ok := rawFields[index]; ok && included {
+			t, v, err = decodeRawField(rt, r)
+		} else if !included {
+			err = Skip(r)
+		} else if nested != nil {
+			t, v, err = c.decodeNestedProjection(r, nested)
+		} else if index < len(fields) && !fields[index].OneOf {
+			t, v, err = c.decodeReusing(r, into.FieldByIndex(fields[index].Field.Index))
+		} else {
+			t, v, err = c.decode(r)
+		}
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF && !sparse {
 				break
 			}
 			return nil, err
 		}
-		str.values = append(str.values, v)
-		str.types = append(str.types, t)
+		if b, ok := v.(*Blob); ok && b.streaming() {
+			if err = bindBlob(b, r); err != nil {
+				return nil, err
+			}
+		}
+		if !included {
+			continue
+		}
+		// Fields absent from a sparse struct are kept as Invalid, and left
+		// untouched when applied to a concrete type.
+		for len(str.values) <= index {
+			str.values = append(str.values, nil)
+			str.types = append(str.types, Invalid)
+		}
+		str.values[index] = v
+		str.types[index] = t
 	}
 
 	return str, nil
 }
 
-func decodeStructToConcrete(b byte, r io.Reader) (interface{}, error) {
-	str, err := decodeStruct(b, r)
+func (c codec) decodeStructToConcrete(b byte, r io.Reader) (interface{}, error) {
+	return c.decodeProjectedConcrete(b, r, nil)
+}
+
+func (c codec) decodeProjectedConcrete(b byte, r io.Reader, p *Projection) (interface{}, error) {
+	sparse, id, r, err := decodeStructHeader(b, r)
+	if err != nil {
+		return nil, err
+	}
+	return c.decodeConcreteBody(id, sparse, r, p)
+}
+
+// decodeConcreteBody decodes the body of a struct whose header was already
+// consumed from r into a new instance of its registered type.
+func (c codec) decodeConcreteBody(id uint64, sparse bool, r io.Reader, p *Projection) (interface{}, error) {
+	if t, ok := registry[id]; ok && p == nil && reflect.PointerTo(t).Implements(reflectedFastDecoder) {
+		return c.decodeFast(t, sparse, r)
+	}
+	str, err := c.decodeStructBody(id, sparse, r, p, reflect.Value{})
 	if err != nil {
 		return nil, err
 	}
@@ -214,46 +465,96 @@ func decodeStructToConcrete(b byte, r io.Reader) (interface{}, error) {
 		return str, ErrUnknownStructType
 	}
 	inst := reflect.New(t)
+	if err = applyStruct(inst.Elem(), str, false); err != nil {
+		return nil, err
+	}
+	return inst.Interface(), nil
+}
+
+// decodeReusing works like decode, but decodes a struct into the message held
+// by existing in case it has the same type, returning a pointer to it.
+func (c codec) decodeReusing(r io.Reader, existing reflect.Value) (Type, interface{}, error) {
+	header := []byte{0x00}
+	if _, err := r.Read(header); err != nil {
+		return Invalid, nil, err
+	}
+	dst := reusableMessage(existing)
+	if detectType(header[0]) != Struct || !dst.IsValid() {
+		return c.decodeWithHeader(header, r)
+	}
+	sparse, id, r, err := decodeStructHeader(header[0], r)
+	if err != nil {
+		return Struct, nil, err
+	}
+	if registry[id] != dst.Elem().Type() {
+		v, err := c.decodeConcreteBody(id, sparse, r, nil)
+		return Struct, v, err
+	}
+	str, err := c.decodeStructBody(id, sparse, r, nil, dst.Elem())
+	if err != nil {
+		return Struct, nil, err
+	}
+	if err = applyStruct(dst.Elem(), str, true); err != nil {
+		return Struct, nil, err
+	}
+	return Struct, dst.Interface(), nil
+}
 
-	setInst := inst.Elem()
+// reusableMessage returns a pointer to the message held by v, which may be a
+// struct, a pointer to a struct, or an interface holding one. Returns an
+// invalid value in case v holds no message.
+func reusableMessage(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		v = v.Elem()
+	case reflect.Struct:
+		if v.CanAddr() {
+			v = v.Addr()
+		}
+	}
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct || !v.Type().Implements(reflectedValuer) {
+		return reflect.Value{}
+	}
+	return v
+}
+
+// applyStruct sets values from a decoded struct into setInst. Values that
+// cannot be applied to their respective fields are stored as UnknownFields in
+// setInst's Structure. When clear is set, fields absent from str, or holding
+// values that could not be applied, are reset to their zero values.
+func applyStruct(setInst reflect.Value, str *encodedStruct, clear bool) error {
+	t := setInst.Type()
 	allFields, err := validateAndExtractStruct(t)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	vLen := len(str.values)
 	var unknownFields []UnknownField
-	maxI := 0
 	for i, f := range allFields {
-		if i > vLen {
-			break
+		if clear && f.OneOf {
+			clearOneOf(setInst, f)
+		}
+		if i >= vLen || str.types[i] == Invalid {
+			if clear && !f.OneOf {
+				clearField(setInst, f.Field)
+			}
+			continue
 		}
 		v := str.values[i]
 
-		maxI = i
 		if f.OneOf {
-			oo, ok := v.(*OneOfValue)
-			if ok {
-				if oo.Index == -1 {
-					// No one is set. Just continue.
-					continue
-				}
-				field, ok := f.OneOfIndexes[oo.Index]
-				val := oo.Data
-				// Here's a catch: All OneOf values are pointers, but oo.Data
-				// will never contain a pointer. For that, we create a new
-				// pointer, set its value, and pass it to setValue.
-				ptr := reflect.New(field.Type.Elem())
-				ptr.Elem().Set(reflect.ValueOf(val))
-				if ok && setValue(setInst, field, ptr) {
-					if hasF, ok := t.FieldByName("Has" + field.Name); ok && hasF.Type.Kind() == reflect.Bool {
-						setInst.FieldByIndex(hasF.Index).SetBool(true)
-					}
-					continue
-				}
+			if setOneOf(setInst, f, v) {
+				continue
 			}
 		} else if setValue(setInst, f.Field, v) {
+			if clear && v == nil {
+				// Void leaves pointers and interfaces untouched.
+				clearField(setInst, f.Field)
+			}
 			continue
+		} else if clear {
+			clearField(setInst, f.Field)
 		}
 
 		unknownFields = append(unknownFields, UnknownField{
@@ -263,20 +564,66 @@ func decodeStructToConcrete(b byte, r io.Reader) (interface{}, error) {
 		})
 	}
 
-	for i, v := range str.values[maxI+1:] {
-		t := str.types[i]
+	for i := len(allFields); i < vLen; i++ {
+		if str.types[i] == Invalid {
+			continue
+		}
 		unknownFields = append(unknownFields, UnknownField{
-			Index: maxI + i,
-			Type:  t,
-			Data:  v,
+			Index: i,
+			Type:  str.types[i],
+			Data:  str.values[i],
 		})
 	}
 
 	sf, _ := t.FieldByName("Structure")
-	setInst.FieldByIndex(sf.Index).Set(reflect.ValueOf(&Structure{
-		UnknownFields: unknownFields,
-	}))
-	return inst.Interface(), nil
+	structure := setInst.FieldByIndex(sf.Index)
+	if structure.IsNil() {
+		structure.Set(reflect.ValueOf(&Structure{}))
+	}
+	structure.Interface().(*Structure).UnknownFields = unknownFields
+	return nil
+}
+
+// setOneOf sets the member of oneof field f held by v, which is expected to
+// be a *OneOfValue, along with its Has field, if any. Returns false in case v
+// cannot be applied to f.
+func setOneOf(into reflect.Value, f structField, v interface{}) bool {
+	oo, ok := v.(*OneOfValue)
+	if !ok {
+		return false
+	}
+	if oo == nil || oo.Index == -1 {
+		// No one is set. Just continue.
+		return true
+	}
+	field, ok := f.OneOfIndexes[oo.Index]
+	// All OneOf members are pointers, which convertValue takes care of,
+	// either reusing decoded struct pointers or allocating new ones for other
+	// values.
+	if !ok || oo.Data == nil || !setValue(into, field, reflect.ValueOf(oo.Data)) {
+		return false
+	}
+	setHasField(into, field, true)
+	return true
+}
+
+// setHasField sets the Has field accompanying a given oneof member, if any.
+func setHasField(into reflect.Value, member reflect.StructField, value bool) {
+	if hasF, ok := into.Type().FieldByName("Has" + member.Name); ok && hasF.Type.Kind() == reflect.Bool {
+		into.FieldByIndex(hasF.Index).SetBool(value)
+	}
+}
+
+func clearField(into reflect.Value, fd reflect.StructField) {
+	v := into.FieldByIndex(fd.Index)
+	v.Set(reflect.Zero(v.Type()))
+}
+
+func clearOneOf(into reflect.Value, f structField) {
+	for _, field := range f.OneOfIndexes {
+		clearField(into, field)
+		setHasField(into, field, false)
+	}
 }
 
 func setValue(into reflect.Value, fd reflect.StructField, value interface{}) bool {
@@ -327,88 +674,200 @@ func setValue(into reflect.Value, fd reflect.StructField, value interface{}) boo
 		//          *N&E&WB08NNH#6r6
 		//               ^  ~~""^
 
-	case fd.Type.Kind() != reflect.Pointer &&
-		rv.Type().Kind() == reflect.Pointer &&
-		rv.Elem().Type().ConvertibleTo(fd.Type):
-		into.FieldByIndex(fd.Index).Set(rv.Elem().Convert(fd.Type))
+	case fd.Type.Kind() == reflect.Interface && !rv.IsValid():
+		// Same as above, for interface fields holding messages.
+
+	default:
+		field := into.FieldByIndex(fd.Index)
+		cv, ok := convertValue(rv, fd.Type, field)
+		if !ok {
+			return false
+		}
+		field.Set(cv)
+	}
 
-	case rv.Type().ConvertibleTo(fd.Type):
-		into.FieldByIndex(fd.Index).Set(rv.Convert(fd.Type))
+	return true
+}
 
-	case rv.Type().Kind() == reflect.Slice && fd.Type.Kind() == reflect.Slice:
-		// rv is []interface, f is specialised. Check if rv[i] can be
-		// convertible to f[i]. Bear in mind that slices do not take optional
-		// values, so no pointers here.
-		ft := fd.Type.Elem()
-		for i := 0; i < rv.Len(); i++ {
-			if !rv.Index(i).Elem().Type().ConvertibleTo(ft) {
-				return false
-			}
+// convertValue converts a value obtained from Decode into a given type,
+// recursing into slices, maps and pointers as needed. When existing is a
+// valid slice or map of type t, its storage is reused whenever possible.
+// Returns false in case rv cannot be represented by t.
+func convertValue(rv reflect.Value, t reflect.Type, existing reflect.Value) (reflect.Value, bool) {
+	if !rv.IsValid() {
+		// Void is only representable by types accepting nil.
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+			return reflect.Zero(t), true
 		}
+		return reflect.Value{}, false
+	}
 
-		// All items can be converted. Initialise a new slice, fill it, and
-		// set the field value.
-		slice := reflect.MakeSlice(reflect.SliceOf(ft), rv.Len(), rv.Len())
-		for i := 0; i < rv.Len(); i++ {
-			v := rv.Index(i).Elem()
-			slice.Index(i).Set(v.Convert(ft))
+	if t == reflectedRawMessage {
+		if rv.Type() != reflectedRawMessage {
+			return reflect.Value{}, false
 		}
-		into.FieldByIndex(fd.Index).Set(slice)
+		return rv, true
+	}
 
-	case fd.Type.Kind() == reflect.Bool &&
-		(rv.Type().Kind() == reflect.Uint64 || rv.Type().Kind() == reflect.Int64):
-		into.FieldByIndex(fd.Index).SetBool(rv.Type().Kind() == reflect.Int64)
+	if t == reflectedBlobPtr {
+		switch {
+		case rv.Type() == reflectedBlobPtr:
+			return rv, true
+		case rv.Kind() == reflect.String:
+			return reflect.ValueOf(blobFromString(rv.String())), true
+		}
+		return reflect.Value{}, false
+	}
 
-	case rv.Type().Kind() == reflect.Pointer &&
-		fd.Type.Kind() == reflect.Map &&
-		rv.Type() == reflectedMapValue:
-		mv := rv.Interface().(*MapValue)
-		ok, mi := makeMap(mv, fd.Type)
+	switch t.Kind() {
+	case reflect.Pointer:
+		if rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				return reflect.Zero(t), true
+			}
+			if rv.Type() == t {
+				return rv, true
+			}
+			rv = rv.Elem()
+		}
+		v, ok := convertValue(rv, t.Elem(), reflect.Value{})
 		if !ok {
-			return false
+			return reflect.Value{}, false
 		}
-		into.FieldByIndex(fd.Index).Set(mi)
-
-	case rv.Type().Kind() == reflect.Pointer &&
-		rv.Type().Elem().Kind() == reflect.Struct &&
-		!rv.IsNil() &&
-		fd.Type.Kind() == reflect.Struct:
-		// rv is a pointer to struct coming from Decode, but we want a concrete
-		// value.
-		return setValue(into, fd, rv.Elem())
-
-	default:
-		return false
-	}
+		ptr := reflect.New(t.Elem())
+		ptr.Elem().Set(v)
+		return ptr, true
+
+	case reflect.Interface:
+		// Messages are kept as pointers, as returned by Decode. Arrays hold
+		// messages by value, so take their address instead.
+		if rv.Kind() == reflect.Struct {
+			ptr := reflect.New(rv.Type())
+			ptr.Elem().Set(rv)
+			rv = ptr
+		}
+		if !rv.Type().Implements(reflectedValuer) || !rv.Type().ConvertibleTo(t) {
+			return reflect.Value{}, false
+		}
+		return rv.Convert(t), true
 
-	return true
-}
+	case reflect.Struct:
+		if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+			rv = rv.Elem()
+		}
+		if rv.Kind() != reflect.Struct || !rv.Type().ConvertibleTo(t) {
+			return reflect.Value{}, false
+		}
+		return rv.Convert(t), true
 
-func makeMap(v *MapValue, mapType reflect.Type) (bool, reflect.Value) {
-	mapKeyType := mapType.Key()
-	mapValueType := mapType.Elem()
-	var mi reflect.Value
-	if v != nil {
-		for _, v := range v.Keys {
-			if !reflect.TypeOf(v).ConvertibleTo(mapKeyType) {
-				return false, reflect.Value{}
+	case reflect.Slice:
+		if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() != reflect.Interface {
+			if rv.Type() == t {
+				return rv, true
 			}
+			return reflect.Value{}, false
 		}
+		// rv is []interface{}, t is specialised. Reuse the current backing
+		// array in case it is large enough, or initialise a new slice, and
+		// convert each item into it.
+		var slice reflect.Value
+		if rv.IsNil() {
+			return reflect.Zero(t), true
+		} else if existing.IsValid() && existing.Type() == t && !existing.IsNil() && existing.Cap() >= rv.Len() {
+			slice = existing.Slice(0, rv.Len())
+		} else {
+			slice = reflect.MakeSlice(t, rv.Len(), rv.Len())
+		}
+		for i := 0; i < rv.Len(); i++ {
+			v, ok := convertValue(rv.Index(i).Elem(), t.Elem(), reflect.Value{})
+			if !ok {
+				return reflect.Value{}, false
+			}
+			slice.Index(i).Set(v)
+		}
+		return slice, true
 
-		for _, v := range v.Values {
-			if !reflect.TypeOf(v).ConvertibleTo(mapValueType) {
-				return false, reflect.Value{}
+	case reflect.Map:
+		if rv.Type() != reflectedMapValue {
+			return reflect.Value{}, false
+		}
+		mv := rv.Interface().(*MapValue)
+		if mv == nil {
+			return reflect.Zero(t), true
+		}
+		n := len(mv.Keys)
+		keys := make([]reflect.Value, n)
+		values := make([]reflect.Value, n)
+		for i := 0; i < n; i++ {
+			k, ok := convertValue(reflect.ValueOf(mv.Keys[i]), t.Key(), reflect.Value{})
+			if !ok {
+				return reflect.Value{}, false
+			}
+			v, ok := convertValue(reflect.ValueOf(mv.Values[i]), t.Elem(), reflect.Value{})
+			if !ok {
+				return reflect.Value{}, false
+			}
+			keys[i], values[i] = k, v
+		}
+		var mi reflect.Value
+		if existing.IsValid() && existing.Type() == t && !existing.IsNil() {
+			// Reuse the current map, removing all its keys.
+			mi = existing
+			for _, k := range mi.MapKeys() {
+				mi.SetMapIndex(k, reflect.Value{})
 			}
+		} else {
+			mi = reflect.MakeMapWithSize(t, n)
 		}
-		mi = reflect.MakeMapWithSize(mapType, len(v.Keys))
-		for i, rk := range v.Keys {
-			k := reflect.ValueOf(rk).Convert(mapKeyType)
-			v := reflect.ValueOf(v.Values[i]).Convert(mapValueType)
-			mi.SetMapIndex(k, v)
+		for i := range keys {
+			mi.SetMapIndex(keys[i], values[i])
 		}
-	} else {
-		mi = reflect.MakeMapWithSize(mapType, 0)
+		return mi, true
+
+	case reflect.Bool:
+		switch rv.Kind() {
+		case reflect.Bool:
+			return rv.Convert(t), true
+		case reflect.Int64:
+			return reflect.ValueOf(true).Convert(t), true
+		case reflect.Uint64:
+			return reflect.ValueOf(false).Convert(t), true
+		}
+		return reflect.Value{}, false
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return rv.Convert(t), true
+		}
+		return reflect.Value{}, false
+
+	case reflect.Float32, reflect.Float64:
+		switch rv.Kind() {
+		case reflect.Float32, reflect.Float64:
+			return rv.Convert(t), true
+		}
+		return reflect.Value{}, false
+
+	case reflect.String:
+		if rv.Kind() != reflect.String {
+			return reflect.Value{}, false
+		}
+		return rv.Convert(t), true
 	}
 
-	return true, mi
+	return reflect.Value{}, false
+}
+
+// makeMap converts v into a map of the given type. Differently from
+// convertValue, a nil v produces an empty map.
+func makeMap(v *MapValue, mapType reflect.Type) (bool, reflect.Value) {
+	if v == nil {
+		v = &MapValue{}
+	}
+	mi, ok := convertValue(reflect.ValueOf(v), mapType, reflect.Value{})
+	return ok, mi
 }
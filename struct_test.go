@@ -7,6 +7,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"reflect"
+	"runtime"
 	"testing"
 )
 
@@ -71,12 +72,12 @@ func TestStruct(t *testing.T) {
 			Role:    "Baz",
 		},
 	}
-	data, err := encode(reflect.ValueOf(v))
+	data, err := defaultCodec.encode(reflect.ValueOf(v))
 	require.NoError(t, err)
 	fmt.Printf("\n%s\n", hex.Dump(data))
 	//assert.Equal(t, []byte{0x81, 0x4e, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x31, 0xd, 0x3b, 0x1c, 0xa1, 0x8, 0x56, 0x69, 0x74, 0x6f, 0xa1, 0x16, 0x68, 0x65, 0x79, 0x40, 0x76, 0x69, 0x74, 0x6f, 0x2e, 0x69, 0x6f, 0x61, 0xc, 0xa2, 0x61, 0xa2, 0x62, 0xa2, 0x63}, data)
 	assert.Equal(t, Struct, detectType(data[0]))
-	str, err := decodeStruct(data[0], bytes.NewReader(data[1:]))
+	str, err := defaultCodec.decodeStruct(data[0], bytes.NewReader(data[1:]))
 	require.NoError(t, err)
 	fmt.Printf("%#v\n", str)
 	ty, decodedStr, err := Decode(bytes.NewReader(data))
@@ -102,3 +103,414 @@ func TestStruct(t *testing.T) {
 	assert.Equal(t, "Baz", ss.SingleOther.Role)
 	assert.Nil(t, ss.OptionalTS)
 }
+
+type SparseTS struct {
+	*Structure
+	A     int               `index:"0"`
+	B     string            `index:"1"`
+	C     []string          `index:"2"`
+	D     map[string]string `index:"3"`
+	E     *OtherTS          `index:"4"`
+	F     uint64            `index:"5"`
+	G     *string           `index:"6,0"`
+	HasG  bool
+	H     *int `index:"6,1"`
+	HasH  bool
+	Extra string `index:"7"`
+}
+
+func (SparseTS) YarpID() uint64         { return 0x3 }
+func (SparseTS) YarpPackage() string    { return "io.vito" }
+func (SparseTS) YarpStructName() string { return "SparseTS" }
+func (SparseTS) YarpSparse() bool       { return true }
+
+type SparseTSv1 struct {
+	*Structure
+	A int    `index:"0"`
+	B string `index:"1"`
+}
+
+func (SparseTSv1) YarpID() uint64         { return 0x3 }
+func (SparseTSv1) YarpPackage() string    { return "io.vito" }
+func (SparseTSv1) YarpStructName() string { return "SparseTS" }
+
+func TestSparseStruct(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(SparseTS{}, OtherTS{})
+	h := 27
+	v := SparseTS{
+		F: 10,
+		H: &h,
+	}
+
+	positional, err := EncodeVersion(v, WireVersion2)
+	require.NoError(t, err)
+	sparse, err := EncodeVersion(v, WireVersion3)
+	require.NoError(t, err)
+	assert.Less(t, len(sparse), len(positional))
+	assert.Equal(t, byte(0x90), sparse[0]&0xF0)
+
+	for _, data := range [][]byte{positional, sparse} {
+		_, decoded, err := DecodeVersion(bytes.NewReader(data), WireVersion3)
+		require.NoError(t, err)
+		ss := decoded.(*SparseTS)
+		assert.Zero(t, ss.A)
+		assert.Empty(t, ss.B)
+		assert.Empty(t, ss.C)
+		assert.Nil(t, ss.E)
+		assert.Equal(t, uint64(10), ss.F)
+		assert.Nil(t, ss.G)
+		assert.False(t, ss.HasG)
+		require.NotNil(t, ss.H)
+		assert.Equal(t, 27, *ss.H)
+		assert.True(t, ss.HasH)
+	}
+
+	t.Run("unknown fields", func(t *testing.T) {
+		t.Cleanup(resetRegistry)
+		resetRegistry()
+		RegisterStructType(SparseTSv1{})
+		data, err := EncodeVersion(SparseTS{A: 1, Extra: "new"}, WireVersion3)
+		require.NoError(t, err)
+		_, decoded, err := DecodeVersion(bytes.NewReader(data), WireVersion3)
+		require.NoError(t, err)
+		ss := decoded.(*SparseTSv1)
+		assert.Equal(t, 1, ss.A)
+		require.Len(t, ss.UnknownFields, 1)
+		assert.Equal(t, 7, ss.UnknownFields[0].Index)
+		assert.Equal(t, String, ss.UnknownFields[0].Type)
+		assert.Equal(t, "new", ss.UnknownFields[0].Data)
+	})
+}
+
+func TestDecodeReuse(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(TS{}, OtherTS{})
+	strValue := "test"
+	first, err := Encode(TS{
+		ID:      1,
+		Name:    "Vito",
+		Keys:    []string{"a", "b", "c"},
+		AMap:    map[string]int{"a": 1, "b": 2},
+		OneOfA:  &strValue,
+		IsAdmin: true,
+	})
+	require.NoError(t, err)
+	b := 2
+	second, err := Encode(TS{
+		ID:     2,
+		Keys:   []string{"d", "e"},
+		AMap:   map[string]int{"c": 3},
+		OneOfB: &b,
+	})
+	require.NoError(t, err)
+
+	v := &TS{}
+	require.NoError(t, DecodeReuse(bytes.NewReader(first), v))
+	assert.Equal(t, 1, v.ID)
+	assert.Equal(t, "Vito", v.Name)
+	assert.Equal(t, []string{"a", "b", "c"}, v.Keys)
+	assert.True(t, v.HasOneOfA)
+	keys := v.Keys
+	structure := v.Structure
+
+	require.NoError(t, DecodeReuse(bytes.NewReader(second), v))
+	assert.Equal(t, 2, v.ID)
+	assert.Empty(t, v.Name)
+	assert.Equal(t, []string{"d", "e"}, v.Keys)
+	assert.Same(t, &keys[0], &v.Keys[0])
+	assert.Equal(t, map[string]int{"c": 3}, v.AMap)
+	assert.Nil(t, v.OneOfA)
+	assert.False(t, v.HasOneOfA)
+	require.NotNil(t, v.OneOfB)
+	assert.Equal(t, 2, *v.OneOfB)
+	assert.True(t, v.HasOneOfB)
+	assert.False(t, v.IsAdmin)
+	assert.Same(t, structure, v.Structure)
+
+	err = DecodeReuse(bytes.NewReader(first), &OtherTS{})
+	assert.ErrorIs(t, err, ErrStructTypeMismatch)
+}
+
+func TestDecodeReuseVersion(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(SparseTS{}, OtherTS{})
+	h := -27
+	data, err := EncodeVersion(SparseTS{
+		A: -1,
+		C: []string{},
+		E: &OtherTS{Project: "p"},
+		H: &h,
+	}, LatestWireVersion)
+	require.NoError(t, err)
+
+	g := "g"
+	v := &SparseTS{
+		B:    "stale",
+		C:    []string{"stale"},
+		D:    map[string]string{"stale": "stale"},
+		E:    &OtherTS{Role: "stale"},
+		F:    1,
+		G:    &g,
+		HasG: true,
+	}
+	e := v.E
+	require.NoError(t, DecodeReuseVersion(bytes.NewReader(data), v, LatestWireVersion))
+	assert.Equal(t, -1, v.A)
+	assert.Empty(t, v.B)
+	assert.NotNil(t, v.C)
+	assert.Empty(t, v.C)
+	assert.Nil(t, v.D)
+	assert.Same(t, e, v.E)
+	assert.Equal(t, "p", v.E.Project)
+	assert.Empty(t, v.E.Role)
+	assert.Zero(t, v.F)
+	assert.Nil(t, v.G)
+	assert.False(t, v.HasG)
+	require.NotNil(t, v.H)
+	assert.Equal(t, -27, *v.H)
+	assert.True(t, v.HasH)
+
+	err = DecodeReuseVersion(bytes.NewReader(data), v, LatestWireVersion+1)
+	assert.Equal(t, ErrUnsupportedWireVersion, err)
+
+	t.Run("unknown fields", func(t *testing.T) {
+		t.Cleanup(resetRegistry)
+		resetRegistry()
+		RegisterStructType(SparseTSv1{})
+		data, err := EncodeVersion(SparseTS{A: 1, Extra: "new"}, WireVersion3)
+		require.NoError(t, err)
+		v := &SparseTSv1{B: "stale"}
+		require.NoError(t, DecodeReuseVersion(bytes.NewReader(data), v, WireVersion3))
+		assert.Equal(t, 1, v.A)
+		assert.Empty(t, v.B)
+		require.Len(t, v.UnknownFields, 1)
+		assert.Equal(t, 7, v.UnknownFields[0].Index)
+		assert.Equal(t, "new", v.UnknownFields[0].Data)
+	})
+
+	t.Run("mismatched field", func(t *testing.T) {
+		data, err := Encode(OtherTS{Project: "p", Role: "r"})
+		require.NoError(t, err)
+		// Role is encoded as a string, which cannot be held by an int.
+		mismatched := &MismatchedTS{Role: 3}
+		require.NoError(t, DecodeReuse(bytes.NewReader(data), mismatched))
+		assert.Equal(t, "p", mismatched.Project)
+		assert.Zero(t, mismatched.Role)
+		require.Len(t, mismatched.UnknownFields, 1)
+		assert.Equal(t, "r", mismatched.UnknownFields[0].Data)
+	})
+}
+
+// MismatchedTS shares its ID with OtherTS, declaring Role with another type.
+type MismatchedTS struct {
+	*Structure
+	Project string `index:"0"`
+	Role    int    `index:"1"`
+}
+
+func (MismatchedTS) YarpID() uint64         { return 0x2 }
+func (MismatchedTS) YarpPackage() string    { return "io.vito" }
+func (MismatchedTS) YarpStructName() string { return "TS2" }
+
+func TestDecodeReuseAllocs(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(TS{}, OtherTS{})
+	b := -10
+	data, err := EncodeVersion(TS{
+		ID:          -1,
+		Keys:        []string{"a", "b", "c"},
+		Other:       []OtherTS{{Project: "Foo", Role: "Bar"}, {Project: "Fuz"}},
+		AMap:        map[string]int{"a": 1, "b": -2},
+		OneOfB:      &b,
+		IsAdmin:     true,
+		SingleOther: OtherTS{Project: "Baz"},
+		OptionalTS:  &OtherTS{Role: "Qux"},
+	}, LatestWireVersion)
+	require.NoError(t, err)
+
+	decodeAllocs := testing.AllocsPerRun(100, func() {
+		_, _, _ = DecodeVersion(bytes.NewReader(data), LatestWireVersion)
+	})
+	v := &TS{}
+	require.NoError(t, DecodeReuseVersion(bytes.NewReader(data), v, LatestWireVersion))
+	keys, other, optional := v.Keys, v.Other, v.OptionalTS
+	reuseAllocs := testing.AllocsPerRun(100, func() {
+		_ = DecodeReuseVersion(bytes.NewReader(data), v, LatestWireVersion)
+	})
+	t.Logf("Decode: %.0f allocs, DecodeReuse: %.0f allocs", decodeAllocs, reuseAllocs)
+	assert.Less(t, reuseAllocs, decodeAllocs)
+	assert.Same(t, &keys[0], &v.Keys[0])
+	assert.Same(t, &other[0], &v.Other[0])
+	assert.Same(t, optional, v.OptionalTS)
+	assert.Equal(t, "Qux", v.OptionalTS.Role)
+	assert.Equal(t, -1, v.ID)
+	assert.Equal(t, -10, *v.OneOfB)
+	assert.Equal(t, map[string]int{"a": 1, "b": -2}, v.AMap)
+}
+
+func TestDecodeReuseOversizedStruct(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(OtherTS{})
+	// A struct claiming a body close to sizeLimit, followed by its ID only.
+	data := appendInteger(nil, sizeLimit-1, 0x80)
+	data = append(data, 0x02, 0, 0, 0, 0, 0, 0, 0)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_ = DecodeReuse(bytes.NewReader(data), &OtherTS{})
+	runtime.ReadMemStats(&after)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+type Matrix struct {
+	*Structure
+	Ints        [][]int                 `index:"0"`
+	StringMaps  []map[string]string     `index:"1"`
+	OtherLists  map[string][]*OtherTS   `index:"2"`
+	OtherByID   map[int]OtherTS         `index:"3"`
+	Nested      []TS                    `index:"4"`
+	Pointers    []*int                  `index:"5"`
+	IntPtr      *int                    `index:"6"`
+	StringPtr   *string                 `index:"7"`
+	OtherPtr    *OtherTS                `index:"8"`
+	Floats      [][]float64             `index:"9"`
+	Bools       []bool                  `index:"10"`
+	MapOfMaps   map[string]map[int8]int `index:"11"`
+	Uints       []uint16                `index:"12"`
+	Float32Ptr  *float32                `index:"13"`
+	NestedMaps  map[uint32][]string     `index:"14"`
+	OtherList2D [][]OtherTS             `index:"15"`
+	Message     StructValuer            `index:"16"`
+	Messages    []StructValuer          `index:"17"`
+	MessageMap  map[string]StructValuer `index:"18"`
+}
+
+func (Matrix) YarpID() uint64         { return 0x8 }
+func (Matrix) YarpPackage() string    { return "io.vito" }
+func (Matrix) YarpStructName() string { return "Matrix" }
+
+func TestNestedContainers(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(Matrix{}, TS{}, OtherTS{})
+
+	one, str, f := 1, "str", float32(1.5)
+	tests := []struct {
+		name  string
+		value Matrix
+	}{
+		{"slice of slices", Matrix{Ints: [][]int{{1, 2}, {}, {-3}}}},
+		{"slice of maps", Matrix{StringMaps: []map[string]string{{"a": "b"}, {"c": "d", "e": "f"}}}},
+		{"map of slices of pointers", Matrix{OtherLists: map[string][]*OtherTS{
+			"a": {{Project: "p1"}, {Role: "r1"}},
+			"b": {{Project: "p2", Role: "r2"}},
+		}}},
+		{"map of structs", Matrix{OtherByID: map[int]OtherTS{1: {Project: "p"}, -2: {Role: "r"}}}},
+		{"slice of oneof-bearing structs", Matrix{Nested: []TS{
+			{ID: 1, OneOfA: &str, HasOneOfA: true},
+			{ID: 2, OneOfB: &one, HasOneOfB: true, Keys: []string{"k"}},
+		}}},
+		{"slice of pointers", Matrix{Pointers: []*int{&one, &one}}},
+		{"pointer to scalar", Matrix{IntPtr: &one}},
+		{"pointer to string", Matrix{StringPtr: &str}},
+		{"pointer to struct", Matrix{OtherPtr: &OtherTS{Project: "p"}}},
+		{"slice of float slices", Matrix{Floats: [][]float64{{1.5, -2.25}, {3}}}},
+		{"slice of bools", Matrix{Bools: []bool{true, false, true}}},
+		{"map of maps", Matrix{MapOfMaps: map[string]map[int8]int{"a": {1: 2, -3: 4}}}},
+		{"slice of unsigned", Matrix{Uints: []uint16{1, 65535}}},
+		{"pointer to float", Matrix{Float32Ptr: &f}},
+		{"map of string slices", Matrix{NestedMaps: map[uint32][]string{7: {"a", "b"}}}},
+		{"slice of struct slices", Matrix{OtherList2D: [][]OtherTS{{{Project: "a"}}, {{Role: "b"}, {Project: "c"}}}}},
+		{"interface", Matrix{Message: &OtherTS{Project: "p"}}},
+		{"slice of interfaces", Matrix{Messages: []StructValuer{&OtherTS{Project: "p"}, &TS{ID: 3}}}},
+		{"map of interfaces", Matrix{MessageMap: map[string]StructValuer{"a": &OtherTS{Role: "r"}}}},
+	}
+
+	// Reused across cases, so that DecodeReuse overwrites values left by
+	// previous ones.
+	reused := &Matrix{}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := Encode(tc.value)
+			require.NoError(t, err)
+			_, v, err := Decode(bytes.NewReader(data))
+			require.NoError(t, err)
+			require.IsType(t, &Matrix{}, v)
+			decoded := v.(*Matrix)
+			assert.Empty(t, decoded.UnknownFields)
+			assert.True(t, Equal(&tc.value, decoded), "expected %#v, got %#v", tc.value, *decoded)
+
+			require.NoError(t, DecodeReuse(bytes.NewReader(data), reused))
+			assert.Empty(t, reused.UnknownFields)
+			assert.True(t, Equal(&tc.value, reused), "expected %#v, got %#v", tc.value, *reused)
+		})
+	}
+}
+
+type Update struct {
+	*Structure
+	Tags   *[]string         `index:"0"`
+	Labels map[string]string `index:"1"`
+	Names  []string          `index:"2"`
+}
+
+func (Update) YarpID() uint64         { return 0x9 }
+func (Update) YarpPackage() string    { return "io.vito" }
+func (Update) YarpStructName() string { return "Update" }
+
+func TestNilAndEmptyContainers(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterStructType(Update{})
+
+	roundTrip := func(t *testing.T, u Update, version WireVersion) *Update {
+		data, err := EncodeVersion(u, version)
+		require.NoError(t, err)
+		_, v, err := DecodeVersion(bytes.NewReader(data), version)
+		require.NoError(t, err)
+		require.IsType(t, &Update{}, v)
+		return v.(*Update)
+	}
+
+	t.Run("nil", func(t *testing.T) {
+		u := roundTrip(t, Update{}, WireVersion4)
+		assert.Nil(t, u.Tags)
+		assert.Nil(t, u.Labels)
+		assert.Nil(t, u.Names)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		u := roundTrip(t, Update{
+			Tags:   &[]string{},
+			Labels: map[string]string{},
+			Names:  []string{},
+		}, WireVersion4)
+		require.NotNil(t, u.Tags)
+		assert.NotNil(t, *u.Tags)
+		assert.Empty(t, *u.Tags)
+		assert.NotNil(t, u.Labels)
+		assert.Empty(t, u.Labels)
+		assert.NotNil(t, u.Names)
+		assert.Empty(t, u.Names)
+	})
+
+	t.Run("empty on older versions", func(t *testing.T) {
+		u := roundTrip(t, Update{
+			Tags:   &[]string{},
+			Labels: map[string]string{},
+			Names:  []string{},
+		}, WireVersion3)
+		require.NotNil(t, u.Tags)
+		assert.Nil(t, *u.Tags)
+		assert.Nil(t, u.Labels)
+		assert.Nil(t, u.Names)
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		dst := &Update{Tags: &[]string{"a"}, Names: []string{"b"}}
+		require.NoError(t, Merge(dst, roundTrip(t, Update{Names: []string{"c"}}, WireVersion4)))
+		assert.Equal(t, []string{"a"}, *dst.Tags)
+		assert.Equal(t, []string{"b", "c"}, dst.Names)
+
+		require.NoError(t, Merge(dst, roundTrip(t, Update{Tags: &[]string{}}, WireVersion4)))
+		assert.Empty(t, *dst.Tags)
+	})
+}
@@ -0,0 +1,151 @@
+package yarp
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// trailersHeader is the reserved header used by clients to announce that they
+// are able to receive a Trailer at the end of streamed responses, and by
+// servers to indicate that a response will end with one.
+const trailersHeader = "Yarp-Trailers"
+
+var trailerContextKey = &contextKey{"trailer"}
+
+// trailerSetter holds trailer headers set by a handler.
+type trailerSetter struct {
+	mu sync.Mutex
+	h  Header
+}
+
+func (t *trailerSetter) headers() Header {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.h.Clone()
+}
+
+// SetTrailer sets a header to be sent to the client in the Trailer of a
+// response, once its handler returns. Unary responses provide their Trailer
+// after their body, while streamed responses provide it after their last
+// value. ctx must be the context provided to the handler. Returns false in
+// case ctx does not belong to a handler, or the client is unable to receive
+// trailers.
+func SetTrailer(ctx context.Context, key, value string) bool {
+	t, ok := ctx.Value(trailerContextKey).(*trailerSetter)
+	if !ok {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.h.Set(key, value)
+	return true
+}
+
+// StreamStatus represents the final status of a streamed response.
+type StreamStatus struct {
+	done    chan struct{}
+	trailer map[string]string
+	err     error
+}
+
+func (s *StreamStatus) finish(trailer map[string]string, err error) {
+	if err == io.EOF {
+		err = nil
+	}
+	s.trailer, s.err = trailer, err
+	close(s.done)
+}
+
+// Wait blocks until the stream is finished, and returns its trailer headers
+// along with its final status. The returned error is nil in case the stream
+// completed successfully, the Error provided by the server in case it failed,
+// or ErrStreamTruncated in case it was interrupted. Servers unable to send
+// trailers provide no headers, and their streams are considered complete once
+// their connection is closed.
+func (s *StreamStatus) Wait() (map[string]string, error) {
+	<-s.done
+	return s.trailer, s.err
+}
+
+// streamReader reads the values of a streamed response, along with its
+// Trailer, in case the server provides one.
+type streamReader struct {
+	ctx      context.Context
+	conn     bufferedConn
+	codec    codec
+	trailers bool
+	last     *Blob
+	trailer  map[string]string
+}
+
+func newStreamReader(ctx context.Context, conn bufferedConn, res *Response) (*streamReader, error) {
+	resCodec, err := responseCodec(res)
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{
+		ctx:      ctx,
+		conn:     conn,
+		codec:    resCodec,
+		trailers: Header(res.Headers).Get(trailersHeader) != "",
+	}, nil
+}
+
+// next returns the next value of the stream. Returns io.EOF once the stream
+// completes, the Error provided by the server in case it failed, or
+// ErrStreamTruncated in case the connection was closed before a Trailer was
+// received. In case the last value returned contains a streamed Blob, next
+// blocks until it is consumed.
+func (r *streamReader) next() (interface{}, error) {
+	if r.last.streaming() {
+		<-r.last.done()
+	}
+	if r.trailers {
+		head, err := r.conn.Peek(1)
+		if err == io.EOF {
+			err = ErrStreamTruncated
+		}
+		if err != nil {
+			return nil, contextError(r.ctx, err)
+		}
+		if head[0] == trailerMarker {
+			t := Trailer{}
+			if err = t.Decode(r.conn); err != nil {
+				return nil, contextError(r.ctx, err)
+			}
+			r.trailer = t.Headers
+			if t.Err != nil {
+				return nil, *t.Err
+			}
+			return nil, io.EOF
+		}
+	}
+	_, v, err := r.codec.decode(r.conn)
+	if err != nil {
+		return nil, contextError(r.ctx, err)
+	}
+	r.last = topLevelBlob(reflect.ValueOf(v))
+	return v, nil
+}
+
+// readTrailer reads the Trailer following the body of a unary response, in
+// case the server announced one. Returns the Error provided by the server
+// instead, if any.
+func readTrailer(ctx context.Context, conn bufferedConn, res *Response) (map[string]string, error) {
+	if Header(res.Headers).Get(trailersHeader) == "" {
+		return nil, nil
+	}
+	t := Trailer{}
+	if err := t.Decode(conn); err != nil {
+		if err == io.EOF {
+			err = ErrStreamTruncated
+		}
+		return nil, contextError(ctx, err)
+	}
+	if t.Err != nil {
+		return t.Headers, *t.Err
+	}
+	return t.Headers, nil
+}
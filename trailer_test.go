@@ -0,0 +1,270 @@
+package yarp
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestTrailer(t *testing.T) {
+	for _, tr := range []Trailer{
+		{Headers: map[string]string{"Count": "2"}},
+		{Headers: map[string]string{}, Err: &Error{Kind: ErrorKindManagedError, Headers: map[string]string{}, Identifier: "boom", UserData: map[string]string{}}},
+	} {
+		data, err := tr.Encode()
+		require.NoError(t, err)
+		assert.Equal(t, trailerMarker, data[0])
+
+		decoded := Trailer{}
+		require.NoError(t, decoded.Decode(bytes.NewReader(data)))
+		assert.Equal(t, tr, decoded)
+	}
+
+	err := (&Trailer{}).Decode(bytes.NewReader([]byte{0x00}))
+	assert.ErrorIs(t, err, ErrCorruptStream)
+}
+
+func TestStreamTrailers(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	failure := Error{Kind: ErrorKindManagedError, Identifier: "boom"}
+	s := NewServer(l.Addr().String())
+	// Pushes as many values as requested by Name, failing afterwards in case
+	// Email is set.
+	s.RegisterHandler(0x1, "io.vito.Trailers.count", func(ctx context.Context, headers Header, req *SimpleRequest, out *SimpleResponseStreamer) error {
+		n, err := strconv.Atoi(req.Name)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			out.Push(&SimpleResponse{ID: int32(i)})
+		}
+		SetTrailer(ctx, "Count", req.Name)
+		if req.Email != "" {
+			return failure
+		}
+		return nil
+	})
+	s.RegisterHandler(0x2, "io.vito.Trailers.echo", func(ctx context.Context, headers Header, in *SimpleRequestReceiver, out *SimpleResponseStreamer) error {
+		if _, err := in.Recv(); err != nil {
+			return err
+		}
+		out.Push(&SimpleResponse{})
+		SetTrailer(ctx, "Echoed", "1")
+		return failure
+	})
+	go func() {
+		_ = s.StartListener(l)
+	}()
+	c := NewClient(l.Addr().String())
+
+	collect := func(t *testing.T, req *SimpleRequest) ([]interface{}, map[string]string, error) {
+		ch, _, status, err := c.DoRequestStreamedWithStatus(context.Background(), Request{Method: 0x1}, req)
+		require.NoError(t, err)
+		var values []interface{}
+		for v := range ch {
+			values = append(values, v)
+		}
+		trailer, err := status.Wait()
+		return values, trailer, err
+	}
+
+	t.Run("completed", func(t *testing.T) {
+		values, trailer, err := collect(t, &SimpleRequest{Name: "3"})
+		require.NoError(t, err)
+		assert.Len(t, values, 3)
+		assert.Equal(t, "3", Header(trailer).Get("Count"))
+	})
+
+	t.Run("failed halfway", func(t *testing.T) {
+		values, trailer, err := collect(t, &SimpleRequest{Name: "2", Email: "fail"})
+		assert.Len(t, values, 2)
+		assert.Equal(t, "2", Header(trailer).Get("Count"))
+		ok, managed := IsManagedError(err)
+		require.True(t, ok, err)
+		assert.Equal(t, failure.Kind, managed.Kind)
+		assert.Equal(t, failure.Identifier, managed.Identifier)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		values, trailer, err := collect(t, &SimpleRequest{Name: "0"})
+		require.NoError(t, err)
+		assert.Empty(t, values)
+		assert.Equal(t, "0", Header(trailer).Get("Count"))
+
+		_, _, err = collect(t, &SimpleRequest{Name: "0", Email: "fail"})
+		ok, _ := IsManagedError(err)
+		assert.True(t, ok, err)
+	})
+
+	t.Run("bidirectional", func(t *testing.T) {
+		s, err := c.NewStream(context.Background(), Request{Method: 0x2})
+		require.NoError(t, err)
+		require.NoError(t, s.Send(&SimpleRequest{}))
+		_, err = s.Recv()
+		require.NoError(t, err)
+		_, err = s.Recv()
+		ok, managed := IsManagedError(err)
+		require.True(t, ok, err)
+		assert.Equal(t, failure.Identifier, managed.Identifier)
+		assert.Equal(t, "1", Header(s.Trailer()).Get("Echoed"))
+	})
+
+	t.Run("unavailable outside handlers", func(t *testing.T) {
+		assert.False(t, SetTrailer(context.Background(), "Key", "Value"))
+	})
+}
+
+func TestUnaryTrailers(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	s := NewServer(l.Addr().String(), WithMultiplexing())
+	s.RegisterHandler(0x1, "io.vito.Trailers.cost", func(ctx context.Context, headers Header, req *SimpleRequest) (Header, *SimpleResponse, error) {
+		if req.Name != "" {
+			SetTrailer(ctx, "Cost", req.Name)
+		}
+		return nil, &SimpleResponse{ID: 1}, nil
+	})
+	s.RegisterHandler(0x2, "io.vito.Trailers.upload", func(ctx context.Context, headers Header, in *SimpleRequestReceiver) (Header, *SimpleResponse, error) {
+		count := 0
+		for {
+			if _, err := in.Recv(); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, nil, err
+			}
+			count++
+		}
+		SetTrailer(ctx, "Count", strconv.Itoa(count))
+		return nil, &SimpleResponse{}, nil
+	})
+	go func() {
+		_ = s.StartListener(l)
+	}()
+	clients := map[string]*Client{
+		"dedicated":   NewClient(l.Addr().String()),
+		"multiplexed": NewClient(l.Addr().String(), WithMultiplexing()),
+	}
+
+	for name, c := range clients {
+		t.Run(name, func(t *testing.T) {
+			t.Cleanup(func() {
+				_ = c.Close()
+			})
+			res, _, trailer, err := c.DoRequestWithTrailer(context.Background(), Request{Method: 0x1}, &SimpleRequest{Name: "12"})
+			require.NoError(t, err)
+			assert.Equal(t, int32(1), res.(*SimpleResponse).ID)
+			assert.Equal(t, "12", Header(trailer).Get("Cost"))
+
+			_, _, trailer, err = c.DoRequestWithTrailer(context.Background(), Request{Method: 0x1}, &SimpleRequest{})
+			require.NoError(t, err)
+			assert.Empty(t, trailer)
+
+			stream, err := c.NewStream(context.Background(), Request{Method: 0x2})
+			require.NoError(t, err)
+			require.NoError(t, stream.Send(&SimpleRequest{}))
+			require.NoError(t, stream.Send(&SimpleRequest{}))
+			_, _, err = stream.CloseAndRecv()
+			require.NoError(t, err)
+			assert.Equal(t, "2", Header(stream.Trailer()).Get("Count"))
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		reply, err := Response{Headers: map[string]string{trailersHeader: "1"}}.Encode()
+		require.NoError(t, err)
+		value, err := Encode(&SimpleResponse{ID: 1})
+		require.NoError(t, err)
+		c := NewClient(serveRaw(t, append(reply, value...)))
+		_, _, _, err = c.DoRequestWithTrailer(context.Background(), Request{Method: 0x1}, &SimpleRequest{})
+		assert.Equal(t, ErrStreamTruncated, err)
+	})
+}
+
+// serveRaw accepts a single connection, reads a request and replies with the
+// provided bytes, closing the connection afterwards.
+func serveRaw(t *testing.T, reply []byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req := Request{}
+		if err = req.Decode(conn); err != nil {
+			return
+		}
+		if _, _, err = Decode(conn); err != nil {
+			return
+		}
+		_, _ = conn.Write(reply)
+	}()
+	return l.Addr().String()
+}
+
+func TestStreamStatusWithoutTrailer(t *testing.T) {
+	t.Cleanup(resetRegistry)
+	RegisterMessages()
+	value, err := Encode(&SimpleResponse{ID: 1})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		err     error
+	}{
+		{"truncated", map[string]string{trailersHeader: "1"}, ErrStreamTruncated},
+		{"legacy server", map[string]string{}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reply, err := Response{Headers: tc.headers, Stream: true}.Encode()
+			require.NoError(t, err)
+			c := NewClient(serveRaw(t, append(reply, value...)))
+			ch, _, status, err := c.DoRequestStreamedWithStatus(context.Background(), Request{Method: 0x1}, &SimpleRequest{})
+			require.NoError(t, err)
+			count := 0
+			for range ch {
+				count++
+			}
+			assert.Equal(t, 1, count)
+			trailer, err := status.Wait()
+			assert.Nil(t, trailer)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+
+	t.Run("truncated value", func(t *testing.T) {
+		reply, err := Response{Headers: map[string]string{trailersHeader: "1"}, Stream: true}.Encode()
+		require.NoError(t, err)
+		c := NewClient(serveRaw(t, append(reply, value[:len(value)-1]...)))
+		ch, _, status, err := c.DoRequestStreamedWithStatus(context.Background(), Request{Method: 0x1}, &SimpleRequest{})
+		require.NoError(t, err)
+		for range ch {
+		}
+		_, err = status.Wait()
+		assert.Error(t, err)
+		assert.NotEqual(t, io.EOF, err)
+	})
+}
@@ -86,11 +86,18 @@ func canEncode(t reflect.Type) bool {
 	case reflect.Float32, reflect.Float64, reflect.Bool:
 		return true
 	case reflect.Slice, reflect.Pointer:
+		if t == reflectedBlobPtr {
+			return true
+		}
 		return canEncode(t.Elem())
 	case reflect.Map:
 		return canEncodeMap(t)
 	case reflect.Struct:
 		return canEncodeStruct(t)
+	case reflect.Interface:
+		// Only interfaces whose values are messages, such as StructValuer,
+		// are allowed. Values are checked during encoding.
+		return t.Implements(reflectedValuer)
 	}
 
 	return false
@@ -110,3 +117,13 @@ func canEncodeStruct(t reflect.Type) bool {
 	}
 	return sf.Type == reflectedStructure
 }
+
+// isNilValue indicates whether v is either nil, or a nil pointer, both of
+// which are encoded as Void.
+func isNilValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Pointer && rv.IsNil()
+}
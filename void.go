@@ -1,3 +1,5 @@
 package yarp
 
 func encodeVoid() []byte { return []byte{0x00} }
+
+func appendVoid(dst []byte) []byte { return append(dst, 0x00) }
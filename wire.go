@@ -16,22 +16,30 @@ var (
 
 // Request represents an internal representation of an incoming request through
 // a stream. Method indicates which handler should be called, and Headers
-// contains any metadata sent by a client.
+// contains any metadata sent by a client. MethodFQN optionally holds the
+// fully-qualified name of the method, which is not transmitted, and is only
+// used by Clients to identify the method in log entries.
 type Request struct {
-	Method  uint64
-	Headers map[string]string
+	Method    uint64
+	Headers   map[string]string
+	MethodFQN string
 }
 
 // Encode encodes the Request header into a byte slice
 func (r Request) Encode() ([]byte, error) {
-	header := encodeUint(r.Method)
-	heads, err := encodeMap(reflect.ValueOf(r.Headers))
+	return r.appendEncode(nil)
+}
+
+func (r Request) appendEncode(dst []byte) ([]byte, error) {
+	heads := reflect.ValueOf(r.Headers)
+	headsLen, err := defaultCodec.sizeMap(heads)
 	if err != nil {
 		return nil, err
 	}
-	data := append(magicRequest, encodeUint(uint64(len(header)+len(heads)))...)
-	data = append(data, header...)
-	return append(data, heads...), nil
+	dst = append(dst, magicRequest...)
+	dst = appendUint(dst, uint64(sizeInteger(r.Method)+headsLen))
+	dst = appendUint(dst, r.Method)
+	return defaultCodec.appendMap(dst, heads)
 }
 
 // Decode reads from a given io.Reader the required bytes to compose a Request,
@@ -67,7 +75,7 @@ func (r *Request) Decode(re io.Reader) error {
 	if _, err = io.ReadFull(lr, head); err != nil {
 		return err
 	}
-	h, err := decodeMap(head[0], lr)
+	h, err := defaultCodec.decodeMap(head[0], lr)
 	if err != nil {
 		return err
 	}
@@ -91,17 +99,15 @@ type Response struct {
 
 // Encode encodes a given Response structure into a byte slice.
 func (r Response) Encode() ([]byte, error) {
-	heads, err := encodeMap(reflect.ValueOf(r.Headers))
-	if err != nil {
-		return nil, err
-	}
-	str, err := encode(reflect.ValueOf(r.Stream))
+	return r.appendEncode(nil)
+}
+
+func (r Response) appendEncode(dst []byte) ([]byte, error) {
+	dst, err := defaultCodec.appendMap(append(dst, magicResponse...), reflect.ValueOf(r.Headers))
 	if err != nil {
 		return nil, err
 	}
-	data := append(magicResponse, heads...)
-	data = append(data, str...)
-	return data, nil
+	return appendBool(dst, r.Stream), nil
 }
 
 // Decode reads all required bytes from a given io.Reader and fills the
@@ -119,7 +125,7 @@ func (r *Response) Decode(re io.Reader) error {
 	if _, err := io.ReadFull(re, head); err != nil {
 		return err
 	}
-	h, err := decodeMap(head[0], re)
+	h, err := defaultCodec.decodeMap(head[0], re)
 	if err != nil {
 		return err
 	}
@@ -142,6 +148,75 @@ func (r *Response) Decode(re io.Reader) error {
 	return nil
 }
 
+// trailerMarker precedes a Trailer within a streamed response. Since it is
+// decoded as a void value by peers unaware of trailers, it is only sent to
+// clients announcing support for them. See trailersHeader.
+const trailerMarker byte = 0x01
+
+// Trailer indicates the end of a streamed response, and contains a set of
+// arbitrary headers, followed by the stream's final status. Err is nil in case
+// the stream completed successfully.
+type Trailer struct {
+	Headers map[string]string
+	Err     *Error
+}
+
+// Encode encodes a given Trailer structure into a byte slice.
+func (t Trailer) Encode() ([]byte, error) {
+	return t.appendEncode(nil)
+}
+
+func (t Trailer) appendEncode(dst []byte) ([]byte, error) {
+	dst, err := defaultCodec.appendMap(append(dst, trailerMarker), reflect.ValueOf(t.Headers))
+	if err != nil {
+		return nil, err
+	}
+	if t.Err == nil {
+		return appendVoid(dst), nil
+	}
+	return t.Err.appendEncode(dst)
+}
+
+// Decode reads all required bytes from a given io.Reader and fills the
+// receiver's fields.
+func (t *Trailer) Decode(re io.Reader) error {
+	head := []byte{0x00}
+	if _, err := io.ReadFull(re, head); err != nil {
+		return err
+	}
+	if head[0] != trailerMarker {
+		return ErrCorruptStream
+	}
+
+	if _, err := io.ReadFull(re, head); err != nil {
+		return err
+	}
+	h, err := defaultCodec.decodeMap(head[0], re)
+	if err != nil {
+		return err
+	}
+	str := reflect.TypeOf("")
+	ok, mv := makeMap(h, reflect.MapOf(str, str))
+	if !ok {
+		return ErrCorruptStream
+	}
+	t.Headers = mv.Interface().(map[string]string)
+
+	if _, err := io.ReadFull(re, head); err != nil {
+		return err
+	}
+	t.Err = nil
+	if detectType(head[0]) == Void {
+		return nil
+	}
+	e := Error{}
+	if err = e.Decode(io.MultiReader(bytes.NewReader(head), re)); err != nil {
+		return err
+	}
+	t.Err = &e
+	return nil
+}
+
 // ErrorKind indicates one of the possible errors returned in a YARP stream.
 type ErrorKind uint
 
@@ -178,6 +253,11 @@ const (
 	// UserData fields, along with the service's documentation for further
 	// information.
 	ErrorKindBadRequest = 6
+
+	// ErrorKindDeadlineExceeded indicates that the server gave up on the
+	// operation, since it exceeded either the deadline provided by the client,
+	// or the maximum duration allowed by the server.
+	ErrorKindDeadlineExceeded = 7
 )
 
 var errorKindString = map[ErrorKind]string{
@@ -188,6 +268,7 @@ var errorKindString = map[ErrorKind]string{
 	ErrorKindTypeMismatch:        "Type Mismatch",
 	ErrorKindUnauthorized:        "Unauthorized",
 	ErrorKindBadRequest:          "Bad Request",
+	ErrorKindDeadlineExceeded:    "Deadline Exceeded",
 }
 
 // Error represents a handled error from the server or an underlying component.
@@ -240,25 +321,18 @@ func (e Error) Error() string {
 }
 
 func (e Error) Encode() ([]byte, error) {
-	kind := encodeUint(uint64(e.Kind))
-	heads, err := encodeMap(reflect.ValueOf(e.Headers))
-	if err != nil {
-		return nil, err
-	}
-	id, err := encode(reflect.ValueOf(e.Identifier))
-	if err != nil {
-		return nil, err
-	}
-	ud, err := encodeMap(reflect.ValueOf(e.UserData))
+	return e.appendEncode(nil)
+}
+
+func (e Error) appendEncode(dst []byte) ([]byte, error) {
+	dst = append(dst, magicError...)
+	dst = appendUint(dst, uint64(e.Kind))
+	dst, err := defaultCodec.appendMap(dst, reflect.ValueOf(e.Headers))
 	if err != nil {
 		return nil, err
 	}
-
-	data := append(magicError, kind...)
-	data = append(data, heads...)
-	data = append(data, id...)
-	data = append(data, ud...)
-	return data, nil
+	dst = appendString(dst, e.Identifier)
+	return defaultCodec.appendMap(dst, reflect.ValueOf(e.UserData))
 }
 
 func (e *Error) Decode(re io.Reader) error {
@@ -283,7 +357,7 @@ func (e *Error) Decode(re io.Reader) error {
 	if _, err := io.ReadFull(re, head); err != nil {
 		return err
 	}
-	h, err := decodeMap(head[0], re)
+	h, err := defaultCodec.decodeMap(head[0], re)
 	if err != nil {
 		return err
 	}
@@ -306,7 +380,7 @@ func (e *Error) Decode(re io.Reader) error {
 	if _, err := io.ReadFull(re, head); err != nil {
 		return err
 	}
-	h, err = decodeMap(head[0], re)
+	h, err = defaultCodec.decodeMap(head[0], re)
 	if err != nil {
 		return err
 	}